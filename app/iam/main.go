@@ -1,21 +1,26 @@
 package iam
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 )
 
-func StartServer() {
+func NewServer(repos *repository.Repositories, flags *helper.FeatureFlags, health *helper.Health, metrics *helper.Metrics) *http.Server {
 	cfg := helper.GetConfig()
-	r := NewRouter()
+	var providers []helper.IdentityProvider
+	for name, providerCfg := range cfg.OIDC.Providers {
+		providers = append(providers, helper.NewOIDCProvider(name, providerCfg))
+	}
+
+	r := NewRouter(repos, flags, providers...)
+	health.Register(r)
+	metrics.Register(r, helper.NewAuth(repos.Users, repos.APIKeys))
 
 	// Apply CORS middleware
-	corsRouter := helper.CORSMiddleware(r)
+	corsRouter := helper.CORSMiddleware("iam")(r)
+	handler := helper.RequestLogging("iam")(metrics.Routes(r)(helper.Hardening(corsRouter)))
 
-	log.Printf("Starting IAM service on port %s...", cfg.Server.IamPort)
-	if err := http.ListenAndServe(":"+cfg.Server.IamPort, corsRouter); err != nil {
-		log.Fatalf("Failed to start IAM server: %v", err)
-	}
+	return helper.NewServer(cfg.Server.IamPort, handler)
 }
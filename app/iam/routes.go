@@ -1,13 +1,70 @@
 package iam
 
 import (
+	"github.com/dianerwansyah/web-cart-backend/helper"
 	"github.com/dianerwansyah/web-cart-backend/logic"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 	"github.com/gorilla/mux"
 )
 
-func NewRouter() *mux.Router {
+func NewRouter(repos *repository.Repositories, flags *helper.FeatureFlags, providers ...helper.IdentityProvider) *mux.Router {
+	auth := helper.NewAuth(repos.Users, repos.APIKeys)
+	h := logic.NewAuthHandler(repos.Users, repos.AuthStates, flags, providers...)
+	a := logic.NewAdminHandler(repos, flags)
+	limiter := helper.NewRateLimiter(repos.RateLimits)
+
 	r := mux.NewRouter()
-	r.HandleFunc("/register", logic.RegisterHandler).Methods("POST")
-	r.HandleFunc("/login", logic.LoginHandler).Methods("POST")
+	r.Use(helper.RouteTracing("iam"), helper.RouteTimeouts())
+
+	r.HandleFunc("/register", helper.Handle(h.RegisterHandler)).Methods("POST")
+	r.HandleFunc("/login", helper.Handle(h.LoginHandler)).Methods("POST")
+	r.Handle("/login/mfa", limiter.Limit("mfa")(helper.Handle(h.LoginMFAHandler))).Methods("POST")
+	r.HandleFunc("/password/reset", helper.Handle(h.ResetPasswordHandler)).Methods("POST")
+
+	r.Handle("/mfa/enroll", auth.MFAEnrollmentMiddleware(helper.Handle(h.EnrollTOTP))).Methods("POST")
+	r.Handle("/mfa/enroll/confirm", auth.MFAEnrollmentMiddleware(helper.Handle(h.ConfirmTOTP))).Methods("POST")
+	r.Handle("/mfa/disable", auth.JWTMiddleware(helper.Handle(h.DisableTOTP))).Methods("POST")
+	r.Handle("/mfa/recovery-codes", auth.JWTMiddleware(helper.Handle(h.RegenerateRecoveryCodes))).Methods("POST")
+
+	r.HandleFunc("/auth/providers", helper.Handle(h.ListIdentityProviders)).Methods("GET")
+	r.HandleFunc("/auth/{provider}/login", helper.Handle(h.ExternalLoginHandler)).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", helper.Handle(h.ExternalCallbackHandler)).Methods("GET")
+	r.Handle("/auth/{provider}/link", auth.JWTMiddleware(helper.Handle(h.ExternalLinkHandler))).Methods("POST")
+	r.Handle("/auth/{provider}/unlink", auth.JWTMiddleware(helper.Handle(h.UnlinkIdentityHandler))).Methods("POST")
+
+	r.Handle("/flags", auth.JWTMiddleware(helper.Handle(logic.CurrentFlags(flags)))).Methods("GET")
+
+	// Admin routes accept admin JWTs, and API keys with the matching scope
+	// where integrations need them. API key management is JWT only.
+	adminOnly := helper.RequireRole(model.RoleAdmin)
+	usersRead := helper.RequireScope(model.ScopeUsersRead, model.RoleAdmin)
+	usersWrite := helper.RequireScope(model.ScopeUsersWrite, model.RoleAdmin)
+	cartsRead := helper.RequireScope(model.ScopeCartsRead, model.RoleAdmin)
+	ordersRead := helper.RequireScope(model.ScopeOrdersRead, model.RoleAdmin)
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(auth.JWTMiddleware)
+	admin.Handle("/users", usersRead(helper.Handle(a.ListUsers))).Methods("GET")
+	admin.Handle("/users/{id}", usersRead(helper.Handle(a.GetUserByID))).Methods("GET")
+	admin.Handle("/users/{id}/role", adminOnly(helper.Handle(a.UpdateUserRole))).Methods("PUT")
+	admin.Handle("/users/{id}/disable", usersWrite(helper.Handle(a.DisableUser))).Methods("POST")
+	admin.Handle("/users/{id}/enable", usersWrite(helper.Handle(a.EnableUser))).Methods("POST")
+	admin.Handle("/users/{id}/reset-password", adminOnly(helper.Handle(a.ForcePasswordReset))).Methods("POST")
+	admin.Handle("/users/{id}/mfa/reset", adminOnly(helper.Handle(a.ResetUserMFA))).Methods("POST")
+	admin.Handle("/users/{id}/carts", cartsRead(helper.Handle(a.GetUserCarts))).Methods("GET")
+	admin.Handle("/users/{id}/orders", ordersRead(helper.Handle(a.GetUserOrders))).Methods("GET")
+	admin.Handle("/audit", adminOnly(helper.Handle(a.GetAuditLogs))).Methods("GET")
+	admin.Handle("/api-keys", adminOnly(helper.Handle(a.ListAPIKeys))).Methods("GET")
+	admin.Handle("/api-keys", adminOnly(helper.Handle(a.CreateAPIKey))).Methods("POST")
+	admin.Handle("/api-keys/{id}", adminOnly(helper.Handle(a.RevokeAPIKey))).Methods("DELETE")
+	admin.Handle("/settings", adminOnly(helper.Handle(a.GetSettings))).Methods("GET")
+	admin.Handle("/settings/reload", adminOnly(helper.Handle(a.ReloadSettings))).Methods("POST")
+	admin.Handle("/flags", adminOnly(helper.Handle(a.ListFlags))).Methods("GET")
+	admin.Handle("/flags", adminOnly(helper.Handle(a.CreateFlag))).Methods("POST")
+	admin.Handle("/flags/{key}", adminOnly(helper.Handle(a.GetFlag))).Methods("GET")
+	admin.Handle("/flags/{key}", adminOnly(helper.Handle(a.UpdateFlag))).Methods("PUT")
+	admin.Handle("/flags/{key}", adminOnly(helper.Handle(a.DeleteFlag))).Methods("DELETE")
+	admin.Handle("/flags/{key}/evaluate", adminOnly(helper.Handle(a.EvaluateFlag))).Methods("GET")
 	return r
 }
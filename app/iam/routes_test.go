@@ -0,0 +1,1381 @@
+package iam
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/logic"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"github.com/golang-jwt/jwt"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("WEBCART_CONFIG", "../../config/config.yaml")
+	os.Setenv("WEBCART_PROFILE", "test")
+	os.Setenv("WEBCART_SERVER_JWT_SECRET", "test-only-insecure-jwt-secret")
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	t       *testing.T
+	repos   *repository.Repositories
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T, providers ...helper.IdentityProvider) *testServer {
+	repos := repository.NewMemory()
+	return &testServer{t: t, repos: repos, handler: NewRouter(repos, helper.NewFeatureFlags(repos.Flags), providers...)}
+}
+
+type requestOption func(r *http.Request)
+
+func withToken(token string) requestOption {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func withAPIKey(key string) requestOption {
+	return func(r *http.Request) { r.Header.Set("X-API-Key", key) }
+}
+
+// withCookies sends the cookies set by an earlier response, as a browser
+// would
+func withCookies(rec *httptest.ResponseRecorder) requestOption {
+	return func(r *http.Request) {
+		for _, cookie := range rec.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+func (s *testServer) do(method, path string, body interface{}, opts ...requestOption) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var reader *bytes.Reader
+	switch b := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(b))
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			s.t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	for _, opt := range opts {
+		opt(req)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d, body %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+func expectCode(t *testing.T, rec *httptest.ResponseRecorder, code string) {
+	t.Helper()
+	var problem helper.Problem
+	decode(t, rec, &problem)
+	if problem.Code != code {
+		t.Fatalf("problem code = %q, want %q, body %s", problem.Code, code, rec.Body.String())
+	}
+}
+
+func (s *testServer) createUser(username, password, role string) *model.User {
+	s.t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	user := &model.User{Username: username, Password: string(hash), Role: role, Created: time.Now()}
+	if err := s.repos.Users.Create(context.Background(), user); err != nil {
+		s.t.Fatalf("create user: %v", err)
+	}
+	return user
+}
+
+// tokenFor signs a JWT for user issued a minute ago, at the user's current
+// token version
+func (s *testServer) tokenFor(user *model.User) string {
+	s.t.Helper()
+	issued := time.Now().Add(-time.Minute)
+	claims := helper.Claims{
+		UserID:       user.ID.Hex(),
+		Username:     user.Username,
+		Role:         user.Role,
+		TokenVersion: user.TokenVersion,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt:  issued.Unix(),
+			ExpiresAt: issued.Add(time.Hour).Unix(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(helper.GetConfig().Server.JwtSecret))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+func TestRegister(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser("taken", "password123", model.RoleUser)
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{"valid", map[string]string{"username": "alice", "password": "password123"}, http.StatusCreated, ""},
+		{"deprecated role is ignored", map[string]string{"username": "carol", "password": "password123", "role": "admin"}, http.StatusCreated, ""},
+		{"duplicate username", map[string]string{"username": "taken", "password": "password123"}, http.StatusConflict, "user_exists"},
+		{"missing password", map[string]string{"username": "bob"}, http.StatusBadRequest, helper.CodeValidationFailed},
+		{"unknown field", map[string]string{"username": "bob", "password": "password123", "admin": "yes"}, http.StatusBadRequest, helper.CodeValidationFailed},
+		{"malformed json", `{"username":`, http.StatusBadRequest, "malformed_json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(http.MethodPost, "/register", tt.body)
+			expectStatus(t, rec, tt.status)
+			if tt.code != "" {
+				expectCode(t, rec, tt.code)
+			}
+			if rec.Code == http.StatusCreated {
+				var resp map[string]interface{}
+				decode(t, rec, &resp)
+				if _, ok := resp["password"]; ok || resp["role"] != model.RoleUser {
+					t.Fatalf("unexpected registration response %v", resp)
+				}
+			}
+		})
+	}
+
+	if _, err := s.repos.Users.FindByUsername(context.Background(), "alice"); err != nil {
+		t.Fatalf("registered user not stored: %v", err)
+	}
+	if carol, err := s.repos.Users.FindByUsername(context.Background(), "carol"); err != nil || carol.Role != model.RoleUser {
+		t.Fatalf("user asking for the admin role was stored as %+v, %v", carol, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("alice", "password123", model.RoleUser)
+	disabled := s.createUser("disabled", "password123", model.RoleUser)
+	s.repos.Users.SetDisabled(context.Background(), disabled.ID, true, time.Now())
+	reset := s.createUser("reset", "password123", model.RoleUser)
+	s.repos.Users.RequirePasswordReset(context.Background(), reset.ID, "hash", time.Now().Add(time.Hour), time.Now())
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		status   int
+		code     string
+	}{
+		{"valid", "alice", "password123", http.StatusOK, ""},
+		{"wrong password", "alice", "wrong-password", http.StatusUnauthorized, "invalid_credentials"},
+		{"unknown user", "nobody", "password123", http.StatusUnauthorized, "invalid_credentials"},
+		{"disabled account", "disabled", "password123", http.StatusForbidden, "account_disabled"},
+		{"password reset required", "reset", "password123", http.StatusForbidden, "password_reset_required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(http.MethodPost, "/login", map[string]string{"username": tt.username, "password": tt.password})
+			expectStatus(t, rec, tt.status)
+			if tt.code != "" {
+				expectCode(t, rec, tt.code)
+				return
+			}
+
+			var resp map[string]string
+			decode(t, rec, &resp)
+			if resp["userId"] != user.ID.Hex() || resp["token"] == "" {
+				t.Fatalf("unexpected login response %v", resp)
+			}
+			claims, err := helper.ParseToken(resp["token"])
+			if err != nil || claims.UserID != user.ID.Hex() {
+				t.Fatalf("token does not identify the user: %v %v", claims, err)
+			}
+		})
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.createUser("admin", "password123", model.RoleAdmin)
+	user := s.createUser("alice", "password123", model.RoleUser)
+	oldToken := s.tokenFor(user)
+
+	rec := s.do(http.MethodPost, "/admin/users/"+user.ID.Hex()+"/reset-password", nil, withToken(s.tokenFor(admin)))
+	expectStatus(t, rec, http.StatusOK)
+	var resp map[string]interface{}
+	decode(t, rec, &resp)
+	resetToken, _ := resp["resetToken"].(string)
+
+	// Issued tokens are revoked by the reset
+	rec = s.do(http.MethodPost, "/mfa/recovery-codes", map[string]string{"code": "000000"}, withToken(oldToken))
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	tests := []struct {
+		name   string
+		body   map[string]string
+		status int
+	}{
+		{"wrong token", map[string]string{"username": "alice", "resetToken": "wrong", "newPassword": "new-password"}, http.StatusUnauthorized},
+		{"short password", map[string]string{"username": "alice", "resetToken": resetToken, "newPassword": "short"}, http.StatusBadRequest},
+		{"valid", map[string]string{"username": "alice", "resetToken": resetToken, "newPassword": "new-password"}, http.StatusOK},
+		{"token reuse", map[string]string{"username": "alice", "resetToken": resetToken, "newPassword": "other-password"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do(http.MethodPost, "/password/reset", tt.body), tt.status)
+		})
+	}
+
+	rec = s.do(http.MethodPost, "/login", map[string]string{"username": "alice", "password": "new-password"})
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func totpCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	code, err := helper.TOTPCode(secret, helper.TOTPCounter(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestMFAFlow(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("alice", "password123", model.RoleUser)
+	token := s.tokenFor(user)
+
+	rec := s.do(http.MethodPost, "/mfa/enroll", nil, withToken(token))
+	expectStatus(t, rec, http.StatusOK)
+	var enroll map[string]string
+	decode(t, rec, &enroll)
+	secret := enroll["secret"]
+	if secret == "" || enroll["provisioningUri"] == "" {
+		t.Fatalf("unexpected enroll response %v", enroll)
+	}
+
+	rec = s.do(http.MethodPost, "/mfa/enroll/confirm", map[string]string{"code": "000000"}, withToken(token))
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	rec = s.do(http.MethodPost, "/mfa/enroll/confirm", map[string]string{"code": totpCode(t, secret, -1)}, withToken(token))
+	expectStatus(t, rec, http.StatusOK)
+	var confirm struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	decode(t, rec, &confirm)
+	if len(confirm.RecoveryCodes) != 10 {
+		t.Fatalf("got %d recovery codes, want 10", len(confirm.RecoveryCodes))
+	}
+
+	// Password login now only yields an MFA challenge
+	mfaToken := s.mfaChallenge("alice", "password123")
+
+	// The pending token is not accepted as a regular JWT
+	rec = s.do(http.MethodPost, "/mfa/disable", map[string]string{"code": "000000"}, withToken(mfaToken))
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	code := totpCode(t, secret, 0)
+	tests := []struct {
+		name   string
+		code   string
+		status int
+	}{
+		{"wrong code", "000000", http.StatusUnauthorized},
+		{"totp code", code, http.StatusOK},
+		{"replayed totp code", code, http.StatusUnauthorized},
+		{"recovery code", confirm.RecoveryCodes[0], http.StatusOK},
+		{"reused recovery code", confirm.RecoveryCodes[0], http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mfaToken := s.mfaChallenge("alice", "password123")
+			rec := s.do(http.MethodPost, "/login/mfa", map[string]string{"mfaToken": mfaToken, "code": tt.code})
+			expectStatus(t, rec, tt.status)
+		})
+	}
+
+	rec = s.do(http.MethodPost, "/mfa/recovery-codes", map[string]string{"code": confirm.RecoveryCodes[1]}, withToken(token))
+	expectStatus(t, rec, http.StatusOK)
+	var regenerated struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	decode(t, rec, &regenerated)
+
+	rec = s.do(http.MethodPost, "/mfa/disable", map[string]string{"code": confirm.RecoveryCodes[2]}, withToken(token))
+	expectStatus(t, rec, http.StatusUnauthorized)
+	rec = s.do(http.MethodPost, "/mfa/disable", map[string]string{"code": regenerated.RecoveryCodes[0]}, withToken(token))
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = s.do(http.MethodPost, "/login", map[string]string{"username": "alice", "password": "password123"})
+	expectStatus(t, rec, http.StatusOK)
+	var resp map[string]interface{}
+	decode(t, rec, &resp)
+	if resp["token"] == nil {
+		t.Fatalf("expected a token after disabling MFA, got %v", resp)
+	}
+}
+
+// mfaChallenge logs in as a user with two-factor authentication and returns
+// the "mfa pending" token
+func (s *testServer) mfaChallenge(username, password string) string {
+	s.t.Helper()
+	rec := s.do(http.MethodPost, "/login", map[string]string{"username": username, "password": password})
+	expectStatus(s.t, rec, http.StatusOK)
+	var challenge map[string]interface{}
+	decode(s.t, rec, &challenge)
+	mfaToken, _ := challenge["mfaToken"].(string)
+	if challenge["mfaRequired"] != true || mfaToken == "" || challenge["token"] != nil {
+		s.t.Fatalf("unexpected login response %v", challenge)
+	}
+	return mfaToken
+}
+
+func TestLoginMFAAttempts(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("alice", "password123", model.RoleUser)
+	secret, err := helper.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repos.Users.EnableTOTP(context.Background(), user.ID, secret, 0, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	loginMFA := func(mfaToken, code string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPost, "/login/mfa", map[string]string{"mfaToken": mfaToken, "code": code})
+	}
+
+	// Wrong codes burn the token, after which even the right code fails
+	burned := s.mfaChallenge("alice", "password123")
+	for i := 1; i < 5; i++ {
+		rec := loginMFA(burned, "000000")
+		expectStatus(t, rec, http.StatusUnauthorized)
+		expectCode(t, rec, "mfa_code_invalid")
+	}
+	rec := loginMFA(burned, "000000")
+	expectStatus(t, rec, http.StatusUnauthorized)
+	expectCode(t, rec, "mfa_attempts_exceeded")
+	rec = loginMFA(burned, totpCode(t, secret, 0))
+	expectStatus(t, rec, http.StatusUnauthorized)
+	expectCode(t, rec, "mfa_token_invalid")
+
+	// A new login replaces the previous challenge
+	replaced := s.mfaChallenge("alice", "password123")
+	current := s.mfaChallenge("alice", "password123")
+	rec = loginMFA(replaced, totpCode(t, secret, 0))
+	expectCode(t, rec, "mfa_token_invalid")
+	expectStatus(t, loginMFA(current, totpCode(t, secret, 0)), http.StatusOK)
+	rec = loginMFA(current, totpCode(t, secret, 1))
+	expectCode(t, rec, "mfa_token_invalid")
+
+	// Revoking the user's tokens, as a password change does, revokes
+	// pending tokens too
+	revoked := s.mfaChallenge("alice", "password123")
+	if err := s.repos.Users.UpdatePassword(context.Background(), user.ID, user.Password, time.Now().Add(2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	rec = loginMFA(revoked, totpCode(t, secret, 1))
+	expectCode(t, rec, "mfa_token_invalid")
+
+	// The endpoint is rate limited per client
+	s = newTestServer(t)
+	for i := 0; i < helper.Settings().RateLimits["mfa"].Burst; i++ {
+		expectStatus(t, loginMFA("invalid", "000000"), http.StatusUnauthorized)
+	}
+	rec = loginMFA("invalid", "000000")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	expectCode(t, rec, helper.CodeRateLimited)
+}
+
+// mockProvider is an IdentityProvider that authorizes every request. The
+// authorization code it expects is the state it was given.
+type mockProvider struct {
+	mu         sync.Mutex
+	nonces     map[string]string
+	challenges map[string]string
+	identity   helper.ExternalIdentity
+}
+
+func newMockProvider(subject, email string) *mockProvider {
+	return &mockProvider{
+		nonces:     map[string]string{},
+		challenges: map[string]string{},
+		identity:   helper.ExternalIdentity{Provider: "mock", Subject: subject, Email: email, EmailVerified: true},
+	}
+}
+
+func (p *mockProvider) Name() string {
+	return "mock"
+}
+
+func (p *mockProvider) AuthCodeURL(state, nonce, codeChallenge string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nonces[state] = nonce
+	p.challenges[state] = codeChallenge
+	return "https://idp.example/authorize?state=" + url.QueryEscape(state), nil
+}
+
+func (p *mockProvider) Exchange(ctx context.Context, code, codeVerifier string) (*helper.ExternalIdentity, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if helper.PKCEChallenge(codeVerifier) != p.challenges[code] {
+		return nil, errors.New("PKCE verification failed")
+	}
+	identity := p.identity
+	identity.Nonce = p.nonces[code]
+	return &identity, nil
+}
+
+func stateFromURL(t *testing.T, rawURL string) string {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get("state")
+}
+
+// oidcServer is an OpenID Connect issuer serving discovery, a key set and a
+// token endpoint that checks PKCE. Codes are registered with authorize.
+type oidcServer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]oidcCode
+}
+
+type oidcCode struct {
+	challenge string
+	nonce     string
+	// signer signs the ID token and claims may alter it
+	signer *rsa.PrivateKey
+	claims func(jwt.MapClaims)
+}
+
+func newOIDCServer(t *testing.T) *oidcServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &oidcServer{t: t, key: key, codes: map[string]oidcCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *oidcServer) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	code, ok := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	s.mu.Unlock()
+	if !ok || r.PostFormValue("client_id") != "webcart" ||
+		helper.PKCEChallenge(r.PostFormValue("code_verifier")) != code.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            s.URL,
+		"aud":            "webcart",
+		"sub":            "oidc-subject",
+		"email":          "oidc@example.com",
+		"email_verified": true,
+		"nonce":          code.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	}
+	if code.claims != nil {
+		code.claims(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(code.signer)
+	if err != nil {
+		s.t.Error(err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "access", "id_token": idToken, "token_type": "Bearer"})
+}
+
+// authorize plays the user approving the login at authURL and returns the
+// code the issuer redirects back with
+func (s *oidcServer) authorize(authURL string, code oidcCode) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "webcart" {
+		s.t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	if code.challenge == "" {
+		code.challenge = query.Get("code_challenge")
+	}
+	if code.nonce == "" {
+		code.nonce = query.Get("nonce")
+	}
+	if code.signer == nil {
+		code.signer = s.key
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := helper.GenerateID()
+	s.codes[id] = code
+	return id
+}
+
+func TestOIDCProvider(t *testing.T) {
+	issuer := newOIDCServer(t)
+	provider := helper.NewOIDCProvider("oidc", helper.OIDCProviderConfig{
+		Issuer:      issuer.URL,
+		ClientID:    "webcart",
+		RedirectURL: "http://localhost/auth/oidc/callback",
+	})
+	s := newTestServer(t, provider)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		code   oidcCode
+		status int
+	}{
+		{"valid token", oidcCode{}, http.StatusOK},
+		{"bad signature", oidcCode{signer: otherKey}, http.StatusUnauthorized},
+		{"wrong audience", oidcCode{claims: func(c jwt.MapClaims) { c["aud"] = "other-client" }}, http.StatusUnauthorized},
+		{"wrong issuer", oidcCode{claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }}, http.StatusUnauthorized},
+		{"expired token", oidcCode{claims: func(c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(-time.Hour).Unix()
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+		}}, http.StatusUnauthorized},
+		{"nonce mismatch", oidcCode{nonce: "other-nonce"}, http.StatusUnauthorized},
+		{"PKCE mismatch", oidcCode{challenge: helper.PKCEChallenge("other-verifier")}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login := s.do(http.MethodGet, "/auth/oidc/login", nil)
+			expectStatus(t, login, http.StatusFound)
+			authURL := login.Header().Get("Location")
+			if !strings.HasPrefix(authURL, issuer.URL+"/authorize?") {
+				t.Fatalf("redirected to %s, want the issuer", authURL)
+			}
+
+			code := issuer.authorize(authURL, tt.code)
+			state := stateFromURL(t, authURL)
+			rec := s.do(http.MethodGet, "/auth/oidc/callback?state="+url.QueryEscape(state)+"&code="+url.QueryEscape(code), nil, withCookies(login))
+			expectStatus(t, rec, tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp map[string]string
+			decode(t, rec, &resp)
+			if resp["token"] == "" || resp["username"] != "oidc@example.com" {
+				t.Fatalf("unexpected callback response %v", resp)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	issuer := newOIDCServer(t)
+	provider := helper.NewOIDCProvider("oidc", helper.OIDCProviderConfig{
+		Issuer:      issuer.URL,
+		ClientID:    "webcart",
+		RedirectURL: "http://localhost/auth/oidc/callback",
+	})
+	s := newTestServer(t, provider)
+
+	login := s.do(http.MethodGet, "/auth/oidc/login", nil)
+	expectStatus(t, login, http.StatusFound)
+	authURL := login.Header().Get("Location")
+	code := issuer.authorize(authURL, oidcCode{})
+	expectStatus(t, s.do(http.MethodGet, "/auth/oidc/callback?state="+url.QueryEscape(stateFromURL(t, authURL))+"&code="+url.QueryEscape(code), nil, withCookies(login)), http.StatusOK)
+
+	// The token and JWKS requests are client spans of the callback
+	var callback trace.SpanContext
+	var clients []string
+	for _, span := range recorder.Ended() {
+		switch {
+		case span.Name() == "/auth/{provider}/callback":
+			callback = span.SpanContext()
+		case span.SpanKind() == trace.SpanKindClient:
+			clients = append(clients, span.Name())
+		}
+	}
+	if !callback.IsValid() {
+		t.Fatal("no span for the callback")
+	}
+	inCallback := 0
+	for _, span := range recorder.Ended() {
+		if span.SpanKind() == trace.SpanKindClient && span.SpanContext().TraceID() == callback.TraceID() {
+			inCallback++
+		}
+	}
+	// Discovery runs once at login; the callback fetches the token and the keys
+	if len(clients) != 3 || inCallback != 2 {
+		t.Fatalf("got client spans %v, %d of them in the callback, want discovery, token and JWKS", clients, inCallback)
+	}
+}
+
+func TestExternalLogin(t *testing.T) {
+	provider := newMockProvider("subject-1", "alice@example.com")
+	s := newTestServer(t, provider)
+
+	rec := s.do(http.MethodGet, "/auth/providers", nil)
+	expectStatus(t, rec, http.StatusOK)
+	var providers map[string][]string
+	decode(t, rec, &providers)
+	if len(providers["providers"]) != 1 || providers["providers"][0] != "mock" {
+		t.Fatalf("unexpected providers %v", providers)
+	}
+
+	expectStatus(t, s.do(http.MethodGet, "/auth/unknown/login", nil), http.StatusNotFound)
+
+	login := s.do(http.MethodGet, "/auth/mock/login", nil)
+	expectStatus(t, login, http.StatusFound)
+	state := stateFromURL(t, login.Header().Get("Location"))
+	cookie := login.Header().Get("Set-Cookie")
+	if !strings.Contains(cookie, "HttpOnly") || !strings.Contains(cookie, "SameSite=Lax") || strings.Contains(cookie, state) {
+		t.Fatalf("unexpected state cookie %q", cookie)
+	}
+
+	// The callback must come from the browser that started the login
+	callback := "/auth/mock/callback?state=" + url.QueryEscape(state) + "&code=" + url.QueryEscape(state)
+	expectStatus(t, s.do(http.MethodGet, callback, nil), http.StatusBadRequest)
+	other := s.do(http.MethodGet, "/auth/mock/login", nil)
+	expectStatus(t, s.do(http.MethodGet, callback, nil, withCookies(other)), http.StatusBadRequest)
+
+	rec = s.do(http.MethodGet, callback, nil, withCookies(login))
+	expectStatus(t, rec, http.StatusOK)
+	var resp map[string]string
+	decode(t, rec, &resp)
+	if resp["token"] == "" || resp["username"] != "alice@example.com" {
+		t.Fatalf("unexpected callback response %v", resp)
+	}
+
+	// States are single use
+	expectStatus(t, s.do(http.MethodGet, callback, nil, withCookies(login)), http.StatusBadRequest)
+
+	// A second login finds the same account
+	login = s.do(http.MethodGet, "/auth/mock/login", nil)
+	state = stateFromURL(t, login.Header().Get("Location"))
+	rec = s.do(http.MethodGet, "/auth/mock/callback?state="+url.QueryEscape(state)+"&code="+url.QueryEscape(state), nil, withCookies(login))
+	expectStatus(t, rec, http.StatusOK)
+	var second map[string]string
+	decode(t, rec, &second)
+	if second["userId"] != resp["userId"] {
+		t.Fatalf("second login created another user: %s != %s", second["userId"], resp["userId"])
+	}
+}
+
+func TestExternalLoginUsernameTaken(t *testing.T) {
+	tests := []struct {
+		name   string
+		taken  []string
+		prefix string
+	}{
+		{"email free", nil, "carol@example.com"},
+		{"email taken", []string{"carol@example.com"}, "mock:subject-3"},
+		{"email and subject taken", []string{"carol@example.com", "mock:subject-3"}, "mock:subject-3-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newMockProvider("subject-3", "carol@example.com"))
+			for _, username := range tt.taken {
+				s.createUser(username, "password123", model.RoleUser)
+			}
+
+			login := s.do(http.MethodGet, "/auth/mock/login", nil)
+			state := stateFromURL(t, login.Header().Get("Location"))
+			rec := s.do(http.MethodGet, "/auth/mock/callback?state="+url.QueryEscape(state)+"&code="+url.QueryEscape(state), nil, withCookies(login))
+			expectStatus(t, rec, http.StatusOK)
+
+			user, err := s.repos.Users.FindByIdentity(context.Background(), "mock", "subject-3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(user.Username, tt.prefix) || (len(tt.taken) < 2 && user.Username != tt.prefix) {
+				t.Fatalf("username = %q, want %q", user.Username, tt.prefix)
+			}
+			for _, username := range tt.taken {
+				if taken, err := s.repos.Users.FindByUsername(context.Background(), username); err != nil || len(taken.Identities) != 0 {
+					t.Fatalf("local account %s was linked: %+v, %v", username, taken, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	provider := newMockProvider("subject-2", "bob@example.com")
+	s := newTestServer(t, provider)
+	user := s.createUser("bob", "password123", model.RoleUser)
+	token := s.tokenFor(user)
+
+	expectStatus(t, s.do(http.MethodPost, "/auth/mock/link", nil), http.StatusUnauthorized)
+
+	start := s.do(http.MethodPost, "/auth/mock/link", nil, withToken(token))
+	expectStatus(t, start, http.StatusOK)
+	var link map[string]string
+	decode(t, start, &link)
+	state := stateFromURL(t, link["authorizationUrl"])
+
+	// An attacker cannot make the victim's browser finish their link flow
+	callback := "/auth/mock/callback?state=" + url.QueryEscape(state) + "&code=" + url.QueryEscape(state)
+	expectStatus(t, s.do(http.MethodGet, callback, nil), http.StatusBadRequest)
+
+	rec := s.do(http.MethodGet, callback, nil, withCookies(start))
+	expectStatus(t, rec, http.StatusOK)
+
+	linked, err := s.repos.Users.FindByIdentity(context.Background(), "mock", "subject-2")
+	if err != nil || linked.ID != user.ID {
+		t.Fatalf("identity not linked to the user: %v %v", linked, err)
+	}
+
+	expectStatus(t, s.do(http.MethodPost, "/auth/mock/unlink", nil, withToken(token)), http.StatusOK)
+	expectStatus(t, s.do(http.MethodPost, "/auth/mock/unlink", nil, withToken(token)), http.StatusNotFound)
+}
+
+func TestAuthenticationErrors(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("alice", "password123", model.RoleUser)
+	expired, _ := helper.SignToken(helper.Claims{UserID: user.ID.Hex(), Username: user.Username}, -time.Minute)
+
+	tests := []struct {
+		name   string
+		opts   []requestOption
+		status int
+		code   string
+	}{
+		{"missing token", nil, http.StatusUnauthorized, "token_missing"},
+		{"malformed token", []requestOption{withToken("not-a-jwt")}, http.StatusUnauthorized, "token_malformed"},
+		{"expired token", []requestOption{withToken(expired)}, http.StatusUnauthorized, "token_expired"},
+		{"unknown api key", []requestOption{withAPIKey("wck_unknown")}, http.StatusUnauthorized, "api_key_invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do(http.MethodGet, "/admin/users", nil, tt.opts...)
+			expectStatus(t, rec, tt.status)
+			expectCode(t, rec, tt.code)
+		})
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("alice", "password123", model.RoleUser)
+	ctx := context.Background()
+
+	// Issued right before the revocation, most likely in the same second
+	token, err := helper.SignToken(helper.Claims{UserID: user.ID.Hex(), Username: user.Username, Role: user.Role}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, s.do(http.MethodGet, "/flags", nil, withToken(token)), http.StatusOK)
+	if err := s.repos.Users.SetDisabled(ctx, user.ID, true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repos.Users.SetDisabled(ctx, user.ID, false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := s.do(http.MethodGet, "/flags", nil, withToken(token))
+	expectStatus(t, rec, http.StatusUnauthorized)
+	expectCode(t, rec, "token_revoked")
+
+	// Tokens issued after the revocation, in the same second too, are valid
+	rec = s.do(http.MethodPost, "/login", map[string]string{"username": "alice", "password": "password123"})
+	expectStatus(t, rec, http.StatusOK)
+	var login map[string]string
+	decode(t, rec, &login)
+	expectStatus(t, s.do(http.MethodGet, "/flags", nil, withToken(login["token"])), http.StatusOK)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.createUser("admin", "password123", model.RoleAdmin)
+	adminToken := s.tokenFor(admin)
+	userToken := s.tokenFor(s.createUser("regular", "password123", model.RoleUser))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"list users", http.MethodGet, "/admin/users?q=targ", nil, http.StatusOK},
+		{"get user", http.MethodGet, "/admin/users/{id}", nil, http.StatusOK},
+		{"update role", http.MethodPut, "/admin/users/{id}/role", map[string]string{"role": model.RoleAdmin}, http.StatusOK},
+		{"disable user", http.MethodPost, "/admin/users/{id}/disable", nil, http.StatusOK},
+		{"enable user", http.MethodPost, "/admin/users/{id}/enable", nil, http.StatusOK},
+		{"force password reset", http.MethodPost, "/admin/users/{id}/reset-password", nil, http.StatusOK},
+		{"reset mfa", http.MethodPost, "/admin/users/{id}/mfa/reset", nil, http.StatusOK},
+		{"user carts", http.MethodGet, "/admin/users/{id}/carts", nil, http.StatusOK},
+		{"user orders", http.MethodGet, "/admin/users/{id}/orders", nil, http.StatusOK},
+		{"audit logs", http.MethodGet, "/admin/audit", nil, http.StatusOK},
+		{"list api keys", http.MethodGet, "/admin/api-keys", nil, http.StatusOK},
+		{"create api key", http.MethodPost, "/admin/api-keys", map[string]interface{}{"name": "ci", "scopes": []string{model.ScopeUsersRead}}, http.StatusCreated},
+		{"revoke unknown api key", http.MethodDelete, "/admin/api-keys/000000000000000000000000", nil, http.StatusNotFound},
+		{"settings", http.MethodGet, "/admin/settings", nil, http.StatusOK},
+		{"reload settings", http.MethodPost, "/admin/settings/reload", nil, http.StatusOK},
+		{"list flags", http.MethodGet, "/admin/flags", nil, http.StatusOK},
+		{"create flag", http.MethodPost, "/admin/flags", map[string]interface{}{"key": "admin-routes", "type": "boolean"}, http.StatusCreated},
+		{"get unknown flag", http.MethodGet, "/admin/flags/unknown", nil, http.StatusNotFound},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := s.createUser(fmt.Sprintf("target-%d", i), "password123", model.RoleUser)
+			path := strings.ReplaceAll(tt.path, "{id}", target.ID.Hex())
+
+			rec := s.do(tt.method, path, tt.body, withToken(userToken))
+			expectStatus(t, rec, http.StatusForbidden)
+
+			rec = s.do(tt.method, path, tt.body, withToken(adminToken))
+			expectStatus(t, rec, tt.status)
+		})
+	}
+
+	t.Run("unknown user", func(t *testing.T) {
+		expectStatus(t, s.do(http.MethodGet, "/admin/users/000000000000000000000000", nil, withToken(adminToken)), http.StatusNotFound)
+	})
+	t.Run("no self demotion", func(t *testing.T) {
+		rec := s.do(http.MethodPut, "/admin/users/"+admin.ID.Hex()+"/role", map[string]string{"role": model.RoleUser}, withToken(adminToken))
+		expectStatus(t, rec, http.StatusBadRequest)
+	})
+
+	entries, total, err := s.repos.AuditLogs.List(context.Background(), repository.AuditFilter{}, repository.Page{Limit: 100})
+	if err != nil || total == 0 || entries[0].ActorID != admin.ID {
+		t.Fatalf("admin actions were not audited: %d entries, %v", total, err)
+	}
+}
+
+// writeConfig writes a test profile overlay with the given runtime section
+// next to a copy of the base config, and points the config loader at it
+func writeConfig(t *testing.T, runtime string) {
+	t.Helper()
+	base, err := os.ReadFile("../../config/config.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	overlay := "runtime:\n" + runtime
+	if err := os.WriteFile(dir+"/config.yaml", base, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"/config.test.yaml", []byte(overlay), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WEBCART_CONFIG", dir+"/config.yaml")
+}
+
+// failingAuditLogs cannot store audit entries
+type failingAuditLogs struct {
+	repository.AuditLogRepository
+}
+
+func (failingAuditLogs) Insert(ctx context.Context, entry *model.AuditLog) error {
+	return errors.New("audit store unavailable")
+}
+
+func TestAuditFailure(t *testing.T) {
+	s := newTestServer(t)
+	s.repos.AuditLogs = failingAuditLogs{s.repos.AuditLogs}
+	s.handler = NewRouter(s.repos, helper.NewFeatureFlags(s.repos.Flags))
+	adminToken := s.tokenFor(s.createUser("admin", "password123", model.RoleAdmin))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"update role", http.MethodPut, "/admin/users/{id}/role", map[string]string{"role": model.RoleAdmin}},
+		{"disable user", http.MethodPost, "/admin/users/{id}/disable", nil},
+		{"force password reset", http.MethodPost, "/admin/users/{id}/reset-password", nil},
+		{"reset mfa", http.MethodPost, "/admin/users/{id}/mfa/reset", nil},
+		{"create api key", http.MethodPost, "/admin/api-keys", map[string]interface{}{"name": "ci", "scopes": []string{model.ScopeUsersRead}}},
+		{"create flag", http.MethodPost, "/admin/flags", map[string]interface{}{"key": "audited", "type": "boolean"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := s.createUser(fmt.Sprintf("target-%d", i), "password123", model.RoleUser)
+			path := strings.ReplaceAll(tt.path, "{id}", target.ID.Hex())
+			expectStatus(t, s.do(tt.method, path, tt.body, withToken(adminToken)), http.StatusInternalServerError)
+		})
+	}
+}
+
+func TestSettingsReload(t *testing.T) {
+	s := newTestServer(t)
+	adminToken := s.tokenFor(s.createUser("admin", "password123", model.RoleAdmin))
+	s.createUser("alice", "password123", model.RoleUser)
+	t.Cleanup(func() {
+		os.Setenv("WEBCART_CONFIG", "../../config/config.yaml")
+		if _, err := helper.ReloadSettings(); err != nil {
+			t.Errorf("restore settings: %v", err)
+		}
+	})
+
+	var before logic.SettingsResponse
+	decode(t, s.do(http.MethodGet, "/admin/settings", nil, withToken(adminToken)), &before)
+
+	writeConfig(t, "  token_ttl_typo: 1h\n")
+	rec := s.do(http.MethodPost, "/admin/settings/reload", nil, withToken(adminToken))
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	expectCode(t, rec, "settings_invalid")
+
+	writeConfig(t, "  auth:\n    token_ttl: -1h\n")
+	expectStatus(t, s.do(http.MethodPost, "/admin/settings/reload", nil, withToken(adminToken)), http.StatusUnprocessableEntity)
+
+	var rejected logic.SettingsResponse
+	decode(t, s.do(http.MethodGet, "/admin/settings", nil, withToken(adminToken)), &rejected)
+	if rejected.Version != before.Version || rejected.LastReloadError == "" {
+		t.Fatalf("rejected reload changed settings: %+v", rejected)
+	}
+
+	writeConfig(t, "  auth:\n    token_ttl: 1h\n  cors:\n    allowed_origins: [\"https://shop.example\"]\n")
+	rec = s.do(http.MethodPost, "/admin/settings/reload", nil, withToken(adminToken))
+	expectStatus(t, rec, http.StatusOK)
+	var after logic.SettingsResponse
+	decode(t, rec, &after)
+	if after.Version != before.Version+1 || after.Settings["runtime.auth.token_ttl"] != "1h0m0s" || after.LastReloadError != "" {
+		t.Fatalf("settings after reload = %+v", after)
+	}
+
+	t.Run("token ttl", func(t *testing.T) {
+		var login struct{ Token string }
+		decode(t, s.do(http.MethodPost, "/login", map[string]string{"username": "alice", "password": "password123"}), &login)
+		claims, err := helper.ParseToken(login.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := time.Until(time.Unix(claims.ExpiresAt, 0)); ttl > time.Hour || ttl < 59*time.Minute {
+			t.Fatalf("token expires in %v, want 1h", ttl)
+		}
+	})
+
+	t.Run("cors origins", func(t *testing.T) {
+		handler := helper.CORSMiddleware("iam")(s.handler)
+		for origin, want := range map[string]string{"https://shop.example": "https://shop.example", "https://evil.example": ""} {
+			req := httptest.NewRequest(http.MethodGet, "/auth/providers", nil)
+			req.Header.Set("Origin", origin)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != want {
+				t.Fatalf("origin %s: allowed %q, want %q", origin, got, want)
+			}
+		}
+	})
+
+	entries, _, _ := s.repos.AuditLogs.List(context.Background(), repository.AuditFilter{Action: logic.AuditSettingsReloaded}, repository.Page{Limit: 10})
+	if len(entries) != 1 {
+		t.Fatalf("got %d settings audit entries, want 1", len(entries))
+	}
+}
+
+func TestFeatureFlags(t *testing.T) {
+	s := newTestServer(t)
+	adminToken := s.tokenFor(s.createUser("admin", "password123", model.RoleAdmin))
+	beta := s.createUser("beta", "password123", model.RoleUser)
+	betaToken := s.tokenFor(beta)
+
+	invalid := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{"missing key", map[string]interface{}{"type": "boolean"}},
+		{"bad key", map[string]interface{}{"key": "New Checkout", "type": "boolean"}},
+		{"unknown type", map[string]interface{}{"key": "x", "type": "number"}},
+		{"percentage over 100", map[string]interface{}{"key": "x", "type": "boolean", "percentage": 101}},
+		{"bad user id", map[string]interface{}{"key": "x", "type": "boolean", "userIds": []string{"nope"}}},
+		{"bad role", map[string]interface{}{"key": "x", "type": "boolean", "roles": []string{"root"}}},
+		{"variant without variants", map[string]interface{}{"key": "x", "type": "variant"}},
+		{"boolean with variants", map[string]interface{}{"key": "x", "type": "boolean", "variants": []map[string]interface{}{{"name": "a", "weight": 1}}}},
+		{"zero weight", map[string]interface{}{"key": "x", "type": "variant", "variants": []map[string]interface{}{{"name": "a", "weight": 0}}}},
+		{"unknown off variant", map[string]interface{}{"key": "x", "type": "variant", "offVariant": "b", "variants": []map[string]interface{}{{"name": "a", "weight": 1}}}},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do(http.MethodPost, "/admin/flags", tt.body, withToken(adminToken)), http.StatusBadRequest)
+		})
+	}
+
+	expectStatus(t, s.do(http.MethodPost, "/admin/flags", map[string]interface{}{
+		"key": "new-checkout", "type": "boolean", "enabled": true, "userIds": []string{beta.ID.Hex()},
+	}, withToken(adminToken)), http.StatusCreated)
+	expectStatus(t, s.do(http.MethodPost, "/admin/flags", map[string]interface{}{"key": "new-checkout", "type": "boolean"}, withToken(adminToken)), http.StatusConflict)
+	expectStatus(t, s.do(http.MethodPost, "/admin/flags", map[string]interface{}{
+		"key": "checkout-layout", "type": "variant", "enabled": true, "roles": []string{model.RoleAdmin},
+		"variants": []map[string]interface{}{{"name": "compact", "weight": 1}}, "offVariant": "compact",
+	}, withToken(adminToken)), http.StatusCreated)
+
+	var flags map[string]helper.FlagResult
+	decode(t, s.do(http.MethodGet, "/flags", nil, withToken(betaToken)), &flags)
+	if !flags["new-checkout"].Enabled || flags["new-checkout"].Reason != helper.FlagReasonUser {
+		t.Fatalf("targeted user: %+v", flags["new-checkout"])
+	}
+	if flags["checkout-layout"].Enabled || flags["checkout-layout"].Variant != "compact" {
+		t.Fatalf("untargeted variant: %+v", flags["checkout-layout"])
+	}
+	expectStatus(t, s.do(http.MethodGet, "/flags", nil), http.StatusUnauthorized)
+
+	t.Run("percentage rollout", func(t *testing.T) {
+		rollout := func(percentage int) map[string]bool {
+			t.Helper()
+			expectStatus(t, s.do(http.MethodPut, "/admin/flags/new-checkout", map[string]interface{}{
+				"type": "boolean", "enabled": true, "percentage": percentage,
+			}, withToken(adminToken)), http.StatusOK)
+
+			enabled := map[string]bool{}
+			for i := 0; i < 400; i++ {
+				userID := fmt.Sprintf("%024x", i)
+				var result helper.FlagResult
+				decode(t, s.do(http.MethodGet, "/admin/flags/new-checkout/evaluate?user="+userID, nil, withToken(adminToken)), &result)
+				if result.Enabled {
+					enabled[userID] = true
+				}
+			}
+			return enabled
+		}
+
+		quarter, half := rollout(25), rollout(50)
+		if len(quarter) < 60 || len(quarter) > 140 || len(half) < 160 || len(half) > 240 {
+			t.Fatalf("rolled out to %d and %d of 400 users, want about 100 and 200", len(quarter), len(half))
+		}
+		for userID := range quarter {
+			if !half[userID] {
+				t.Fatalf("user %s dropped out when the rollout grew", userID)
+			}
+		}
+		if none := rollout(0); len(none) != 0 {
+			t.Fatalf("0%% rollout enabled %d users", len(none))
+		}
+	})
+
+	t.Run("disable and delete", func(t *testing.T) {
+		expectStatus(t, s.do(http.MethodPut, "/admin/flags/new-checkout", map[string]interface{}{
+			"type": "boolean", "enabled": false, "userIds": []string{beta.ID.Hex()},
+		}, withToken(adminToken)), http.StatusOK)
+		decode(t, s.do(http.MethodGet, "/flags", nil, withToken(betaToken)), &flags)
+		if flags["new-checkout"].Enabled {
+			t.Fatal("disabled flag is still on for targeted user")
+		}
+
+		expectStatus(t, s.do(http.MethodDelete, "/admin/flags/new-checkout", nil, withToken(adminToken)), http.StatusOK)
+		expectStatus(t, s.do(http.MethodDelete, "/admin/flags/new-checkout", nil, withToken(adminToken)), http.StatusNotFound)
+		flags = nil
+		decode(t, s.do(http.MethodGet, "/flags", nil, withToken(betaToken)), &flags)
+		if _, ok := flags["new-checkout"]; ok {
+			t.Fatal("deleted flag is still evaluated")
+		}
+	})
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.createUser("admin", "password123", model.RoleAdmin)
+	adminToken := s.tokenFor(admin)
+
+	rec := s.do(http.MethodPost, "/admin/api-keys", map[string]interface{}{
+		"name":   "reporting",
+		"scopes": []string{model.ScopeUsersRead},
+	}, withToken(adminToken))
+	expectStatus(t, rec, http.StatusCreated)
+	var created struct {
+		Key    string       `json:"key"`
+		APIKey model.APIKey `json:"apiKey"`
+	}
+	decode(t, rec, &created)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{"scoped read", http.MethodGet, "/admin/users", nil, http.StatusOK},
+		{"missing scope", http.MethodPost, "/admin/users/" + admin.ID.Hex() + "/disable", nil, http.StatusForbidden},
+		{"admin only route", http.MethodGet, "/admin/api-keys", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do(tt.method, tt.path, tt.body, withAPIKey(created.Key)), tt.status)
+		})
+	}
+
+	rec = s.do(http.MethodDelete, "/admin/api-keys/"+created.APIKey.ID.Hex(), nil, withToken(adminToken))
+	expectStatus(t, rec, http.StatusOK)
+	expectStatus(t, s.do(http.MethodGet, "/admin/users", nil, withAPIKey(created.Key)), http.StatusUnauthorized)
+}
+
+// captureLogs installs a JSON logger writing to the returned buffer for the
+// duration of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(helper.NewLogger(helper.GetConfig(), &buf))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRequestLogging(t *testing.T) {
+	s := newTestServer(t)
+	s.handler = helper.RequestLogging("iam")(s.handler)
+	user := s.createUser("alice", "password123", model.RoleUser)
+
+	t.Run("request id", func(t *testing.T) {
+		tests := []struct {
+			name string
+			sent string
+			keep bool
+		}{
+			{"generated", "", false},
+			{"propagated", "trace-42.a:b_c", true},
+			{"unsafe replaced", "bad id\r\nX-Injected: 1", false},
+			{"too long replaced", strings.Repeat("a", 200), false},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec := s.do(http.MethodGet, "/flags", nil, withToken(s.tokenFor(user)), func(r *http.Request) {
+					r.Header.Set(helper.RequestIDHeader, tt.sent)
+				})
+				id := rec.Header().Get(helper.RequestIDHeader)
+				if id == "" || (id == tt.sent) != tt.keep {
+					t.Fatalf("X-Request-ID = %q for %q", id, tt.sent)
+				}
+			})
+		}
+	})
+
+	t.Run("access log", func(t *testing.T) {
+		buf := captureLogs(t)
+		rec := s.do(http.MethodGet, "/flags", nil, withToken(s.tokenFor(user)), func(r *http.Request) {
+			r.Header.Set(helper.RequestIDHeader, "req-1")
+		})
+		expectStatus(t, rec, http.StatusOK)
+
+		entries := logEntries(t, buf)
+		entry := entries[len(entries)-1]
+		want := map[string]interface{}{
+			"msg": "request", "level": "INFO", "service": "iam", "request_id": "req-1",
+			"method": "GET", "path": "/flags", "status": float64(200), "subject": "user:" + user.ID.Hex(),
+		}
+		for key, value := range want {
+			if entry[key] != value {
+				t.Errorf("%s = %v, want %v in %v", key, entry[key], value, entry)
+			}
+		}
+		if _, ok := entry["duration_ms"].(float64); !ok {
+			t.Errorf("duration_ms missing in %v", entry)
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		buf := captureLogs(t)
+		s.do(http.MethodPost, "/login", map[string]string{"username": "alice", "password": "wrong-password"})
+		s.do(http.MethodGet, "/flags", nil, withToken("not-a-jwt"))
+		slog.Default().Info("redaction", "password", "hunter2", "api_key", "wck_secret", "header", "Bearer abc")
+
+		logs := buf.String()
+		for _, leaked := range []string{"wrong-password", "not-a-jwt", "hunter2", "wck_secret", "Bearer abc"} {
+			if strings.Contains(logs, leaked) {
+				t.Errorf("logs contain %q: %s", leaked, logs)
+			}
+		}
+		if !strings.Contains(logs, `"status":401`) {
+			t.Errorf("failed login not in access log: %s", logs)
+		}
+	})
+}
+
+func TestCORS(t *testing.T) {
+	s := newTestServer(t)
+	t.Cleanup(func() {
+		os.Setenv("WEBCART_CONFIG", "../../config/config.yaml")
+		if _, err := helper.ReloadSettings(); err != nil {
+			t.Errorf("restore settings: %v", err)
+		}
+	})
+	writeConfig(t, `  cors:
+    services:
+      iam:
+        allowed_origins: ["https://*.shop.example", "https://partner.example"]
+        allowed_methods: ["GET", "POST", "DELETE"]
+        allowed_headers: ["Content-Type", "Authorization"]
+        exposed_headers: ["X-Request-ID", "Location"]
+        allow_credentials: true
+        max_age: 5m
+      trx:
+        allowed_origins: ["*"]
+        allowed_methods: ["GET"]
+`)
+	if _, err := helper.ReloadSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	type header = map[string]string
+	tests := []struct {
+		name    string
+		service string
+		method  string
+		headers header
+		status  int
+		want    header // expected response headers, "" means absent
+	}{
+		{"preflight subdomain", "iam", http.MethodOptions,
+			header{"Origin": "https://admin.shop.example", "Access-Control-Request-Method": "DELETE", "Access-Control-Request-Headers": "authorization, content-type"},
+			http.StatusNoContent,
+			header{"Access-Control-Allow-Origin": "https://admin.shop.example", "Access-Control-Allow-Credentials": "true", "Access-Control-Allow-Methods": "GET, POST, DELETE", "Access-Control-Allow-Headers": "authorization, content-type", "Access-Control-Max-Age": "300"}},
+		{"preflight exact origin", "iam", http.MethodOptions,
+			header{"Origin": "https://partner.example", "Access-Control-Request-Method": "POST"},
+			http.StatusNoContent, header{"Access-Control-Allow-Origin": "https://partner.example"}},
+		{"preflight bare domain", "iam", http.MethodOptions,
+			header{"Origin": "https://shop.example", "Access-Control-Request-Method": "GET"},
+			http.StatusForbidden, header{"Access-Control-Allow-Origin": ""}},
+		{"preflight lookalike domain", "iam", http.MethodOptions,
+			header{"Origin": "https://evilshop.example", "Access-Control-Request-Method": "GET"},
+			http.StatusForbidden, header{"Access-Control-Allow-Origin": ""}},
+		{"preflight wrong scheme", "iam", http.MethodOptions,
+			header{"Origin": "http://admin.shop.example", "Access-Control-Request-Method": "GET"},
+			http.StatusForbidden, header{"Access-Control-Allow-Origin": ""}},
+		{"preflight method", "iam", http.MethodOptions,
+			header{"Origin": "https://admin.shop.example", "Access-Control-Request-Method": "PUT"},
+			http.StatusForbidden, header{"Access-Control-Allow-Methods": ""}},
+		{"preflight header", "iam", http.MethodOptions,
+			header{"Origin": "https://admin.shop.example", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "Authorization, X-Debug"},
+			http.StatusForbidden, header{"Access-Control-Allow-Headers": ""}},
+		{"options without preflight", "iam", http.MethodOptions,
+			header{"Origin": "https://admin.shop.example"},
+			http.StatusMethodNotAllowed, header{}},
+		{"allowed request", "iam", http.MethodGet,
+			header{"Origin": "https://admin.shop.example"},
+			http.StatusOK,
+			header{"Access-Control-Allow-Origin": "https://admin.shop.example", "Access-Control-Allow-Credentials": "true", "Access-Control-Expose-Headers": "X-Request-ID, Location", "Vary": "Origin"}},
+		{"disallowed request", "iam", http.MethodGet,
+			header{"Origin": "https://evil.example"},
+			http.StatusOK, header{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Credentials": "", "Vary": "Origin"}},
+		{"same origin request", "iam", http.MethodGet, header{}, http.StatusOK, header{"Access-Control-Allow-Origin": "", "Vary": "Origin"}},
+		{"default policy", "setup", http.MethodGet,
+			header{"Origin": "https://evil.example"},
+			http.StatusOK, header{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Credentials": ""}},
+		{"any origin", "trx", http.MethodGet,
+			header{"Origin": "https://evil.example"},
+			http.StatusOK, header{"Access-Control-Allow-Origin": "*", "Access-Control-Allow-Credentials": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/auth/providers", nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			helper.CORSMiddleware(tt.service)(s.handler).ServeHTTP(rec, req)
+
+			expectStatus(t, rec, tt.status)
+			if tt.status == http.StatusForbidden {
+				expectCode(t, rec, helper.CodeCORSRejected)
+			}
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	t.Run("credentials with any origin", func(t *testing.T) {
+		writeConfig(t, "  cors:\n    allowed_origins: [\"*\"]\n    allow_credentials: true\n")
+		if _, err := helper.ReloadSettings(); err == nil || !strings.Contains(err.Error(), "allow_credentials") {
+			t.Fatalf("reload error = %v, want a credentials error", err)
+		}
+	})
+}
@@ -1,21 +1,21 @@
 package setup
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 )
 
-func StartServer() {
+func NewServer(repos *repository.Repositories, flags *helper.FeatureFlags, health *helper.Health, metrics *helper.Metrics) *http.Server {
 	cfg := helper.GetConfig()
-	r := NewRouter()
+	r := NewRouter(repos, flags)
+	health.Register(r)
+	metrics.Register(r, helper.NewAuth(repos.Users, repos.APIKeys))
 
 	// Apply CORS middleware
-	corsRouter := helper.CORSMiddleware(r)
+	corsRouter := helper.CORSMiddleware("setup")(r)
+	handler := helper.RequestLogging("setup")(metrics.Routes(r)(helper.Hardening(corsRouter)))
 
-	log.Printf("Starting Setup service on port %s...", cfg.Server.SetupPort)
-	if err := http.ListenAndServe(":"+cfg.Server.SetupPort, corsRouter); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
+	return helper.NewServer(cfg.Server.SetupPort, handler)
 }
@@ -0,0 +1,281 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("WEBCART_CONFIG", "../../config/config.yaml")
+	os.Setenv("WEBCART_PROFILE", "test")
+	os.Setenv("WEBCART_SERVER_JWT_SECRET", "test-only-insecure-jwt-secret")
+	os.Exit(m.Run())
+}
+
+type catalog struct {
+	handler    http.Handler
+	products   []model.Product
+	categories []model.Category
+}
+
+func newCatalog(t *testing.T) *catalog {
+	t.Helper()
+	repos := repository.NewMemory()
+	products := repos.Products.(*repository.MemoryProducts)
+	categories := repos.Categories.(*repository.MemoryCategories)
+
+	c := &catalog{handler: NewRouter(repos, helper.NewFeatureFlags(repos.Flags))}
+	c.categories = []model.Category{
+		categories.Add(model.Category{Name: "Shoes"}),
+		categories.Add(model.Category{Name: "Shirts"}),
+	}
+	c.products = []model.Product{
+		products.Add(model.Product{Name: "Runner", Price: 50, Stock: 5, CategoryID: []string{c.categories[0].ID.Hex()}}),
+		products.Add(model.Product{Name: "Boot", Price: 80, Stock: 2, CategoryID: []string{c.categories[0].ID.Hex()}}),
+		products.Add(model.Product{Name: "Tee", Price: 15, Stock: 10, CategoryID: []string{c.categories[1].ID.Hex()}}),
+	}
+	return c
+}
+
+func (c *catalog) do(t *testing.T, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewReader(data)))
+	return rec
+}
+
+func productNames(t *testing.T, rec *httptest.ResponseRecorder) map[string]bool {
+	t.Helper()
+	var products []model.Product
+	if err := json.Unmarshal(rec.Body.Bytes(), &products); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+	names := map[string]bool{}
+	for _, product := range products {
+		names[product.Name] = true
+	}
+	return names
+}
+
+func TestGetProducts(t *testing.T) {
+	c := newCatalog(t)
+
+	rec := c.do(t, http.MethodGet, "/api/products/gets", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if names := productNames(t, rec); len(names) != 3 {
+		t.Fatalf("got products %v, want all 3", names)
+	}
+}
+
+func TestGetProductsByFilter(t *testing.T) {
+	c := newCatalog(t)
+	shoes := c.categories[0].ID.Hex()
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+		want   []string
+		count  int
+	}{
+		{"limit", map[string]interface{}{"filtertype": "limit", "limit": 2}, http.StatusOK, nil, 2},
+		{"no limit", map[string]interface{}{"filtertype": "limit"}, http.StatusOK, nil, 3},
+		{"by name", map[string]interface{}{"filtertype": "field", "field": "Name", "value": "Tee"}, http.StatusOK, []string{"Tee"}, 1},
+		{"by category", map[string]interface{}{"filtertype": "field", "field": "CategoryID", "value": shoes}, http.StatusOK, []string{"Runner", "Boot"}, 2},
+		{"no match", map[string]interface{}{"filtertype": "field", "field": "Name", "value": "Hat"}, http.StatusOK, nil, 0},
+		{"missing field", map[string]interface{}{"filtertype": "field", "value": "Tee"}, http.StatusBadRequest, nil, 0},
+		{"operator field", map[string]interface{}{"filtertype": "field", "field": "$where", "value": "1"}, http.StatusBadRequest, nil, 0},
+		{"missing filtertype", map[string]interface{}{"limit": 2}, http.StatusBadRequest, nil, 0},
+		{"limit too large", map[string]interface{}{"filtertype": "limit", "limit": 5000}, http.StatusBadRequest, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := c.do(t, http.MethodPost, "/api/products/get", tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			names := productNames(t, rec)
+			if len(names) != tt.count {
+				t.Fatalf("got products %v, want %d", names, tt.count)
+			}
+			for _, name := range tt.want {
+				if !names[name] {
+					t.Fatalf("product %s missing from %v", name, names)
+				}
+			}
+		})
+	}
+}
+
+func TestCategories(t *testing.T) {
+	c := newCatalog(t)
+
+	rec := c.do(t, http.MethodGet, "/api/categories", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	var categories []model.Category
+	if err := json.Unmarshal(rec.Body.Bytes(), &categories); err != nil || len(categories) != 2 {
+		t.Fatalf("got categories %s, want 2", rec.Body.String())
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{"existing", c.categories[1].ID.Hex(), http.StatusOK},
+		{"unknown", "000000000000000000000000", http.StatusNotFound},
+		{"invalid id", "not-an-id", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := c.do(t, http.MethodGet, "/api/categories/"+tt.id, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status == http.StatusOK {
+				var category model.Category
+				json.Unmarshal(rec.Body.Bytes(), &category)
+				if category.Name != "Shirts" {
+					t.Fatalf("got category %+v", category)
+				}
+			}
+		})
+	}
+}
+
+func TestSetupHasNoTransactionRoutes(t *testing.T) {
+	c := newCatalog(t)
+	for _, path := range []string{"/api/cart/save", "/api/cart/savecheckout", "/api/history/get"} {
+		if rec := c.do(t, http.MethodPost, path, map[string]string{}); rec.Code != http.StatusNotFound {
+			t.Fatalf("%s: status = %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	if _, err := helper.SetupTracing(context.Background(), helper.GetConfig()); err != nil {
+		t.Fatal(err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	c := newCatalog(t)
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodGet, "/api/categories/"+c.categories[0].ID.Hex(), nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "/api/categories/{id}" {
+		t.Errorf("span name = %q, want the route template", span.Name())
+	}
+	if span.SpanContext().TraceID().String() != traceID || span.Parent().SpanID().String() != parentID {
+		t.Errorf("span %s/%s does not continue trace %s/%s", span.SpanContext().TraceID(), span.Parent().SpanID(), traceID, parentID)
+	}
+	if span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("span kind = %v, want server", span.SpanKind())
+	}
+}
+
+func TestHealth(t *testing.T) {
+	repos := repository.NewMemory()
+	router := NewRouter(repos, helper.NewFeatureFlags(repos.Flags))
+	var mongoErr error
+	health := helper.NewHealth()
+	health.AddCheck("mongo", func(ctx context.Context) error { return mongoErr })
+	health.AddCheck("workers", func(ctx context.Context) error { return nil })
+	health.Register(router)
+
+	probe := func(path string) (int, helper.HealthResponse) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if strings.Contains(rec.Body.String(), "timeout") {
+			t.Errorf("%s leaks the check error: %s", path, rec.Body.String())
+		}
+		var response helper.HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode %q: %v", rec.Body.String(), err)
+		}
+		return rec.Code, response
+	}
+
+	tests := []struct {
+		name      string
+		mongoErr  error
+		draining  bool
+		ready     int
+		failCheck string
+		result    string
+	}{
+		{"healthy", nil, false, http.StatusOK, "", ""},
+		{"mongo down", errors.New("server selection timeout"), false, http.StatusServiceUnavailable, "mongo", "failed"},
+		{"draining", nil, true, http.StatusServiceUnavailable, "lifecycle", "draining"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mongoErr = tt.mongoErr
+			if tt.draining {
+				health.SetDraining()
+			}
+
+			if status, response := probe("/healthz"); status != http.StatusOK || response.Status != "ok" {
+				t.Errorf("healthz = %d %+v, want 200 ok", status, response)
+			}
+			status, response := probe("/readyz")
+			if status != tt.ready {
+				t.Errorf("readyz = %d %+v, want %d", status, response, tt.ready)
+			}
+			for name, result := range response.Checks {
+				want := "ok"
+				if name == tt.failCheck {
+					want = tt.result
+				}
+				if result != want {
+					t.Errorf("check %s = %q, want %q", name, result, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package trx
+
+import (
+	"net/http"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+)
+
+func NewServer(repos *repository.Repositories, flags *helper.FeatureFlags, health *helper.Health, metrics *helper.Metrics) *http.Server {
+	cfg := helper.GetConfig()
+	r := NewRouter(repos, flags)
+	health.Register(r)
+	metrics.Register(r, helper.NewAuth(repos.Users, repos.APIKeys))
+
+	// Apply CORS middleware
+	corsRouter := helper.CORSMiddleware("trx")(r)
+	handler := helper.RequestLogging("trx")(metrics.Routes(r)(helper.Hardening(corsRouter)))
+
+	return helper.NewServer(cfg.Server.TrxPort, handler)
+}
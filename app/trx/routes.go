@@ -0,0 +1,39 @@
+package trx
+
+import (
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/logic"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"github.com/gorilla/mux"
+)
+
+func NewRouter(repos *repository.Repositories, flags *helper.FeatureFlags) *mux.Router {
+	auth := helper.NewAuth(repos.Users, repos.APIKeys)
+	h := logic.NewTrxHandler(repos.Products, repos.Carts, repos.Orders, repos.Coupons, flags)
+	limiter := helper.NewRateLimiter(repos.RateLimits)
+	idempotency := helper.NewIdempotency(repos.Idempotency)
+
+	r := mux.NewRouter()
+	r.Use(helper.RouteTracing("trx"), helper.RouteTimeouts())
+
+	// Transaction routes need an authenticated user, or an API key with the
+	// matching scope
+	cartsRead := helper.RequireScope(model.ScopeCartsRead)
+	cartsWrite := helper.RequireScope(model.ScopeCartsWrite)
+	ordersRead := helper.RequireScope(model.ScopeOrdersRead)
+	ordersWrite := helper.RequireScope(model.ScopeOrdersWrite)
+	// Cart routes are limited per user or API key, so authenticate first
+	cartLimit := limiter.Limit("cart")
+
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(auth.JWTMiddleware)
+	api.Handle("/cart/save", cartLimit(cartsWrite(helper.Handle(h.UpdateCartItemQuantity)))).Methods("POST")
+	api.Handle("/cart/get", cartLimit(cartsRead(helper.Handle(h.GetProductsUser)))).Methods("POST")
+	// Checkout and confirm change stock and history, so retries with an
+	// Idempotency-Key must not run them twice
+	api.Handle("/cart/savecheckout", cartLimit(cartsWrite(idempotency.Middleware(helper.Handle(h.SaveCheckout))))).Methods("POST")
+	api.Handle("/cart/saveconfirm", cartLimit(ordersWrite(idempotency.Middleware(helper.Handle(h.SaveConfirm))))).Methods("POST")
+	api.Handle("/history/get", ordersRead(helper.Handle(h.GetHistory))).Methods("POST")
+	return r
+}
@@ -0,0 +1,889 @@
+package trx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/logic"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("WEBCART_CONFIG", "../../config/config.yaml")
+	os.Setenv("WEBCART_PROFILE", "test")
+	os.Setenv("WEBCART_SERVER_JWT_SECRET", "test-only-insecure-jwt-secret")
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	t       *testing.T
+	repos   *repository.Repositories
+	handler http.Handler
+}
+
+func newTestServer(t *testing.T) *testServer {
+	repos := repository.NewMemory()
+	return &testServer{t: t, repos: repos, handler: NewRouter(repos, helper.NewFeatureFlags(repos.Flags))}
+}
+
+func (s *testServer) createUser(username, role string) (*model.User, string) {
+	s.t.Helper()
+	user := &model.User{Username: username, Role: role, Created: time.Now().Add(-time.Hour)}
+	if err := s.repos.Users.Create(context.Background(), user); err != nil {
+		s.t.Fatalf("create user: %v", err)
+	}
+	token, err := helper.SignToken(helper.Claims{UserID: user.ID.Hex(), Username: username, Role: role}, time.Hour)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return user, token
+}
+
+func (s *testServer) addProduct(name string, stock int) model.Product {
+	return s.repos.Products.(*repository.MemoryProducts).Add(model.Product{Name: name, Price: 10, Stock: stock})
+}
+
+func (s *testServer) stockOf(id primitive.ObjectID) int {
+	s.t.Helper()
+	product, err := s.repos.Products.FindByID(context.Background(), id)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return product.Stock
+}
+
+func (s *testServer) do(path, token string, body interface{}) *httptest.ResponseRecorder {
+	data, err := json.Marshal(body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d, body %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", rec.Body.String(), err)
+	}
+}
+
+func checkout(userID string, product model.Product, quantity int) map[string]interface{} {
+	return map[string]interface{}{
+		"UserID":     userID,
+		"IsCheckout": true,
+		"Target":     []map[string]interface{}{{"ProductID": product.ID.Hex(), "Quantity": quantity}},
+	}
+}
+
+func TestCartSave(t *testing.T) {
+	s := newTestServer(t)
+	user, token := s.createUser("alice", model.RoleUser)
+	product := s.addProduct("Runner", 5)
+	ctx := context.Background()
+
+	save := func(quantity int) map[string]interface{} {
+		return map[string]interface{}{"UserID": user.ID.Hex(), "ProductID": product.ID.Hex(), "Quantity": quantity}
+	}
+
+	tests := []struct {
+		name     string
+		body     interface{}
+		status   int
+		quantity int // expected quantity in the cart afterwards, 0 means no item
+	}{
+		{"insert", save(2), http.StatusOK, 2},
+		{"update", save(4), http.StatusOK, 4},
+		{"remove", save(0), http.StatusOK, 0},
+		{"insert with zero quantity", save(0), http.StatusBadRequest, 0},
+		{"negative quantity", save(-1), http.StatusBadRequest, 0},
+		{"invalid product id", map[string]interface{}{"UserID": user.ID.Hex(), "ProductID": "x", "Quantity": 1}, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do("/api/cart/save", token, tt.body), tt.status)
+
+			item, err := s.repos.Carts.FindItem(ctx, user.ID, product.ID)
+			switch {
+			case tt.quantity == 0 && err != repository.ErrNotFound:
+				t.Fatalf("cart item = %+v, %v, want none", item, err)
+			case tt.quantity > 0 && (err != nil || item.Quantity != tt.quantity):
+				t.Fatalf("cart item = %+v, %v, want quantity %d", item, err, tt.quantity)
+			}
+		})
+	}
+}
+
+func TestCartGet(t *testing.T) {
+	s := newTestServer(t)
+	user, token := s.createUser("alice", model.RoleUser)
+	runner := s.addProduct("Runner", 5)
+	boot := s.addProduct("Boot", 5)
+
+	expectStatus(t, s.do("/api/cart/save", token, map[string]interface{}{"UserID": user.ID.Hex(), "ProductID": runner.ID.Hex(), "Quantity": 2}), http.StatusOK)
+	expectStatus(t, s.do("/api/cart/savecheckout", token, checkout(user.ID.Hex(), boot, 1)), http.StatusOK)
+
+	tests := []struct {
+		name       string
+		isCheckout bool
+		want       string
+		quantity   int
+	}{
+		{"cart", false, "Runner", 2},
+		{"checkout", true, "Boot", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do("/api/cart/get", token, map[string]interface{}{"UserID": user.ID.Hex(), "IsCheckout": tt.isCheckout})
+			expectStatus(t, rec, http.StatusOK)
+
+			var items []struct {
+				Product  model.Product
+				Quantity int
+			}
+			decode(t, rec, &items)
+			if len(items) != 1 || items[0].Product.Name != tt.want || items[0].Quantity != tt.quantity {
+				t.Fatalf("got items %+v, want %s x%d", items, tt.want, tt.quantity)
+			}
+		})
+	}
+}
+
+func TestSaveCheckout(t *testing.T) {
+	s := newTestServer(t)
+	user, token := s.createUser("alice", model.RoleUser)
+	product := s.addProduct("Runner", 5)
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+		stock  int
+	}{
+		{"decrements stock", checkout(user.ID.Hex(), product, 3), http.StatusOK, 2},
+		{"insufficient stock", checkout(user.ID.Hex(), product, 3), http.StatusBadRequest, 2},
+		{"unknown product", checkout(user.ID.Hex(), model.Product{ID: primitive.NewObjectID()}, 1), http.StatusNotFound, 2},
+		{"zero quantity", checkout(user.ID.Hex(), product, 0), http.StatusBadRequest, 2},
+		{"remaining stock", checkout(user.ID.Hex(), product, 2), http.StatusOK, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, s.do("/api/cart/savecheckout", token, tt.body), tt.status)
+			if stock := s.stockOf(product.ID); stock != tt.stock {
+				t.Fatalf("stock = %d, want %d", stock, tt.stock)
+			}
+		})
+	}
+}
+
+func TestSaveCheckoutRollback(t *testing.T) {
+	s := newTestServer(t)
+	user, token := s.createUser("alice", model.RoleUser)
+	first := s.addProduct("Runner", 5)
+	second := s.addProduct("Trail", 1)
+
+	tests := []struct {
+		name   string
+		second model.Product
+		status int
+	}{
+		{"second item out of stock", second, http.StatusBadRequest},
+		{"second item unknown", model.Product{ID: primitive.NewObjectID()}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := checkout(user.ID.Hex(), first, 2)
+			body["Target"] = []map[string]interface{}{
+				{"ProductID": first.ID.Hex(), "Quantity": 2},
+				{"ProductID": tt.second.ID.Hex(), "Quantity": 3},
+			}
+			expectStatus(t, s.do("/api/cart/savecheckout", token, body), tt.status)
+
+			if stock := s.stockOf(first.ID); stock != 5 {
+				t.Fatalf("stock of the first item = %d, want 5", stock)
+			}
+			if stock := s.stockOf(second.ID); stock != 1 {
+				t.Fatalf("stock of the second item = %d, want 1", stock)
+			}
+			items, err := s.repos.Carts.ListByUser(context.Background(), user.ID)
+			if err != nil || len(items) != 0 {
+				t.Fatalf("failed checkout left cart items %+v, %v", items, err)
+			}
+		})
+	}
+}
+
+// failingCarts fails to upsert the items of one product
+type failingCarts struct {
+	repository.CartRepository
+	product primitive.ObjectID
+}
+
+func (c *failingCarts) Upsert(ctx context.Context, item model.Cart) error {
+	if item.ProductID == c.product {
+		return errors.New("connection reset")
+	}
+	return c.CartRepository.Upsert(ctx, item)
+}
+
+func TestSaveCheckoutCartRollback(t *testing.T) {
+	s := newTestServer(t)
+	user, token := s.createUser("alice", model.RoleUser)
+	inCart := s.addProduct("Runner", 5)
+	added := s.addProduct("Trail", 4)
+	failed := s.addProduct("Court", 3)
+
+	ctx := context.Background()
+	before := model.Cart{ProductID: inCart.ID, UserID: user.ID, Quantity: 1, Created: time.Now().Add(-time.Hour).Truncate(time.Millisecond)}
+	if err := s.repos.Carts.Insert(ctx, &before); err != nil {
+		t.Fatal(err)
+	}
+	carts := s.repos.Carts
+	s.repos.Carts = &failingCarts{CartRepository: carts, product: failed.ID}
+	s.handler = NewRouter(s.repos, helper.NewFeatureFlags(s.repos.Flags))
+
+	body := checkout(user.ID.Hex(), inCart, 2)
+	body["Target"] = []map[string]interface{}{
+		{"ProductID": inCart.ID.Hex(), "Quantity": 2},
+		{"ProductID": added.ID.Hex(), "Quantity": 1},
+		{"ProductID": failed.ID.Hex(), "Quantity": 1},
+	}
+	expectStatus(t, s.do("/api/cart/savecheckout", token, body), http.StatusInternalServerError)
+
+	for _, product := range []model.Product{inCart, added, failed} {
+		if stock := s.stockOf(product.ID); stock != product.Stock {
+			t.Errorf("stock of %s = %d, want %d", product.Name, stock, product.Stock)
+		}
+	}
+	items, err := carts.ListByUser(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0] != before {
+		t.Fatalf("failed checkout left cart items %+v, want only %+v", items, before)
+	}
+}
+
+// deadlineProducts records the deadline of the context stock is taken with
+type deadlineProducts struct {
+	repository.ProductRepository
+	deadline time.Time
+}
+
+func (p *deadlineProducts) DecrementStock(ctx context.Context, id primitive.ObjectID, quantity int) error {
+	p.deadline, _ = ctx.Deadline()
+	return p.ProductRepository.DecrementStock(ctx, id, quantity)
+}
+
+func TestSaveCheckoutRouteTimeout(t *testing.T) {
+	s := newTestServer(t)
+	user, token := s.createUser("alice", model.RoleUser)
+	product := s.addProduct("Runner", 5)
+	products := &deadlineProducts{ProductRepository: s.repos.Products}
+	s.repos.Products = products
+	s.handler = NewRouter(s.repos, helper.NewFeatureFlags(s.repos.Flags))
+
+	cfg := helper.GetConfig()
+	timeout := cfg.HTTP.RouteTimeouts["/api/cart/savecheckout"]
+	if timeout <= 10*time.Second {
+		t.Fatalf("savecheckout route timeout is %v, want it above the former 10s default", timeout)
+	}
+	start := time.Now()
+	expectStatus(t, s.do("/api/cart/savecheckout", token, checkout(user.ID.Hex(), product, 1)), http.StatusOK)
+	if got := products.deadline.Sub(start); got < timeout || got > timeout+time.Second {
+		t.Fatalf("handler ran with a %v deadline, want the %v route timeout", got, timeout)
+	}
+}
+
+func TestSaveCheckoutConcurrentOversell(t *testing.T) {
+	s := newTestServer(t)
+	const stock, buyers = 5, 40
+	product := s.addProduct("Last pairs", stock)
+
+	tokens := make([]string, buyers)
+	users := make([]*model.User, buyers)
+	for i := range users {
+		users[i], tokens[i] = s.createUser("buyer"+primitive.NewObjectID().Hex(), model.RoleUser)
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]int, buyers)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = s.do("/api/cart/savecheckout", tokens[i], checkout(users[i].ID.Hex(), product, 1)).Code
+		}(i)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusBadRequest:
+		default:
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	if succeeded != stock {
+		t.Fatalf("%d checkouts succeeded, want %d", succeeded, stock)
+	}
+	if remaining := s.stockOf(product.ID); remaining != 0 {
+		t.Fatalf("stock = %d, want 0", remaining)
+	}
+}
+
+func TestSaveConfirm(t *testing.T) {
+	s := newTestServer(t)
+	user, token := s.createUser("alice", model.RoleUser)
+	runner := s.addProduct("Runner", 10)
+	boot := s.addProduct("Boot", 10)
+	ctx := context.Background()
+
+	confirm := func(product model.Product, quantity, coupons int) map[string]interface{} {
+		body := checkout(user.ID.Hex(), product, quantity)
+		body["IsConfirm"] = true
+		body["TotalCoupons"] = coupons
+		return body
+	}
+
+	expectStatus(t, s.do("/api/cart/savecheckout", token, checkout(user.ID.Hex(), runner, 2)), http.StatusOK)
+	expectStatus(t, s.do("/api/cart/saveconfirm", token, confirm(runner, 2, 3)), http.StatusOK)
+
+	carts, err := s.repos.Carts.ListByUser(ctx, user.ID)
+	if err != nil || len(carts) != 0 {
+		t.Fatalf("cart after confirm = %+v, %v, want empty", carts, err)
+	}
+
+	expectStatus(t, s.do("/api/cart/savecheckout", token, checkout(user.ID.Hex(), boot, 1)), http.StatusOK)
+	expectStatus(t, s.do("/api/cart/saveconfirm", token, confirm(boot, 1, 4)), http.StatusOK)
+	expectStatus(t, s.do("/api/cart/saveconfirm", token, confirm(boot, 1, -1)), http.StatusBadRequest)
+
+	coupon, err := s.repos.Coupons.FindByUser(ctx, user.ID)
+	if err != nil || coupon.Amount != 7 {
+		t.Fatalf("coupon = %+v, %v, want amount 7", coupon, err)
+	}
+
+	orders, err := s.repos.Orders.ListByUser(ctx, user.ID)
+	if err != nil || len(orders) != 2 {
+		t.Fatalf("orders = %+v, %v, want 2", orders, err)
+	}
+	if orders[0].IDTrx == orders[1].IDTrx {
+		t.Fatal("separate confirmations share a transaction ID")
+	}
+
+	rec := s.do("/api/history/get", token, map[string]string{"userId": user.ID.Hex()})
+	expectStatus(t, rec, http.StatusOK)
+	var history []struct {
+		Quantity int
+		Product  model.Product
+	}
+	decode(t, rec, &history)
+	if len(history) != 2 || history[0].Product.Name != "Boot" || history[1].Product.Name != "Runner" {
+		t.Fatalf("history = %+v, want Boot then Runner", history)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	s := newTestServer(t)
+	alice, aliceToken := s.createUser("alice", model.RoleUser)
+	_, bobToken := s.createUser("bob", model.RoleUser)
+	_, adminToken := s.createUser("admin", model.RoleAdmin)
+	product := s.addProduct("Runner", 5)
+
+	routes := []struct {
+		path string
+		body interface{}
+	}{
+		{"/api/cart/save", map[string]interface{}{"UserID": alice.ID.Hex(), "ProductID": product.ID.Hex(), "Quantity": 1}},
+		{"/api/cart/get", map[string]interface{}{"UserID": alice.ID.Hex()}},
+		{"/api/cart/savecheckout", checkout(alice.ID.Hex(), product, 1)},
+		{"/api/cart/saveconfirm", checkout(alice.ID.Hex(), product, 1)},
+		{"/api/history/get", map[string]string{"userId": alice.ID.Hex()}},
+	}
+
+	callers := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"invalid token", "not-a-token", http.StatusUnauthorized},
+		{"other user", bobToken, http.StatusForbidden},
+		{"owner", aliceToken, http.StatusOK},
+		{"admin", adminToken, http.StatusOK},
+	}
+
+	for _, route := range routes {
+		for _, caller := range callers {
+			t.Run(route.path+"/"+caller.name, func(t *testing.T) {
+				expectStatus(t, s.do(route.path, caller.token, route.body), caller.status)
+			})
+		}
+	}
+}
+
+// getMetrics requests GET /metrics with the given credential header
+func (s *testServer) getMetrics(header, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// scrape reads the metrics from GET /metrics into a map from series, e.g.
+// webcart_checkouts_total, to value
+func (s *testServer) scrape(token string) map[string]float64 {
+	s.t.Helper()
+	rec := s.getMetrics("Authorization", "Bearer "+token)
+	expectStatus(s.t, rec, http.StatusOK)
+
+	series := map[string]float64{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			s.t.Fatalf("metric line %q: %v", line, err)
+		}
+		series[line[:i]] = value
+	}
+	return series
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	router := NewRouter(s.repos, helper.NewFeatureFlags(s.repos.Flags))
+	metrics := helper.NewMetrics("trx", logic.Collectors()...)
+	metrics.Register(router, helper.NewAuth(s.repos.Users, s.repos.APIKeys))
+	s.handler = metrics.Routes(router)(router)
+	user, token := s.createUser("alice", model.RoleUser)
+	_, adminToken := s.createUser("root", model.RoleAdmin)
+	product := s.addProduct("Runner", 5)
+	before := s.scrape(adminToken)
+
+	expectStatus(t, s.do("/api/cart/save", token, map[string]interface{}{"UserID": user.ID.Hex(), "ProductID": product.ID.Hex(), "Quantity": 1}), http.StatusOK)
+	expectStatus(t, s.do("/api/cart/savecheckout", token, checkout(user.ID.Hex(), product, 2)), http.StatusOK)
+	expectStatus(t, s.do("/api/cart/savecheckout", token, checkout(user.ID.Hex(), product, 10)), http.StatusBadRequest)
+	confirm := checkout(user.ID.Hex(), product, 2)
+	confirm["TotalCoupons"] = 7
+	expectStatus(t, s.do("/api/cart/saveconfirm", token, confirm), http.StatusOK)
+	expectStatus(t, s.do("/api/unknown/"+user.ID.Hex(), token, nil), http.StatusNotFound)
+
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/unknown", nil))
+	expectStatus(t, rec, http.StatusNotFound)
+
+	// Only admins and API keys with the metrics:read scope may scrape
+	for _, scopes := range [][]string{{model.ScopeMetricsRead}, {model.ScopeCartsRead}} {
+		key := "test-key-" + scopes[0]
+		err := s.repos.APIKeys.Create(context.Background(), &model.APIKey{Name: scopes[0], Prefix: scopes[0], KeyHash: helper.HashToken(key), Scopes: scopes})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectStatus(t, s.getMetrics("", ""), http.StatusUnauthorized)
+	expectStatus(t, s.getMetrics("Authorization", "Bearer "+token), http.StatusForbidden)
+	expectStatus(t, s.getMetrics("X-API-Key", "test-key-"+model.ScopeCartsRead), http.StatusForbidden)
+	expectStatus(t, s.getMetrics("X-API-Key", "test-key-"+model.ScopeMetricsRead), http.StatusOK)
+
+	after := s.scrape(adminToken)
+	tests := []struct {
+		series string
+		delta  float64
+	}{
+		{`webcart_cart_items_created_total`, 1},
+		{`webcart_checkouts_total`, 1},
+		{`webcart_insufficient_stock_total`, 1},
+		{`webcart_confirms_total`, 1},
+		{`webcart_coupons_issued_total`, 7},
+		{`http_requests_total{method="POST",route="/api/cart/savecheckout",service="trx",status="200"}`, 1},
+		{`http_requests_total{method="POST",route="/api/cart/savecheckout",service="trx",status="400"}`, 1},
+		{`http_requests_total{method="POST",route="unmatched",service="trx",status="404"}`, 1},
+		{`http_requests_total{method="GET",route="unmatched",service="trx",status="404"}`, 1},
+		{`http_request_duration_seconds_count{method="POST",route="/api/cart/savecheckout",service="trx"}`, 2},
+	}
+	for _, tt := range tests {
+		if delta := after[tt.series] - before[tt.series]; delta != tt.delta {
+			t.Errorf("%s increased by %v, want %v", tt.series, delta, tt.delta)
+		}
+	}
+}
+
+func TestFeatureFlagInHandler(t *testing.T) {
+	s := newTestServer(t)
+	alice, aliceToken := s.createUser("alice", model.RoleUser)
+	_, bobToken := s.createUser("bob", model.RoleUser)
+	_, adminToken := s.createUser("root", model.RoleAdmin)
+	err := s.repos.Flags.Create(context.Background(), &model.FeatureFlag{
+		Key:     "new-checkout",
+		Type:    model.FlagTypeBoolean,
+		Enabled: true,
+		UserIDs: []string{alice.ID.Hex()},
+		Roles:   []string{model.RoleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handler sees the flags passed to the router and the claims of the
+	// authenticated caller
+	flags := helper.NewFeatureFlags(s.repos.Flags)
+	router := NewRouter(s.repos, flags)
+	auth := helper.NewAuth(s.repos.Users, s.repos.APIKeys)
+	router.Handle("/test/flag", auth.JWTMiddleware(helper.Handle(func(w http.ResponseWriter, r *http.Request) error {
+		helper.RespondWithJSON(w, http.StatusOK, map[string]bool{"enabled": flags.Enabled(r.Context(), "new-checkout")})
+		return nil
+	})))
+	s.handler = router
+
+	tests := []struct {
+		name    string
+		token   string
+		enabled bool
+	}{
+		{"targeted user", aliceToken, true},
+		{"targeted role", adminToken, true},
+		{"not targeted", bobToken, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := s.do("/test/flag", tt.token, nil)
+			expectStatus(t, rec, http.StatusOK)
+			var got map[string]bool
+			decode(t, rec, &got)
+			if got["enabled"] != tt.enabled {
+				t.Fatalf("new-checkout enabled = %v, want %v", got["enabled"], tt.enabled)
+			}
+		})
+	}
+}
+
+func TestHardening(t *testing.T) {
+	s := newTestServer(t)
+	_, token := s.createUser("alice", model.RoleUser)
+	router := NewRouter(s.repos, helper.NewFeatureFlags(s.repos.Flags))
+	router.HandleFunc("/test/panic", func(w http.ResponseWriter, r *http.Request) {
+		var cart *model.Cart
+		_ = cart.Quantity
+	})
+	router.HandleFunc("/test/panic-after-write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("boom")
+	})
+	router.Handle("/test/slow", helper.Handle(func(w http.ResponseWriter, r *http.Request) error {
+		<-r.Context().Done()
+		return helper.Internal("Error waiting", r.Context().Err())
+	}))
+	s.handler = helper.Hardening(router)
+
+	cfg := helper.GetConfig()
+	cfg.HTTP.RouteTimeouts = map[string]time.Duration{"/test/slow": 20 * time.Millisecond}
+	t.Cleanup(func() { cfg.HTTP.RouteTimeouts = nil })
+
+	problemCode := func(rec *httptest.ResponseRecorder) string {
+		var problem helper.Problem
+		decode(t, rec, &problem)
+		return problem.Code
+	}
+
+	t.Run("panic", func(t *testing.T) {
+		rec := s.do("/test/panic", "", nil)
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if code := problemCode(rec); code != helper.CodeInternal {
+			t.Fatalf("code = %q, want %q", code, helper.CodeInternal)
+		}
+	})
+
+	t.Run("panic after write", func(t *testing.T) {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("recovered %v, want http.ErrAbortHandler", v)
+			}
+		}()
+		s.do("/test/panic-after-write", "", nil)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		rec := s.do("/test/slow", "", nil)
+		expectStatus(t, rec, http.StatusServiceUnavailable)
+		if code := problemCode(rec); code != helper.CodeTimeout {
+			t.Fatalf("code = %q, want %q", code, helper.CodeTimeout)
+		}
+	})
+
+	t.Run("body too large", func(t *testing.T) {
+		rec := s.do("/api/cart/save", token, map[string]string{"UserID": strings.Repeat("a", int(cfg.HTTP.MaxBodyBytes))})
+		expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+		if code := problemCode(rec); code != "body_too_large" {
+			t.Fatalf("code = %q, want body_too_large", code)
+		}
+	})
+
+	t.Run("security headers", func(t *testing.T) {
+		rec := s.do("/api/cart/get", "", nil)
+		for name, want := range map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"X-Frame-Options":         "DENY",
+			"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+		} {
+			if got := rec.Header().Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	aliceUser, alice := s.createUser("alice", model.RoleUser)
+	bobUser, bob := s.createUser("bob", model.RoleUser)
+	getCart := func(user *model.User, token string) *httptest.ResponseRecorder {
+		return s.do("/api/cart/get", token, map[string]interface{}{"UserID": user.ID.Hex()})
+	}
+
+	previous := *helper.Settings()
+	settings := previous
+	settings.RateLimits = map[string]helper.RateLimitPolicy{"cart": {Requests: 1, Per: time.Minute, Burst: 3}}
+	if _, err := helper.ApplySettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { helper.ApplySettings(previous) })
+
+	for i := 2; i >= 0; i-- {
+		rec := getCart(aliceUser, alice)
+		expectStatus(t, rec, http.StatusOK)
+		if got := rec.Header().Get(helper.RateLimitRemainingHeader); got != strconv.Itoa(i) {
+			t.Fatalf("%s = %q, want %d", helper.RateLimitRemainingHeader, got, i)
+		}
+		if got := rec.Header().Get(helper.RateLimitLimitHeader); got != "3" {
+			t.Fatalf("%s = %q, want 3", helper.RateLimitLimitHeader, got)
+		}
+		if got := rec.Header().Get(helper.RateLimitPolicyHeader); got != "3;w=180" {
+			t.Fatalf("%s = %q, want 3;w=180", helper.RateLimitPolicyHeader, got)
+		}
+	}
+
+	rec := s.do("/api/cart/save", alice, map[string]interface{}{})
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("Retry-After = %q, want 60", got)
+	}
+	var problem helper.Problem
+	decode(t, rec, &problem)
+	if problem.Code != helper.CodeRateLimited {
+		t.Fatalf("code = %q, want %q", problem.Code, helper.CodeRateLimited)
+	}
+
+	// Buckets are per user
+	expectStatus(t, getCart(bobUser, bob), http.StatusOK)
+
+	// Removing the policy lifts the limit
+	settings.RateLimits = nil
+	if _, err := helper.ApplySettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	rec = getCart(aliceUser, alice)
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get(helper.RateLimitLimitHeader); got != "" {
+		t.Fatalf("%s = %q without a policy", helper.RateLimitLimitHeader, got)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cfg := helper.GetConfig()
+	cfg.HTTP.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	t.Cleanup(func() { cfg.HTTP.TrustedProxies = nil })
+
+	for _, tc := range []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "203.0.113.7:1234", "", "203.0.113.7"},
+		{"untrusted peer", "203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		{"spoofed hop", "10.1.2.3:1234", "1.1.1.1, 198.51.100.1, 192.0.2.1", "198.51.100.1"},
+		{"only proxies", "10.1.2.3:1234", "10.9.9.9", "10.9.9.9"},
+		{"garbage", "10.1.2.3:1234", "not-an-ip", "10.1.2.3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remote
+			if tc.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if got := helper.ClientIP(req); got != tc.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	s := newTestServer(t)
+	alice, aliceToken := s.createUser("alice", model.RoleUser)
+	bob, bobToken := s.createUser("bob", model.RoleUser)
+	boot := s.addProduct("Boot", 5)
+
+	do := func(token, key string, body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/cart/savecheckout", bytes.NewReader(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(helper.IdempotencyKeyHeader, key)
+		rec := httptest.NewRecorder()
+		s.handler.ServeHTTP(rec, req)
+		return rec
+	}
+	problemCode := func(rec *httptest.ResponseRecorder) string {
+		var problem helper.Problem
+		decode(t, rec, &problem)
+		return problem.Code
+	}
+
+	first := do(aliceToken, "checkout-1", checkout(alice.ID.Hex(), boot, 2))
+	expectStatus(t, first, http.StatusOK)
+	if first.Header().Get(helper.IdempotentReplayedHeader) != "" {
+		t.Fatal("first response marked as replayed")
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		rec := do(aliceToken, "checkout-1", checkout(alice.ID.Hex(), boot, 2))
+		expectStatus(t, rec, http.StatusOK)
+		if rec.Header().Get(helper.IdempotentReplayedHeader) != "true" {
+			t.Fatalf("%s = %q, want true", helper.IdempotentReplayedHeader, rec.Header().Get(helper.IdempotentReplayedHeader))
+		}
+		if rec.Body.String() != first.Body.String() {
+			t.Fatalf("replayed body %q, want %q", rec.Body.String(), first.Body.String())
+		}
+		if stock := s.stockOf(boot.ID); stock != 3 {
+			t.Fatalf("stock = %d, want 3", stock)
+		}
+	})
+
+	t.Run("different payload", func(t *testing.T) {
+		rec := do(aliceToken, "checkout-1", checkout(alice.ID.Hex(), boot, 1))
+		expectStatus(t, rec, http.StatusUnprocessableEntity)
+		if code := problemCode(rec); code != helper.CodeIdempotencyKeyReused {
+			t.Fatalf("code = %q, want %q", code, helper.CodeIdempotencyKeyReused)
+		}
+	})
+
+	t.Run("keys are per user", func(t *testing.T) {
+		expectStatus(t, do(bobToken, "checkout-1", checkout(bob.ID.Hex(), boot, 1)), http.StatusOK)
+		if stock := s.stockOf(boot.ID); stock != 2 {
+			t.Fatalf("stock = %d, want 2", stock)
+		}
+	})
+
+	t.Run("client errors are replayed", func(t *testing.T) {
+		rec := do(aliceToken, "checkout-2", checkout(alice.ID.Hex(), boot, 10))
+		expectStatus(t, rec, http.StatusBadRequest)
+		s.repos.Products.(*repository.MemoryProducts).Add(model.Product{ID: boot.ID, Name: boot.Name, Price: boot.Price, Stock: 20})
+		rec = do(aliceToken, "checkout-2", checkout(alice.ID.Hex(), boot, 10))
+		expectStatus(t, rec, http.StatusBadRequest)
+		if rec.Header().Get(helper.IdempotentReplayedHeader) != "true" {
+			t.Fatal("client error was not replayed")
+		}
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		rec := do(aliceToken, strings.Repeat("k", 256), checkout(alice.ID.Hex(), boot, 1))
+		expectStatus(t, rec, http.StatusBadRequest)
+		if code := problemCode(rec); code != helper.CodeIdempotencyKeyInvalid {
+			t.Fatalf("code = %q, want %q", code, helper.CodeIdempotencyKeyInvalid)
+		}
+	})
+}
+
+// flakyIdempotency fails the first failures calls to Complete
+type flakyIdempotency struct {
+	repository.IdempotencyRepository
+	failures  int32
+	completes atomic.Int32
+}
+
+func (f *flakyIdempotency) Complete(ctx context.Context, record model.IdempotencyRecord) error {
+	if f.completes.Add(1) <= f.failures {
+		return errors.New("write concern timeout")
+	}
+	return f.IdempotencyRepository.Complete(ctx, record)
+}
+
+func TestIdempotencyCompleteFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int32
+		completes int32
+		retry     int
+	}{
+		{"transient failure is retried", 1, 2, http.StatusOK},
+		{"record stays pending", 5, 3, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			store := &flakyIdempotency{IdempotencyRepository: s.repos.Idempotency, failures: tt.failures}
+			s.repos.Idempotency = store
+			s.handler = NewRouter(s.repos, helper.NewFeatureFlags(s.repos.Flags))
+			user, token := s.createUser("alice", model.RoleUser)
+			boot := s.addProduct("Boot", 5)
+
+			do := func() *httptest.ResponseRecorder {
+				data, _ := json.Marshal(checkout(user.ID.Hex(), boot, 2))
+				req := httptest.NewRequest(http.MethodPost, "/api/cart/savecheckout", bytes.NewReader(data))
+				req.Header.Set("Authorization", "Bearer "+token)
+				req.Header.Set(helper.IdempotencyKeyHeader, "checkout-1")
+				rec := httptest.NewRecorder()
+				s.handler.ServeHTTP(rec, req)
+				return rec
+			}
+
+			expectStatus(t, do(), http.StatusOK)
+			if n := store.completes.Load(); n != tt.completes {
+				t.Fatalf("Complete called %d times, want %d", n, tt.completes)
+			}
+			// The retry never runs the checkout again
+			expectStatus(t, do(), tt.retry)
+			if stock := s.stockOf(boot.ID); stock != 3 {
+				t.Fatalf("stock = %d, want 3", stock)
+			}
+		})
+	}
+}
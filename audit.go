@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+)
+
+const auditUsage = `usage: webcart audit [samples] [config flags]
+
+Lists the documents that violate the collection schemas, field by field,
+with up to samples document IDs each (5 by default). Exits with 3 when
+violations are found.
+`
+
+const defaultAuditSamples = 5
+
+// runAudit runs the audit subcommand and returns the exit code
+func runAudit(args []string) int {
+	samples := defaultAuditSamples
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			fmt.Fprint(os.Stderr, auditUsage)
+			return 2
+		}
+		samples, args = n, args[1:]
+	}
+
+	return withDatabase(args, auditUsage, func(ctx context.Context, db *helper.Database) int {
+		violations, err := repository.AuditSchemas(ctx, db.DB(), samples)
+		return reportAudit(os.Stdout, violations, err)
+	})
+}
+
+// reportAudit prints the violations and returns the exit code of the audit
+func reportAudit(w io.Writer, violations []repository.SchemaViolation, err error) int {
+	if err != nil {
+		slog.Error("Schema audit failed", "error", err)
+		return 1
+	}
+	if len(violations) == 0 {
+		slog.Info("No schema violations found")
+		return 0
+	}
+	printViolations(w, violations)
+	return 3
+}
+
+func printViolations(w io.Writer, violations []repository.SchemaViolation) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tFIELD\tDOCUMENTS\tSAMPLE IDS")
+	for _, v := range violations {
+		ids := make([]string, 0, len(v.Samples))
+		for _, id := range v.Samples {
+			ids = append(ids, fmt.Sprint(id))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", v.Collection, v.Field, v.Count, strings.Join(ids, " "))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/dianerwansyah/web-cart-backend/repository"
+)
+
+func TestReportAudit(t *testing.T) {
+	violations := []repository.SchemaViolation{
+		{Collection: "carts", Field: "Quantity", Count: 7, Samples: []interface{}{"a1", "b2"}},
+		{Collection: "users", Field: "role", Count: 1},
+	}
+
+	tests := []struct {
+		name       string
+		violations []repository.SchemaViolation
+		err        error
+		code       int
+		output     []string
+	}{
+		{"failure", nil, errors.New("connection refused"), 1, nil},
+		{"no violations", nil, nil, 0, nil},
+		{"violations", violations, nil, 3, []string{
+			"COLLECTION  FIELD     DOCUMENTS  SAMPLE IDS",
+			"carts       Quantity  7          a1 b2",
+			"users       role      1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			if code := reportAudit(&out, tt.violations, tt.err); code != tt.code {
+				t.Fatalf("reportAudit exited with %d, want %d", code, tt.code)
+			}
+			var lines []string
+			for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+				if line = strings.TrimRight(line, " "); line != "" {
+					lines = append(lines, line)
+				}
+			}
+			if strings.Join(lines, "\n") != strings.Join(tt.output, "\n") {
+				t.Fatalf("printed\n%s\nwant\n%s", out.String(), strings.Join(tt.output, "\n"))
+			}
+		})
+	}
+
+	if code := runAudit([]string{"many"}); code != 2 {
+		t.Fatalf("runAudit with a bad sample count exited with %d, want 2", code)
+	}
+}
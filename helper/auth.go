@@ -0,0 +1,170 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const authRealm = "webcart"
+
+// Claims are the claims of the JWTs issued by the IAM service
+type Claims struct {
+	UserID     string `json:"userId"`
+	Username   string `json:"username"`
+	Role       string `json:"role"`
+	MFAPending bool   `json:"mfa_pending,omitempty"`
+	// TokenVersion is the user's token version at issue time; revoking
+	// the user's tokens bumps it
+	TokenVersion int `json:"ver,omitempty"`
+	jwt.StandardClaims
+}
+
+// AuthError is an authentication or authorization failure. OAuthError is the
+// RFC 6750 error code sent in WWW-Authenticate, Code tells clients the exact
+// reason.
+type AuthError struct {
+	Status      int
+	OAuthError  string
+	Code        string
+	Description string
+}
+
+func (e *AuthError) Error() string {
+	return e.Description
+}
+
+var (
+	ErrTokenMissing          = &AuthError{http.StatusUnauthorized, "", "token_missing", "Authentication required"}
+	ErrAuthHeaderMalformed   = &AuthError{http.StatusBadRequest, "invalid_request", "authorization_header_malformed", "The Authorization header must use the Bearer scheme"}
+	ErrTokenMalformed        = &AuthError{http.StatusUnauthorized, "invalid_token", "token_malformed", "The access token is malformed"}
+	ErrTokenExpired          = &AuthError{http.StatusUnauthorized, "invalid_token", "token_expired", "The access token expired"}
+	ErrTokenSignatureInvalid = &AuthError{http.StatusUnauthorized, "invalid_token", "token_signature_invalid", "The access token signature is invalid"}
+	ErrTokenInvalid          = &AuthError{http.StatusUnauthorized, "invalid_token", "token_invalid", "The access token is invalid"}
+	ErrTokenRevoked          = &AuthError{http.StatusUnauthorized, "invalid_token", "token_revoked", "The access token was revoked"}
+	ErrMFAPending            = &AuthError{http.StatusUnauthorized, "invalid_token", "mfa_required", "Two-factor authentication must be completed first"}
+	ErrAccountDisabled       = &AuthError{http.StatusForbidden, "invalid_token", "account_disabled", "The account is disabled"}
+	ErrAPIKeyInvalid         = &AuthError{http.StatusUnauthorized, "", "api_key_invalid", "The API key is invalid"}
+	ErrAPIKeyExpired         = &AuthError{http.StatusUnauthorized, "", "api_key_expired", "The API key expired"}
+	ErrInsufficientScope     = &AuthError{http.StatusForbidden, "insufficient_scope", "insufficient_scope", "The credentials do not grant access to this resource"}
+)
+
+// setAuthChallenge sets the RFC 6750 WWW-Authenticate challenge for 401
+// responses and bearer token errors
+func setAuthChallenge(w http.ResponseWriter, authErr *AuthError) {
+	if authErr.Status != http.StatusUnauthorized && authErr.OAuthError == "" {
+		return
+	}
+
+	challenge := fmt.Sprintf("Bearer realm=%q", authRealm)
+	if authErr.OAuthError != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", authErr.OAuthError, authErr.Description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+}
+
+// BearerToken extracts the access token from an RFC 6750 Authorization
+// header. Bare tokens without a scheme are still accepted for older clients.
+func BearerToken(r *http.Request) (string, error) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" {
+		return "", ErrTokenMissing
+	}
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found {
+		if strings.Count(header, ".") == 2 {
+			return header, nil
+		}
+		return "", ErrAuthHeaderMalformed
+	}
+
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "Bearer") || token == "" || strings.ContainsAny(token, " \t") {
+		return "", ErrAuthHeaderMalformed
+	}
+	return token, nil
+}
+
+// SignToken issues a JWT for claims signed with the configured secret
+func SignToken(claims Claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(ttl).Unix()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(GetConfig().Server.JwtSecret))
+}
+
+// ParseToken validates a signed JWT and returns its claims. Errors are
+// *AuthError values telling expired, malformed and forged tokens apart.
+func ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(GetConfig().Server.JwtSecret), nil
+	})
+
+	var validationErr *jwt.ValidationError
+	if errors.As(err, &validationErr) {
+		switch {
+		case validationErr.Errors&jwt.ValidationErrorMalformed != 0:
+			return nil, ErrTokenMalformed
+		case validationErr.Errors&(jwt.ValidationErrorSignatureInvalid|jwt.ValidationErrorUnverifiable) != 0:
+			return nil, ErrTokenSignatureInvalid
+		case validationErr.Errors&jwt.ValidationErrorExpired != 0:
+			return nil, ErrTokenExpired
+		}
+		return nil, ErrTokenInvalid
+	}
+	if err != nil || !token.Valid {
+		return nil, ErrTokenInvalid
+	}
+
+	if _, err := primitive.ObjectIDFromHex(claims.UserID); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	return claims, nil
+}
+
+// ClaimsFromContext returns the JWT claims stored by JWTMiddleware
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// UserIDFromContext returns the ID of the user authenticated by JWTMiddleware
+func UserIDFromContext(ctx context.Context) (primitive.ObjectID, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return primitive.NilObjectID, false
+	}
+	userID, err := primitive.ObjectIDFromHex(claims.UserID)
+	return userID, err == nil
+}
+
+// UsernameFromContext returns the username of the authenticated user
+func UsernameFromContext(ctx context.Context) (string, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return claims.Username, true
+}
+
+// RoleFromContext returns the current role of the authenticated user
+func RoleFromContext(ctx context.Context) (string, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	return claims.Role, true
+}
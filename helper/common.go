@@ -2,6 +2,7 @@ package helper
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
@@ -13,24 +14,29 @@ func WriteJSONResponse(w http.ResponseWriter, status int, payload interface{}) {
 	json.NewEncoder(w).Encode(payload)
 }
 
-func ParseJSONBody(r *http.Request, dst interface{}) error {
-	return json.NewDecoder(r.Body).Decode(dst)
-}
-
 func GenerateID() string {
 	bytes := make([]byte, 16)
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)
 }
 
-func RespondWithError(w http.ResponseWriter, code int, message string) {
-	WriteJSONResponse(w, code, map[string]string{"error": message})
+// HashToken returns the SHA-256 hex digest used to store secrets such as
+// reset tokens, recovery codes and API keys
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 func RespondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
 	response, err := json.Marshal(payload)
 	if err != nil {
-		http.Error(w, "Error converting result to JSON", http.StatusInternalServerError)
+		writeProblem(w, Problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(http.StatusInternalServerError),
+			Status: http.StatusInternalServerError,
+			Detail: "Error converting result to JSON",
+			Code:   CodeInternal,
+		})
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
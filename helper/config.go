@@ -1,40 +1,750 @@
 package helper
 
 import (
-	"io/ioutil"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	ProfileDev  = "dev"
+	ProfileTest = "test"
+	ProfileProd = "prod"
+
+	// EnvPrefix prefixes the environment variable of every config field,
+	// e.g. WEBCART_SERVER_JWT_SECRET for server.jwt_secret
+	EnvPrefix = "WEBCART_"
+
+	defaultConfigPath = "config/config.yaml"
+	minProdSecretLen  = 32
+)
+
 var (
 	config *Config
 	once   sync.Once
 )
 
+// Config is built by LoadConfig. Fields are addressed by their yaml path,
+// e.g. server.iam_port; fields tagged redact are masked in LogValue.
 type Config struct {
-	Server struct {
-		IamPort   string `yaml:"iam_port"`
-		TrxPort   string `yaml:"trx_port"`
-		SetupPort string `yaml:"setup_port"`
-		JwtSecret string `yaml:"jwt_secret"`
-		MongoURI  string `yaml:"mongo_uri"`
+	Profile string `yaml:"profile"`
+	Server  struct {
+		IamPort   int    `yaml:"iam_port"`
+		TrxPort   int    `yaml:"trx_port"`
+		SetupPort int    `yaml:"setup_port"`
+		JwtSecret string `yaml:"jwt_secret" redact:"secret"`
+		MongoURI  string `yaml:"mongo_uri" redact:"url"`
 		MongoDB   string `yaml:"mongo_db"`
 	} `yaml:"server"`
+	Mongo struct {
+		MaxPoolSize            uint64        `yaml:"max_pool_size"`
+		MinPoolSize            uint64        `yaml:"min_pool_size"`
+		MaxConnIdleTime        time.Duration `yaml:"max_conn_idle_time"`
+		ConnectTimeout         time.Duration `yaml:"connect_timeout"`
+		ServerSelectionTimeout time.Duration `yaml:"server_selection_timeout"`
+		SocketTimeout          time.Duration `yaml:"socket_timeout"`
+		RetryWrites            bool          `yaml:"retry_writes"`
+		ReadPreference         string        `yaml:"read_preference"`
+		// AutoMigrate applies pending migrations at startup; when off, run
+		// the migrate command before deploying
+		AutoMigrate bool `yaml:"auto_migrate"`
+		// MigrateTimeout bounds a migration run, including waiting for
+		// another instance that is migrating
+		MigrateTimeout time.Duration `yaml:"migrate_timeout"`
+	} `yaml:"mongo"`
+	HTTP struct {
+		ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+		ReadTimeout       time.Duration `yaml:"read_timeout"`
+		WriteTimeout      time.Duration `yaml:"write_timeout"`
+		IdleTimeout       time.Duration `yaml:"idle_timeout"`
+		ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+		// DrainDelay is how long readiness fails before the servers stop
+		// accepting requests on shutdown
+		DrainDelay time.Duration `yaml:"drain_delay"`
+		// RequestTimeout bounds every request unless its route template
+		// has its own entry in RouteTimeouts
+		RequestTimeout time.Duration            `yaml:"request_timeout"`
+		RouteTimeouts  map[string]time.Duration `yaml:"route_timeouts"`
+		MaxBodyBytes   int64                    `yaml:"max_body_bytes"`
+		// HSTSMaxAge is sent in Strict-Transport-Security; 0 disables it
+		HSTSMaxAge time.Duration `yaml:"hsts_max_age"`
+		// TrustedProxies are the addresses or CIDRs of load balancers whose
+		// X-Forwarded-For entries are believed, see ClientIP
+		TrustedProxies []string `yaml:"trusted_proxies"`
+	} `yaml:"http"`
+	MFA struct {
+		Issuer          string `yaml:"issuer"`
+		RequireForAdmin bool   `yaml:"require_for_admin"`
+	} `yaml:"mfa"`
+	OIDC struct {
+		Providers map[string]OIDCProviderConfig `yaml:"providers"`
+	} `yaml:"oidc"`
+	Log struct {
+		// Format is json or text
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+	Tracing struct {
+		// Exporter is none, stdout or otlp
+		Exporter string `yaml:"exporter"`
+		// Endpoint is the host:port of an OTLP/HTTP collector
+		Endpoint    string  `yaml:"endpoint"`
+		Insecure    bool    `yaml:"insecure"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+	} `yaml:"tracing"`
+	// Runtime settings are reloaded while the services run, see Settings
+	Runtime RuntimeSettings `yaml:"runtime"`
+
+	// args are the command line arguments the config was loaded with, so
+	// reloads layer the same flags
+	args []string
+	// fileSecrets are the paths of secrets that were read from a config
+	// file, which only the dev profile accepts
+	fileSecrets []string
+}
+
+type OIDCProviderConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret" redact:"secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
 }
 
+// GetConfig returns the configuration installed with SetConfig, or loads it
+// from the config file and environment on first use
 func GetConfig() *Config {
 	once.Do(func() {
-		config = &Config{}
-		data, err := ioutil.ReadFile("config/config.yaml")
+		cfg, err := LoadConfig(nil)
 		if err != nil {
-			log.Fatalf("Failed to read config file: %v", err)
+			slog.Error("Error loading config", "error", err)
+			os.Exit(1)
+		}
+		config = cfg
+	})
+	return config
+}
+
+// SetConfig installs cfg as the configuration returned by GetConfig. It must
+// be called before the services start.
+func SetConfig(cfg *Config) {
+	once.Do(func() {})
+	config = cfg
+	storeSettings(cfg.Runtime)
+}
+
+func defaultConfig() *Config {
+	cfg := &Config{Profile: ProfileProd}
+	cfg.Server.IamPort = 8081
+	cfg.Server.TrxPort = 8082
+	cfg.Server.SetupPort = 8083
+	cfg.Server.MongoURI = "mongodb://localhost:27017"
+	cfg.Server.MongoDB = "webcart"
+	cfg.Mongo.MaxPoolSize = 100
+	cfg.Mongo.MaxConnIdleTime = 5 * time.Minute
+	cfg.Mongo.ConnectTimeout = 10 * time.Second
+	cfg.Mongo.ServerSelectionTimeout = 5 * time.Second
+	cfg.Mongo.RetryWrites = true
+	cfg.Mongo.ReadPreference = "primary"
+	cfg.Mongo.AutoMigrate = true
+	cfg.Mongo.MigrateTimeout = 5 * time.Minute
+	cfg.HTTP.ReadHeaderTimeout = 5 * time.Second
+	cfg.HTTP.ReadTimeout = 15 * time.Second
+	cfg.HTTP.WriteTimeout = 30 * time.Second
+	cfg.HTTP.IdleTimeout = 60 * time.Second
+	cfg.HTTP.ShutdownTimeout = 20 * time.Second
+	cfg.HTTP.RequestTimeout = 30 * time.Second
+	cfg.HTTP.MaxBodyBytes = 1 << 20
+	cfg.MFA.Issuer = "WebCart"
+	cfg.Log.Format = "json"
+	cfg.Tracing.Exporter = TracingExporterNone
+	cfg.Tracing.Endpoint = "localhost:4318"
+	cfg.Tracing.Insecure = true
+	cfg.Tracing.SampleRatio = 1
+	cfg.Runtime = defaultRuntimeSettings()
+	return cfg
+}
+
+// LoadConfig layers defaults, the config file, the profile's config file,
+// environment variables and command line flags, in that order, and
+// validates the result.
+//
+// The config file is config/config.yaml unless --config or WEBCART_CONFIG
+// names another one. The profile, prod unless set, picks the file next to
+// it, e.g. config/config.prod.yaml. Every field can be set with a flag
+// named after its path, e.g. --server.iam_port=9000; map entries are named
+// by their key, e.g. --oidc.providers.google.client_id.
+func LoadConfig(args []string) (*Config, error) {
+	cfg := defaultConfig()
+	cfg.args = args
+	keys := configKeys(reflect.TypeOf(cfg).Elem(), "")
+
+	fs := flag.NewFlagSet("webcart", flag.ContinueOnError)
+	path := fs.String("config", "", "path of the config file (env "+EnvPrefix+"CONFIG)")
+	overrides := map[string]string{}
+	addFlag := func(name string) {
+		fs.Func(name, "sets "+name+" (env "+envName(name)+")", func(raw string) error {
+			overrides[name] = raw
+			return nil
+		})
+	}
+	for _, key := range keys {
+		if !strings.Contains(key, "*") {
+			addFlag(key)
+		}
+	}
+	// Flags of map entries cannot be known ahead, so take them from args
+	for _, name := range flagNames(args) {
+		if fs.Lookup(name) == nil && matchConfigKey(keys, name) {
+			addFlag(name)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := true
+	if *path == "" {
+		*path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if *path == "" {
+		*path, explicit = defaultConfigPath, false
+	}
+	if err := readConfigFile(cfg, *path, explicit); err != nil {
+		return nil, err
+	}
+
+	// The profile picks the second file, so resolve it ahead of the other
+	// environment variables and flags
+	if profile, ok := overrides["profile"]; ok {
+		cfg.Profile = profile
+	} else if profile := os.Getenv(envName("profile")); profile != "" {
+		cfg.Profile = profile
+	}
+	ext := filepath.Ext(*path)
+	profilePath := strings.TrimSuffix(*path, ext) + "." + cfg.Profile + ext
+	if err := readConfigFile(cfg, profilePath, false); err != nil {
+		return nil, err
+	}
+	fileSecrets := secretValues(cfg)
+
+	env := envOverrides(keys)
+	for _, path := range sortedKeys(env) {
+		if err := setConfigPath(reflect.ValueOf(cfg).Elem(), strings.Split(path, "."), env[path]); err != nil {
+			return nil, fmt.Errorf("%s: %w", envName(path), err)
+		}
+	}
+	for _, path := range sortedKeys(overrides) {
+		if err := setConfigPath(reflect.ValueOf(cfg).Elem(), strings.Split(path, "."), overrides[path]); err != nil {
+			return nil, fmt.Errorf("--%s: %w", path, err)
+		}
+	}
+
+	// Secrets left as a config file set them were committed with it
+	for path, value := range secretValues(cfg) {
+		if fileSecrets[path] == value {
+			cfg.fileSecrets = append(cfg.fileSecrets, path)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfigFile merges the yaml file at path into cfg. Unknown keys are
+// rejected so that typos do not go unnoticed.
+func readConfigFile(cfg *Config, path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// weakSecrets are secrets that were committed or shipped in example files
+var weakSecrets = map[string]bool{
+	"Lu4r_B145a": true,
+	"secret":     true,
+	"changeme":   true,
+}
+
+// Validate reports every invalid setting at once. Profiles other than dev
+// refuse secrets read from config files, and prod also refuses weak or
+// missing secrets.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch c.Profile {
+	case ProfileDev, ProfileTest, ProfileProd:
+	default:
+		fail("profile: must be one of %s, %s, %s, got %q", ProfileDev, ProfileTest, ProfileProd, c.Profile)
+	}
+
+	ports := map[int]string{}
+	for name, port := range map[string]int{
+		"server.iam_port":   c.Server.IamPort,
+		"server.trx_port":   c.Server.TrxPort,
+		"server.setup_port": c.Server.SetupPort,
+	} {
+		if port < 1 || port > 65535 {
+			fail("%s: must be between 1 and 65535, got %d", name, port)
+		} else if other, ok := ports[port]; ok {
+			fail("%s: port %d already used by %s", name, port, other)
+		}
+		ports[port] = name
+	}
+
+	if c.Server.JwtSecret == "" {
+		fail("server.jwt_secret: is required")
+	}
+	if _, err := url.Parse(c.Server.MongoURI); err != nil || !strings.HasPrefix(c.Server.MongoURI, "mongodb") {
+		fail("server.mongo_uri: must be a mongodb:// or mongodb+srv:// URI")
+	}
+	if c.Server.MongoDB == "" {
+		fail("server.mongo_db: is required")
+	}
+	if c.Mongo.MaxPoolSize > 0 && c.Mongo.MinPoolSize > c.Mongo.MaxPoolSize {
+		fail("mongo.min_pool_size: must not exceed mongo.max_pool_size")
+	}
+	if c.Mongo.MigrateTimeout <= 0 {
+		fail("mongo.migrate_timeout: must be positive")
+	}
+	switch c.Mongo.ReadPreference {
+	case "", "primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest":
+	default:
+		fail("mongo.read_preference: unknown mode %q", c.Mongo.ReadPreference)
+	}
+	for name, d := range map[string]time.Duration{
+		"mongo.max_conn_idle_time":       c.Mongo.MaxConnIdleTime,
+		"mongo.connect_timeout":          c.Mongo.ConnectTimeout,
+		"mongo.server_selection_timeout": c.Mongo.ServerSelectionTimeout,
+		"mongo.socket_timeout":           c.Mongo.SocketTimeout,
+		"http.read_header_timeout":       c.HTTP.ReadHeaderTimeout,
+		"http.read_timeout":              c.HTTP.ReadTimeout,
+		"http.write_timeout":             c.HTTP.WriteTimeout,
+		"http.idle_timeout":              c.HTTP.IdleTimeout,
+		"http.shutdown_timeout":          c.HTTP.ShutdownTimeout,
+		"http.drain_delay":               c.HTTP.DrainDelay,
+		"http.request_timeout":           c.HTTP.RequestTimeout,
+		"http.hsts_max_age":              c.HTTP.HSTSMaxAge,
+	} {
+		if d < 0 {
+			fail("%s: must not be negative", name)
 		}
-		err = yaml.Unmarshal(data, config)
+	}
+	for route, d := range c.HTTP.RouteTimeouts {
+		if d <= 0 {
+			fail("http.route_timeouts.%s: must be positive", route)
+		}
+	}
+	if c.HTTP.MaxBodyBytes <= 0 {
+		fail("http.max_body_bytes: must be positive")
+	}
+	for _, proxy := range c.HTTP.TrustedProxies {
+		if _, err := parseProxy(proxy); err != nil {
+			fail("http.trusted_proxies: %v", err)
+		}
+	}
+	for name, provider := range c.OIDC.Providers {
+		if provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+			fail("oidc.providers.%s: issuer, client_id and redirect_url are required", name)
+		}
+	}
+
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		fail("log.format: must be json or text, got %q", c.Log.Format)
+	}
+
+	switch c.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterStdout:
+	case TracingExporterOTLP:
+		if c.Tracing.Endpoint == "" {
+			fail("tracing.endpoint: is required for the otlp exporter")
+		}
+	default:
+		fail("tracing.exporter: must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio: must be between 0 and 1")
+	}
+
+	if err := c.Runtime.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Profile != ProfileDev {
+		for _, path := range c.fileSecrets {
+			fail("%s: must be set in the environment or with a flag, config files are committed", path)
+		}
+	}
+	if c.Profile == ProfileProd {
+		if c.Server.JwtSecret != "" && weakSecret(c.Server.JwtSecret) {
+			fail("server.jwt_secret: must be at least %d characters and not a known default in prod", minProdSecretLen)
+		}
+		for name, provider := range c.OIDC.Providers {
+			if provider.ClientSecret == "" {
+				fail("oidc.providers.%s.client_secret: is required in prod", name)
+			}
+		}
+		errs = append(errs, c.Runtime.CORS.validateProd()...)
+	}
+
+	// Map iteration order is random, keep the message stable
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func weakSecret(secret string) bool {
+	if len(secret) < minProdSecretLen || weakSecrets[secret] {
+		return true
+	}
+	distinct := map[rune]bool{}
+	for _, r := range secret {
+		distinct[r] = true
+	}
+	return len(distinct) < 8
+}
+
+// LogValue logs the configuration as one attribute per field with secrets
+// masked, for logging at startup
+func (c *Config) LogValue() slog.Value {
+	var attrs []slog.Attr
+	walkConfig(reflect.ValueOf(c).Elem(), "", "", func(f configField) error {
+		attrs = append(attrs, slog.String(f.path, redactValue(f)))
+		return nil
+	})
+	return slog.GroupValue(attrs...)
+}
+
+func redactValue(f configField) string {
+	value := formatConfigValue(f.value)
+	if value == "" {
+		return value
+	}
+	switch f.redact {
+	case "secret":
+		return "[REDACTED]"
+	case "url":
+		u, err := url.Parse(value)
 		if err != nil {
-			log.Fatalf("Failed to unmarshal config file: %v", err)
+			return "[REDACTED]"
 		}
+		return u.Redacted()
+	}
+	return value
+}
+
+// secretValues returns the non-empty secrets of cfg by path
+func secretValues(cfg *Config) map[string]string {
+	secrets := map[string]string{}
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", "", func(f configField) error {
+		if value := formatConfigValue(f.value); f.redact == "secret" && value != "" {
+			secrets[f.path] = value
+		}
+		return nil
 	})
-	return config
+	return secrets
+}
+
+// configKeys lists the paths of the leaf fields of t, whether set or not.
+// Map keys are "*".
+func configKeys(t reflect.Type, path string) []string {
+	switch {
+	case t.Kind() == reflect.Struct:
+		var keys []string
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, inline := configFieldName(field)
+			switch {
+			case name == "-":
+			case inline:
+				keys = append(keys, configKeys(field.Type, path)...)
+			default:
+				keys = append(keys, configKeys(field.Type, joinPath(path, name))...)
+			}
+		}
+		return keys
+	case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String:
+		return configKeys(t.Elem(), joinPath(path, "*"))
+	default:
+		return []string{path}
+	}
+}
+
+// configFieldName returns the yaml name of a field, "-" for fields that
+// are not configured, and whether it is inlined
+func configFieldName(field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("yaml"), ",")
+	name := tag[0]
+	if name == "-" || !field.IsExported() {
+		return "-", false
+	}
+	if len(tag) > 1 && tag[1] == "inline" {
+		return "", true
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, false
+}
+
+// matchConfigKey reports whether path is one of keys, with "*" matching any
+// map key
+func matchConfigKey(keys []string, path string) bool {
+	segments := strings.Split(path, ".")
+	for _, key := range keys {
+		pattern := strings.Split(key, ".")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		match := true
+		for i := range pattern {
+			if segments[i] == "" || pattern[i] != "*" && pattern[i] != segments[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// flagNames returns the names of the flags in args
+func flagNames(args []string) []string {
+	var names []string
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		names = append(names, name)
+	}
+	return names
+}
+
+// envOverrides collects the environment variables of keys by path. The
+// variables of map entries are found by their prefix and suffix, e.g.
+// WEBCART_OIDC_PROVIDERS_GOOGLE_CLIENT_ID, and the key is lower cased.
+func envOverrides(keys []string) map[string]string {
+	env := map[string]string{}
+	for _, key := range keys {
+		before, after, isMap := strings.Cut(key, "*")
+		if !isMap {
+			if raw, ok := os.LookupEnv(envName(key)); ok {
+				env[key] = raw
+			}
+			continue
+		}
+		if strings.Contains(after, "*") {
+			// Maps of maps are only set by files
+			continue
+		}
+		prefix, suffix := envName(before), strings.TrimPrefix(envName(after), EnvPrefix)
+		for _, variable := range os.Environ() {
+			name, raw, _ := strings.Cut(variable, "=")
+			if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+				continue
+			}
+			mapKey := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix))
+			env[before+mapKey+after] = raw
+		}
+	}
+	return env
+}
+
+// setConfigPath parses raw into the field at path below v, adding map
+// entries on the way
+func setConfigPath(v reflect.Value, path []string, raw string) error {
+	switch {
+	case v.Kind() == reflect.Struct && len(path) > 0:
+		for i := 0; i < v.NumField(); i++ {
+			name, inline := configFieldName(v.Type().Field(i))
+			if inline {
+				if err := setConfigPath(v.Field(i), path, raw); err == nil {
+					return nil
+				}
+			}
+			if name == path[0] {
+				return setConfigPath(v.Field(i), path[1:], raw)
+			}
+		}
+		return fmt.Errorf("unknown field %s", path[0])
+	case v.Kind() == reflect.Map && len(path) > 0:
+		key := reflect.ValueOf(path[0]).Convert(v.Type().Key())
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
+		}
+		if err := setConfigPath(elem, path[1:], raw); err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	case len(path) > 0:
+		return fmt.Errorf("unknown field %s", path[0])
+	}
+	return setConfigValue(v, raw)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type configField struct {
+	path   string
+	redact string
+	value  reflect.Value
+}
+
+// walkConfig calls visit for every leaf field below v. Map entries are
+// visited through read-only copies.
+func walkConfig(v reflect.Value, path, redact string, visit func(configField) error) error {
+	switch {
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, inline := configFieldName(field)
+			if name == "-" {
+				continue
+			}
+			if inline {
+				if err := walkConfig(v.Field(i), path, redact, visit); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := walkConfig(v.Field(i), joinPath(path, name), field.Tag.Get("redact"), visit); err != nil {
+				return err
+			}
+		}
+		return nil
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			if err := walkConfig(v.MapIndex(key), joinPath(path, key.String()), redact, visit); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return visit(configField{path: path, redact: redact, value: v})
+	}
+}
+
+func joinPath(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(path))
+}
+
+func setConfigValue(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func formatConfigValue(v reflect.Value) string {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(v.Int()).String()
+	}
+	if v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v.Interface())
 }
@@ -0,0 +1,238 @@
+package helper
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CodeCORSRejected is returned for preflight requests the CORS policy does
+// not allow
+const CodeCORSRejected = "cors_rejected"
+
+// CORSPolicy is the CORS configuration of a service
+type CORSPolicy struct {
+	// AllowedOrigins are origins such as https://shop.example, * for any
+	// origin, or https://*.shop.example for any subdomain
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// AllowedHeaders are the request headers a client may send; * allows
+	// any header
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// CORSSettings is the default policy plus per service policies, which
+// replace the default as a whole
+type CORSSettings struct {
+	CORSPolicy `yaml:",inline"`
+	// Services maps a service (iam, trx or setup) to its own policy
+	Services map[string]CORSPolicy `yaml:"services"`
+}
+
+func defaultCORSSettings() CORSSettings {
+	// No origin is allowed until the config lists them
+	return CORSSettings{CORSPolicy: CORSPolicy{
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key", RequestIDHeader, IdempotencyKeyHeader},
+		ExposedHeaders: []string{
+			RequestIDHeader, RateLimitLimitHeader, RateLimitRemainingHeader, RateLimitResetHeader, RateLimitPolicyHeader,
+			"Retry-After", IdempotentReplayedHeader,
+		},
+		MaxAge: 10 * time.Minute,
+	}}
+}
+
+// Policy returns the policy of service
+func (c *CORSSettings) Policy(service string) *CORSPolicy {
+	if policy, ok := c.Services[service]; ok {
+		return &policy
+	}
+	return &c.CORSPolicy
+}
+
+// policies returns the default and the per service policies by config path
+func (c *CORSSettings) policies() map[string]CORSPolicy {
+	policies := map[string]CORSPolicy{"runtime.cors": c.CORSPolicy}
+	for service, policy := range c.Services {
+		policies["runtime.cors.services."+service] = policy
+	}
+	return policies
+}
+
+func (c *CORSSettings) validate() []error {
+	var errs []error
+	for path, policy := range c.policies() {
+		errs = append(errs, policy.validate(path)...)
+	}
+	return errs
+}
+
+// validateProd rejects any origin, so prod only answers the origins it lists
+func (c *CORSSettings) validateProd() []error {
+	var errs []error
+	for path, policy := range c.policies() {
+		for _, origin := range policy.AllowedOrigins {
+			if origin == "*" {
+				errs = append(errs, fmt.Errorf("%s.allowed_origins: * is not allowed in prod, list the origins", path))
+			}
+		}
+	}
+	return errs
+}
+
+func (p *CORSPolicy) validate(path string) []error {
+	var errs []error
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if p.AllowCredentials {
+				errs = append(errs, fmt.Errorf("%s.allowed_origins: * cannot be combined with allow_credentials", path))
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" || strings.Contains(u.Host, "*") {
+			errs = append(errs, fmt.Errorf("%s.allowed_origins: %q is not *, scheme://host or scheme://*.domain", path, origin))
+		}
+	}
+	for _, method := range p.AllowedMethods {
+		if method == "" || method != strings.ToUpper(method) || strings.ContainsAny(method, " ,") {
+			errs = append(errs, fmt.Errorf("%s.allowed_methods: %q is not an upper case method", path, method))
+		}
+	}
+	if len(p.AllowedMethods) == 0 {
+		errs = append(errs, fmt.Errorf("%s.allowed_methods: must not be empty", path))
+	}
+	if p.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("%s.max_age: must not be negative", path))
+	}
+	return errs
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" if the origin is not allowed
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.TrimSuffix(allowed, "/")
+		switch {
+		case allowed == "*":
+			return "*"
+		case strings.EqualFold(allowed, origin):
+			return origin
+		case strings.Contains(allowed, "://*."):
+			scheme, domain, _ := strings.Cut(allowed, "://*")
+			prefix, host, ok := strings.Cut(origin, "://")
+			// The subdomain must be non-empty and the port must match
+			if ok && strings.EqualFold(prefix, scheme) && len(host) > len(domain) &&
+				strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain)) && !strings.ContainsAny(host, "/@?#") {
+				return origin
+			}
+		}
+	}
+	return ""
+}
+
+func (p *CORSPolicy) allowMethod(method string) bool {
+	for _, allowed := range p.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// disallowedHeader returns the first of the comma separated headers the
+// policy does not allow
+func (p *CORSPolicy) disallowedHeader(headers string) string {
+	for _, header := range strings.Split(headers, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, candidate := range p.AllowedHeaders {
+			if candidate == "*" || strings.EqualFold(candidate, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return header
+		}
+	}
+	return ""
+}
+
+// CORSMiddleware applies the CORS policy of service in
+// runtime.cors, read on every request so that reloads apply immediately.
+// Preflight requests are answered here and rejected with 403 unless the
+// origin, method and headers are all allowed; other requests from
+// disallowed origins are served without CORS headers, so browsers do not
+// expose the response.
+func CORSMiddleware(service string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The response depends on Origin even when it is missing, so
+			// caches must not reuse it across origins
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			policy := Settings().CORS.Policy(service)
+			allowed := policy.allowOrigin(origin)
+
+			requestMethod := r.Header.Get("Access-Control-Request-Method")
+			if r.Method == http.MethodOptions && requestMethod != "" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				requestHeaders := r.Header.Get("Access-Control-Request-Headers")
+				header := policy.disallowedHeader(requestHeaders)
+				switch {
+				case allowed == "":
+					WriteError(w, r, Forbidden("Origin not allowed").WithCode(CodeCORSRejected))
+					return
+				case !policy.allowMethod(requestMethod):
+					WriteError(w, r, Forbidden("Method not allowed by CORS policy").WithCode(CodeCORSRejected))
+					return
+				case header != "":
+					WriteError(w, r, Forbidden("Header "+header+" not allowed by CORS policy").WithCode(CodeCORSRejected))
+					return
+				}
+
+				setAllowOrigin(w, policy, allowed)
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+				if requestHeaders != "" {
+					w.Header().Set("Access-Control-Allow-Headers", requestHeaders)
+				}
+				if policy.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if allowed != "" {
+				setAllowOrigin(w, policy, allowed)
+				if len(policy.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setAllowOrigin(w http.ResponseWriter, policy *CORSPolicy, allowed string) {
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if policy.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
@@ -2,63 +2,152 @@ package helper
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"reflect"
+	"strings"
 
 	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
-var client *mongo.Client
+// Database is the process-wide MongoDB handle. It wraps a single pooled
+// client shared by every service through the repositories.
+type Database struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
 
-func InitDB(uri string, collections []string) *mongo.Client {
-	clientOptions := options.Client().ApplyURI(uri)
-	var err error
-	client, err = mongo.Connect(context.Background(), clientOptions)
+// ConnectDB connects to MongoDB using the pool settings from config and
+// pings the primary before returning
+func ConnectDB(ctx context.Context, cfg *Config) (*Database, error) {
+	readPrefMode, err := readpref.ModeFromString(cfg.Mongo.ReadPreference)
 	if err != nil {
-		log.Fatalf("Error connecting to MongoDB: %v", err)
+		return nil, fmt.Errorf("invalid read preference %q: %w", cfg.Mongo.ReadPreference, err)
 	}
-
-	cfg := GetConfig()
-	db := client.Database(cfg.Server.MongoDB)
-	for _, collection := range collections {
-		CreateCollectionIfNotExists(db, collection)
+	readPref, err := readpref.New(readPrefMode)
+	if err != nil {
+		return nil, err
 	}
 
-	return client
-}
+	clientOptions := options.Client().
+		ApplyURI(cfg.Server.MongoURI).
+		SetMaxPoolSize(cfg.Mongo.MaxPoolSize).
+		SetMinPoolSize(cfg.Mongo.MinPoolSize).
+		SetMaxConnIdleTime(cfg.Mongo.MaxConnIdleTime).
+		SetConnectTimeout(cfg.Mongo.ConnectTimeout).
+		SetServerSelectionTimeout(cfg.Mongo.ServerSelectionTimeout).
+		SetRetryWrites(cfg.Mongo.RetryWrites).
+		SetReadPreference(readPref).
+		SetServerMonitor(serverMonitor()).
+		SetMonitor(chainMonitors(otelmongo.NewMonitor(), commandMonitor()))
+	if cfg.Mongo.SocketTimeout > 0 {
+		clientOptions.SetSocketTimeout(cfg.Mongo.SocketTimeout)
+	}
 
-func CreateCollectionIfNotExists(db *mongo.Database, collectionName string) {
-	collections, err := db.ListCollectionNames(context.Background(), bson.D{})
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatalf("Error listing collections: %v", err)
+		return nil, err
 	}
 
-	collectionExists := false
-	for _, name := range collections {
-		if name == collectionName {
-			collectionExists = true
-			break
-		}
+	d := &Database{client: client, db: client.Database(cfg.Server.MongoDB)}
+	if err := d.Ping(ctx); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("ping MongoDB: %w", err)
 	}
+	return d, nil
+}
 
-	if !collectionExists {
-		err := db.CreateCollection(context.Background(), collectionName)
-		if err != nil {
-			log.Fatalf("Error creating collection: %v", err)
-		}
-		log.Printf("Collection %s created.", collectionName)
+// serverMonitor logs when a server becomes unreachable and when the client
+// reconnects to it
+func serverMonitor() *event.ServerMonitor {
+	return &event.ServerMonitor{
+		ServerDescriptionChanged: func(e *event.ServerDescriptionChangedEvent) {
+			prev, next := e.PreviousDescription.Kind, e.NewDescription.Kind
+			switch {
+			case prev != 0 && next == 0:
+				slog.Warn("MongoDB server unreachable", "address", e.Address.String(), "error", e.NewDescription.LastError)
+			case prev == 0 && next != 0:
+				slog.Info("MongoDB server connected", "address", e.Address.String(), "kind", next.String())
+			}
+		},
+	}
+}
+
+// chainMonitors calls every monitor for each command event, since the
+// driver accepts a single command monitor
+func chainMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
 	}
 }
 
-func GetDBClient() *mongo.Client {
-	return client
+func (d *Database) Client() *mongo.Client {
+	return d.client
+}
+
+func (d *Database) DB() *mongo.Database {
+	return d.db
+}
+
+// Ping checks that the primary is reachable
+func (d *Database) Ping(ctx context.Context) error {
+	return d.client.Ping(ctx, readpref.Primary())
 }
 
-func SetDBClient(mongoClient *mongo.Client) {
-	client = mongoClient
+// Close disconnects the client, waiting for in-use connections up to ctx
+func (d *Database) Close(ctx context.Context) error {
+	return d.client.Disconnect(ctx)
+}
+
+// EnsureCollections creates any of the given collections that do not exist
+func (d *Database) EnsureCollections(ctx context.Context, collections []string) error {
+	existing, err := d.db.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("list collections: %w", err)
+	}
+
+	names := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		names[name] = true
+	}
+
+	for _, collection := range collections {
+		if names[collection] {
+			continue
+		}
+		if err := d.db.CreateCollection(ctx, collection); err != nil {
+			return fmt.Errorf("create collection %s: %w", collection, err)
+		}
+		slog.Info("Collection created", "collection", collection)
+	}
+	return nil
 }
 
 func GetAllModels() []interface{} {
@@ -68,6 +157,14 @@ func GetAllModels() []interface{} {
 		model.Cart{},
 		model.Coupon{},
 		model.History{},
+		model.User{},
+		model.AuditLog{},
+		model.AuthState{},
+		model.APIKey{},
+		model.FeatureFlag{},
+		model.RateLimitBucket{},
+		model.IdempotencyRecord{},
+		model.Migration{},
 	}
 }
 
@@ -89,18 +186,48 @@ func getTableName(model interface{}) string {
 		results := method.Func.Call([]reflect.Value{reflect.ValueOf(model)})
 		return results[0].String()
 	}
-	log.Fatalf("getTableName method not found for model %s", modelType.Name())
-	return ""
+	panic(fmt.Sprintf("getTableName method not found for model %s", modelType.Name()))
 }
 
-func GetCollection(TableName string) *mongo.Collection {
-	collectionName := TableName
+func GetTableName(models interface{}) string {
+	return getTableName(models)
+}
 
-	cfg := GetConfig()
-	db := client.Database(cfg.Server.MongoDB)
-	return db.Collection(collectionName)
+// Migrator returns the runner of the repository migrations
+func (d *Database) Migrator() *repository.Migrator {
+	return repository.NewMigrator(d.db, repository.Migrations())
 }
 
-func GetTableName(models interface{}) string {
-	return getTableName(models)
+// Migrate applies the pending migrations, or only reports them when
+// mongo.auto_migrate is off
+func (d *Database) Migrate(ctx context.Context, cfg *Config) error {
+	migrator := d.Migrator()
+	if !cfg.Mongo.AutoMigrate {
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range pending {
+			slog.Warn("Migration pending", "version", migration.Version, "name", migration.Name)
+		}
+		return nil
+	}
+
+	applied, err := migrator.Up(ctx, 0)
+	for _, migration := range applied {
+		slog.Info("Migration applied", "version", migration.Version, "name", migration.Name)
+	}
+	return err
+}
+
+// CheckIndexes fails if any index the repositories need is missing
+func (d *Database) CheckIndexes(ctx context.Context) error {
+	missing, err := repository.MissingIndexes(ctx, d.db)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing indexes: %s", strings.Join(missing, ", "))
+	}
+	return nil
 }
@@ -0,0 +1,151 @@
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Error codes shared by all services. Handlers may use more specific codes.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeValidationFailed = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeInternal         = "internal_error"
+	CodeBadGateway       = "bad_gateway"
+)
+
+// FieldError describes why a single request field was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// AppError is the error type returned by handlers. It is rendered as an
+// RFC 7807 problem document by WriteError; Err is logged but never sent.
+type AppError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// WithCode replaces the generic code of e with a more specific one
+func (e *AppError) WithCode(code string) *AppError {
+	e.Code = code
+	return e
+}
+
+func (e *AppError) WithField(field, message string) *AppError {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: message})
+	return e
+}
+
+func NewError(status int, code, message string) *AppError {
+	return &AppError{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *AppError {
+	return NewError(http.StatusBadRequest, CodeBadRequest, message)
+}
+
+func Unauthorized(message string) *AppError {
+	return NewError(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func Forbidden(message string) *AppError {
+	return NewError(http.StatusForbidden, CodeForbidden, message)
+}
+
+func NotFound(message string) *AppError {
+	return NewError(http.StatusNotFound, CodeNotFound, message)
+}
+
+func Conflict(message string) *AppError {
+	return NewError(http.StatusConflict, CodeConflict, message)
+}
+
+// Internal reports a server side failure; cause is logged, not returned
+func Internal(message string, cause error) *AppError {
+	return &AppError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: message, Err: cause}
+}
+
+// Problem is an RFC 7807 problem details document
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// WriteError renders err as application/problem+json. Errors that are not
+// *AppError or *AuthError become a generic 500 so internals never leak.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var appErr *AppError
+	var authErr *AuthError
+	switch {
+	case errors.As(err, &authErr):
+		setAuthChallenge(w, authErr)
+		appErr = &AppError{Status: authErr.Status, Code: authErr.Code, Message: authErr.Description}
+	case errors.As(err, &appErr):
+	default:
+		appErr = Internal("Internal server error", err)
+	}
+
+	if appErr.Status >= http.StatusInternalServerError && requestTimedOut(r) {
+		appErr = &AppError{Status: http.StatusServiceUnavailable, Code: CodeTimeout, Message: "Request timed out", Err: err}
+	}
+
+	if appErr.Status >= http.StatusInternalServerError {
+		LoggerFromContext(r.Context()).Error("Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+
+	problem := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(appErr.Status),
+		Status:   appErr.Status,
+		Detail:   appErr.Message,
+		Instance: r.URL.Path,
+		Code:     appErr.Code,
+		Errors:   appErr.Fields,
+	}
+
+	writeProblem(w, problem)
+}
+
+func writeProblem(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// HandlerFunc is an HTTP handler that reports failures by returning them
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// Handle adapts fn to http.HandlerFunc and renders its error, if any
+func Handle(fn HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(w, r); err != nil {
+			WriteError(w, r, err)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package helper
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+)
+
+// Reasons reported with a flag evaluation
+const (
+	FlagReasonUnknown  = "unknown"  // no such flag, runtime.features decides
+	FlagReasonDisabled = "disabled" // the flag is switched off
+	FlagReasonUser     = "user"     // the user is targeted by ID
+	FlagReasonRole     = "role"     // the user's role is targeted
+	FlagReasonRollout  = "rollout"  // the user is inside the percentage
+	FlagReasonDefault  = "default"  // the user is outside the percentage
+)
+
+// FlagSubject is who a flag is evaluated for
+type FlagSubject struct {
+	UserID string
+	Role   string
+}
+
+// FlagSubjectFromContext takes the subject from the JWT claims of the
+// request; anonymous requests only see flags rolled out to everyone
+func FlagSubjectFromContext(ctx context.Context) FlagSubject {
+	var subject FlagSubject
+	if userID, ok := UserIDFromContext(ctx); ok {
+		subject.UserID = userID.Hex()
+	}
+	subject.Role, _ = RoleFromContext(ctx)
+	return subject
+}
+
+type FlagResult struct {
+	Key     string `json:"key"`
+	Enabled bool   `json:"enabled"`
+	Variant string `json:"variant,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// FeatureFlags evaluates flags stored in Mongo. Flags are cached in process
+// and reloaded once runtime.flags.cache_ttl has passed, so changes made on
+// another instance show up within that time.
+type FeatureFlags struct {
+	flags   repository.FeatureFlagRepository
+	mu      sync.Mutex
+	cache   atomic.Pointer[flagCache]
+	expired atomic.Bool
+}
+
+type flagCache struct {
+	flags  map[string]model.FeatureFlag
+	loaded time.Time
+}
+
+func NewFeatureFlags(flags repository.FeatureFlagRepository) *FeatureFlags {
+	return &FeatureFlags{flags: flags}
+}
+
+// Enabled reports whether the flag is on for the caller of ctx
+func (f *FeatureFlags) Enabled(ctx context.Context, key string) bool {
+	return f.Evaluate(ctx, key, FlagSubjectFromContext(ctx)).Enabled
+}
+
+// Variant returns the variant of the flag chosen for the caller of ctx
+func (f *FeatureFlags) Variant(ctx context.Context, key string) string {
+	return f.Evaluate(ctx, key, FlagSubjectFromContext(ctx)).Variant
+}
+
+func (f *FeatureFlags) Evaluate(ctx context.Context, key string, subject FlagSubject) FlagResult {
+	flag, ok := f.load(ctx)[key]
+	if !ok {
+		return FlagResult{Key: key, Enabled: Settings().Features[key], Reason: FlagReasonUnknown}
+	}
+	return EvaluateFlag(flag, subject)
+}
+
+// EvaluateAll evaluates every stored flag for subject
+func (f *FeatureFlags) EvaluateAll(ctx context.Context, subject FlagSubject) map[string]FlagResult {
+	results := map[string]FlagResult{}
+	for key, flag := range f.load(ctx) {
+		results[key] = EvaluateFlag(flag, subject)
+	}
+	return results
+}
+
+// Invalidate makes the next evaluation reload the flags, so that changes
+// made through this instance apply immediately
+func (f *FeatureFlags) Invalidate() {
+	f.expired.Store(true)
+}
+
+func (f *FeatureFlags) load(ctx context.Context) map[string]model.FeatureFlag {
+	cache := f.cache.Load()
+	if cache != nil && !f.expired.Load() && time.Since(cache.loaded) < Settings().Flags.CacheTTL {
+		return cache.flags
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Another caller may have reloaded while this one waited
+	if fresh := f.cache.Load(); fresh != cache && !f.expired.Load() {
+		return fresh.flags
+	}
+
+	f.expired.Store(false)
+	list, err := f.flags.List(ctx)
+	if err != nil {
+		LoggerFromContext(ctx).Error("Error loading feature flags", "error", err)
+		if cache != nil {
+			// Keep serving the last known flags and retry after the TTL
+			f.cache.Store(&flagCache{flags: cache.flags, loaded: time.Now()})
+			return cache.flags
+		}
+		return nil
+	}
+
+	flags := make(map[string]model.FeatureFlag, len(list))
+	for _, flag := range list {
+		flags[flag.Key] = flag
+	}
+	f.cache.Store(&flagCache{flags: flags, loaded: time.Now()})
+	return flags
+}
+
+// EvaluateFlag decides flag for subject. Rollout buckets are derived from
+// the flag key and user ID, so a user keeps the same answer as the
+// percentage grows, and different flags roll out to different users.
+func EvaluateFlag(flag model.FeatureFlag, subject FlagSubject) FlagResult {
+	result := FlagResult{Key: flag.Key}
+	switch {
+	case !flag.Enabled:
+		result.Reason = FlagReasonDisabled
+	case subject.UserID != "" && contains(flag.UserIDs, subject.UserID):
+		result.Enabled, result.Reason = true, FlagReasonUser
+	case subject.Role != "" && contains(flag.Roles, subject.Role):
+		result.Enabled, result.Reason = true, FlagReasonRole
+	case flag.Percentage >= 100:
+		result.Enabled, result.Reason = true, FlagReasonRollout
+	case subject.UserID != "" && int(flagBucket(flag.Key, subject.UserID)%100) < flag.Percentage:
+		result.Enabled, result.Reason = true, FlagReasonRollout
+	default:
+		result.Reason = FlagReasonDefault
+	}
+
+	if flag.Type == model.FlagTypeVariant {
+		result.Variant = flag.OffVariant
+		if result.Enabled {
+			result.Variant = pickVariant(flag, subject.UserID)
+		}
+	}
+	return result
+}
+
+func pickVariant(flag model.FeatureFlag, userID string) string {
+	total := 0
+	for _, variant := range flag.Variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return flag.OffVariant
+	}
+
+	bucket := int(flagBucket(flag.Key+"/variant", userID) % uint32(total))
+	for _, variant := range flag.Variants {
+		if bucket < variant.Weight {
+			return variant.Name
+		}
+		bucket -= variant.Weight
+	}
+	return flag.Variants[len(flag.Variants)-1].Name
+}
+
+func flagBucket(key, userID string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key + "/" + userID))
+	return h.Sum32()
+}
+
+func contains(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
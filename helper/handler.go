@@ -8,7 +8,7 @@ func GenericGetHandler(getDataFunc func() (interface{}, error)) http.HandlerFunc
 	return func(w http.ResponseWriter, r *http.Request) {
 		data, err := getDataFunc()
 		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, err.Error())
+			WriteError(w, r, Internal("Error loading data", err))
 			return
 		}
 		RespondWithJSON(w, http.StatusOK, data)
@@ -0,0 +1,118 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// CodeTimeout is returned when a request runs past its route timeout
+const CodeTimeout = "timeout"
+
+// Hardening wraps next with, from the outside in, panic recovery, the
+// security headers and the request body limit from config
+func Hardening(next http.Handler) http.Handler {
+	return Recover(SecurityHeaders(LimitBody(next)))
+}
+
+// Recover turns a panic in next into a 500 problem response and logs it
+// with the stack, so one bad request cannot take the process down
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort of the response, let net/http handle it
+				panic(v)
+			}
+
+			LoggerFromContext(r.Context()).Error("Panic serving request",
+				"method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			if rec.wroteHeader {
+				// Too late for an error response, cut the connection instead
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(rec, Problem{
+				Type:     "about:blank",
+				Title:    http.StatusText(http.StatusInternalServerError),
+				Status:   http.StatusInternalServerError,
+				Detail:   "Internal server error",
+				Instance: r.URL.Path,
+				Code:     CodeInternal,
+			})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// LimitBody caps request bodies at http.max_body_bytes; reading past it
+// fails with *http.MaxBytesError, which ParseJSONBody reports as 413
+func LimitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := GetConfig().HTTP.MaxBodyBytes
+		if r.ContentLength > limit {
+			WriteError(w, r, NewError(http.StatusRequestEntityTooLarge, "body_too_large",
+				fmt.Sprintf("Request body must not be larger than %d bytes", limit)))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SecurityHeaders sets the headers every API response should carry. HSTS
+// is sent when http.hsts_max_age is positive; browsers ignore it over
+// plain HTTP, so it only takes effect behind TLS.
+func SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		if maxAge := GetConfig().HTTP.HSTSMaxAge; maxAge > 0 {
+			h.Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(maxAge.Seconds()))+"; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RouteTimeouts bounds the context of every request by the timeout of its
+// route template in http.route_timeouts, or http.request_timeout. Handlers
+// that run past it fail with CodeTimeout.
+func RouteTimeouts() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := GetConfig()
+			timeout := cfg.HTTP.RequestTimeout
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					if override, ok := cfg.HTTP.RouteTimeouts[template]; ok {
+						timeout = override
+					}
+				}
+			}
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func requestTimedOut(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.DeadlineExceeded)
+}
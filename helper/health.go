@@ -0,0 +1,105 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const readinessTimeout = 3 * time.Second
+
+// Results of a readiness check. Errors are logged, not returned, since
+// the probes are unauthenticated.
+const (
+	checkOK       = "ok"
+	checkFailed   = "failed"
+	checkDraining = "draining"
+)
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Health answers the liveness and readiness probes of every server in the
+// process. Readiness runs the registered checks and fails as soon as the
+// process starts shutting down, so traffic moves elsewhere while in-flight
+// requests drain.
+type Health struct {
+	checks   []healthCheck
+	draining atomic.Bool
+}
+
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// AddCheck registers a readiness check. Checks must be added before the
+// servers start.
+func (h *Health) AddCheck(name string, check func(ctx context.Context) error) {
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+// SetDraining makes readiness fail from now on
+func (h *Health) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Register adds GET /healthz and GET /readyz to r
+func (h *Health) Register(r *mux.Router) {
+	r.HandleFunc("/healthz", h.Live).Methods("GET")
+	r.HandleFunc("/readyz", h.Ready).Methods("GET")
+}
+
+// Live reports that the process is up and serving requests
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	RespondWithJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// Ready runs every check and reports 503 if any of them fails
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	response := HealthResponse{Status: "ok", Checks: map[string]string{}}
+	if h.draining.Load() {
+		response.Status = "unavailable"
+		response.Checks["lifecycle"] = checkDraining
+	}
+
+	results := make([]error, len(h.checks))
+	done := make(chan int, len(h.checks))
+	for i, c := range h.checks {
+		go func(i int, c healthCheck) {
+			results[i] = c.check(ctx)
+			done <- i
+		}(i, c)
+	}
+	for range h.checks {
+		<-done
+	}
+
+	for i, c := range h.checks {
+		response.Checks[c.name] = checkOK
+		if err := results[i]; err != nil {
+			response.Status = "unavailable"
+			response.Checks[c.name] = checkFailed
+			LoggerFromContext(r.Context()).Warn("Readiness check failed", "check", c.name, "error", err)
+		}
+	}
+
+	status := http.StatusOK
+	if response.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	RespondWithJSON(w, status, response)
+}
@@ -0,0 +1,227 @@
+package helper
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+)
+
+// Idempotency headers
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	maxIdempotencyKeyLength = 255
+	// idempotencyRetryAfter is suggested to clients whose first request
+	// is still running
+	idempotencyRetryAfter = time.Second
+	// idempotencyCompleteAttempts bounds the tries to store a response
+	idempotencyCompleteAttempts = 3
+	idempotencyCompleteBackoff  = 50 * time.Millisecond
+)
+
+// Idempotency error codes
+const (
+	CodeIdempotencyKeyInvalid = "idempotency_key_invalid"
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeIdempotencyInProgress = "idempotency_in_progress"
+)
+
+// Idempotency makes retried requests safe. A request carrying an
+// Idempotency-Key runs once; repeating it with the same payload replays the
+// stored response for runtime.idempotency.ttl, while reusing the key for a
+// different payload is rejected.
+type Idempotency struct {
+	store repository.IdempotencyRepository
+}
+
+func NewIdempotency(store repository.IdempotencyRepository) *Idempotency {
+	return &Idempotency{store: store}
+}
+
+// Middleware applies idempotency to requests with an Idempotency-Key header;
+// others pass through. Keys are scoped to the caller, so it must be chained
+// after JWTMiddleware. Responses with a 5xx status are not stored, so the
+// request can be retried with the same key.
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			WriteError(w, r, BadRequest(fmt.Sprintf("%s must be 1 to %d printable ASCII characters",
+				IdempotencyKeyHeader, maxIdempotencyKeyLength)).WithCode(CodeIdempotencyKeyInvalid))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteError(w, r, decodeError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		record := model.IdempotencyRecord{
+			Key:         clientSubject(r) + ":" + key,
+			Fingerprint: requestFingerprint(r, body),
+			Created:     now,
+			// A pending record outlives the request by at most its timeout,
+			// so a crashed instance does not block the key for long
+			Expires: now.Add(Settings().Idempotency.TTL),
+		}
+		if deadline, ok := r.Context().Deadline(); ok {
+			record.Expires = deadline
+		}
+
+		err = i.store.Create(r.Context(), record)
+		if errors.Is(err, repository.ErrDuplicate) {
+			i.replay(w, r, record)
+			return
+		}
+		if err != nil {
+			WriteError(w, r, Internal("Error storing idempotency key", err))
+			return
+		}
+
+		// The record is finished even if the request context is done by now
+		ctx := context.WithoutCancel(r.Context())
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			if !completed {
+				if err := i.store.Delete(ctx, record.Key); err != nil {
+					LoggerFromContext(ctx).Warn("Error releasing idempotency key", "error", err)
+				}
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+		record.Completed = true
+		record.Status = rec.status
+		record.ContentType = rec.Header().Get("Content-Type")
+		record.Body = rec.body.Bytes()
+		record.Expires = time.Now().Add(Settings().Idempotency.TTL)
+		// The request has run, so its key is never released from here on. If
+		// the response cannot be stored the record stays pending, and
+		// retries are told the request is in progress until it expires.
+		completed = true
+		if err := i.complete(ctx, record); err != nil {
+			LoggerFromContext(ctx).Warn("Error storing idempotent response", "error", err)
+		}
+	})
+}
+
+// complete stores the response of record, retrying transient failures
+func (i *Idempotency) complete(ctx context.Context, record model.IdempotencyRecord) error {
+	var err error
+	for attempt := 1; attempt <= idempotencyCompleteAttempts; attempt++ {
+		if err = i.store.Complete(ctx, record); err == nil {
+			return nil
+		}
+		if attempt < idempotencyCompleteAttempts {
+			time.Sleep(time.Duration(attempt) * idempotencyCompleteBackoff)
+		}
+	}
+	return err
+}
+
+// replay answers a request whose key is already taken
+func (i *Idempotency) replay(w http.ResponseWriter, r *http.Request, request model.IdempotencyRecord) {
+	stored, err := i.store.Find(r.Context(), request.Key)
+	if errors.Is(err, repository.ErrNotFound) {
+		// The first request failed and released the key in the meantime;
+		// answer as if it were still running so the client retries
+		stored = &model.IdempotencyRecord{Fingerprint: request.Fingerprint}
+	} else if err != nil {
+		WriteError(w, r, Internal("Error loading idempotency key", err))
+		return
+	}
+
+	switch {
+	case stored.Fingerprint != request.Fingerprint:
+		WriteError(w, r, NewError(http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+			IdempotencyKeyHeader+" was already used for a different request"))
+	case !stored.Completed:
+		w.Header().Set("Retry-After", strconv.Itoa(int(idempotencyRetryAfter.Seconds())))
+		WriteError(w, r, Conflict("A request with this "+IdempotencyKeyHeader+" is still in progress").
+			WithCode(CodeIdempotencyInProgress))
+	default:
+		if stored.ContentType != "" {
+			w.Header().Set("Content-Type", stored.ContentType)
+		}
+		w.Header().Set(IdempotentReplayedHeader, "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+	}
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestFingerprint hashes what makes two requests the same. JSON bodies
+// are compacted first, so formatting differences do not count.
+func requestFingerprint(r *http.Request, body []byte) string {
+	var compact bytes.Buffer
+	if json.Compact(&compact, body) == nil {
+		body = compact.Bytes()
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes the response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
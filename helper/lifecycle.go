@@ -0,0 +1,202 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// NewServer builds an http.Server for port with the timeouts from config
+func NewServer(port int, handler http.Handler) *http.Server {
+	return newServer(fmt.Sprintf(":%d", port), handler)
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	cfg := GetConfig()
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+	}
+}
+
+type lifecycleServer struct {
+	name string
+	srv  *http.Server
+}
+
+type lifecycleWorker struct {
+	name    string
+	run     func(ctx context.Context)
+	running atomic.Bool
+}
+
+type lifecycleHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Lifecycle runs the HTTP servers and background workers of the process and
+// shuts them down in order: the drain hooks run (e.g. failing readiness) and
+// the servers keep serving for the drain delay, then servers drain in-flight
+// requests, workers stop, and the shutdown hooks (e.g. closing Mongo) run in
+// reverse order.
+type Lifecycle struct {
+	shutdownTimeout time.Duration
+	drainDelay      time.Duration
+	servers         []lifecycleServer
+	workers         []*lifecycleWorker
+	drainHooks      []func()
+	hooks           []lifecycleHook
+}
+
+func NewLifecycle(shutdownTimeout, drainDelay time.Duration) *Lifecycle {
+	return &Lifecycle{shutdownTimeout: shutdownTimeout, drainDelay: drainDelay}
+}
+
+func (l *Lifecycle) AddServer(name string, srv *http.Server) {
+	l.servers = append(l.servers, lifecycleServer{name: name, srv: srv})
+}
+
+// AddWorker registers a background worker. run must return once ctx is done.
+func (l *Lifecycle) AddWorker(name string, run func(ctx context.Context)) {
+	l.workers = append(l.workers, &lifecycleWorker{name: name, run: run})
+}
+
+// OnDrain registers fn to run as soon as shutdown starts, before the
+// servers stop accepting requests
+func (l *Lifecycle) OnDrain(fn func()) {
+	l.drainHooks = append(l.drainHooks, fn)
+}
+
+// CheckWorkers reports the background workers that are not running, as a
+// readiness check
+func (l *Lifecycle) CheckWorkers(ctx context.Context) error {
+	var stopped []string
+	for _, wk := range l.workers {
+		if !wk.running.Load() {
+			stopped = append(stopped, wk.name)
+		}
+	}
+	if len(stopped) > 0 {
+		return fmt.Errorf("workers not running: %s", strings.Join(stopped, ", "))
+	}
+	return nil
+}
+
+// OnShutdown registers fn to run after servers and workers have stopped
+func (l *Lifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	l.hooks = append(l.hooks, lifecycleHook{name: name, fn: fn})
+}
+
+// Run starts everything and blocks until SIGINT/SIGTERM is received or a
+// server fails, then shuts down. It returns the server failure, if any, or
+// the first shutdown error.
+func (l *Lifecycle) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, len(l.servers))
+	for _, s := range l.servers {
+		go func(s lifecycleServer) {
+			slog.Info("Starting service", "service", s.name, "addr", s.srv.Addr)
+			if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- errors.New(s.name + " server: " + err.Error())
+			}
+		}(s)
+	}
+
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	for _, wk := range l.workers {
+		workers.Add(1)
+		wk.running.Store(true)
+		go func(wk *lifecycleWorker) {
+			defer workers.Done()
+			defer wk.running.Store(false)
+			wk.run(workerCtx)
+		}(wk)
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutdown signal received, draining requests")
+	case runErr = <-serverErr:
+		slog.Error("Shutting down after failure", "error", runErr)
+	}
+	stop()
+
+	for _, fn := range l.drainHooks {
+		fn()
+	}
+	if runErr == nil && l.drainDelay > 0 {
+		// Give load balancers time to notice the failing readiness probe
+		time.Sleep(l.drainDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), l.shutdownTimeout)
+	defer cancel()
+
+	var (
+		errMu       sync.Mutex
+		shutdownErr error
+	)
+	record := func(name string, err error) {
+		slog.Error("Error stopping component", "component", name, "error", err)
+		errMu.Lock()
+		if shutdownErr == nil {
+			shutdownErr = err
+		}
+		errMu.Unlock()
+	}
+
+	var servers sync.WaitGroup
+	for _, s := range l.servers {
+		servers.Add(1)
+		go func(s lifecycleServer) {
+			defer servers.Done()
+			if err := s.srv.Shutdown(shutdownCtx); err != nil {
+				record(s.name+" server", err)
+				s.srv.Close()
+			}
+		}(s)
+	}
+	servers.Wait()
+
+	cancelWorkers()
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-shutdownCtx.Done():
+		record("workers", shutdownCtx.Err())
+	}
+
+	for i := len(l.hooks) - 1; i >= 0; i-- {
+		if err := l.hooks[i].fn(shutdownCtx); err != nil {
+			record(l.hooks[i].name, err)
+		}
+	}
+
+	slog.Info("Shutdown complete")
+	if runErr != nil {
+		return runErr
+	}
+	return shutdownErr
+}
@@ -0,0 +1,182 @@
+package helper
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	loggerContextKey      contextKey = "logger"
+	requestInfoContextKey contextKey = "requestInfo"
+
+	maxRequestIDLen = 128
+	redacted        = "[REDACTED]"
+)
+
+// logLevel follows runtime.log_level, so the level can change without a
+// restart
+var logLevel = new(slog.LevelVar)
+
+// NewLogger builds the process logger in the configured format. Attributes
+// that look like credentials are redacted before they are written.
+func NewLogger(cfg *Config, w io.Writer) *slog.Logger {
+	setLogLevel(Settings().LogLevel)
+	opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: redactAttr}
+	if cfg.Log.Format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// SetupLogging installs the logger from cfg as the default for slog and the
+// log package
+func SetupLogging(cfg *Config) {
+	slog.SetDefault(NewLogger(cfg, os.Stdout))
+}
+
+func setLogLevel(level string) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err == nil {
+		logLevel.Set(l)
+	}
+}
+
+// sensitiveKeys are attribute key fragments whose values are never logged
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "cookie", "apikey", "verifier", "recovery"}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(a.Key))
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if a.Value.Kind() == slog.KindString {
+		if value := a.Value.String(); strings.HasPrefix(strings.ToLower(value), "bearer ") {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+// LoggerFromContext returns the request logger stored by RequestLogging,
+// or the default logger
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// RequestIDFromContext returns the ID of the request being served
+func RequestIDFromContext(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoContextKey).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// requestInfo is shared between RequestLogging and the handlers below it,
+// so the access log can name the user authenticated further down
+type requestInfo struct {
+	id      string
+	subject atomic.Value
+}
+
+func setRequestSubject(ctx context.Context, subject string) {
+	if info, ok := ctx.Value(requestInfoContextKey).(*requestInfo); ok {
+		info.subject.Store(subject)
+	}
+}
+
+// RequestLogging assigns every request an ID, taken from X-Request-ID when
+// the client sent a usable one, echoes it in the response, stores a logger
+// carrying it in the context, and writes an access log line once the
+// request is done.
+func RequestLogging(service string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			info := &requestInfo{id: requestID(r.Header.Get(RequestIDHeader))}
+			w.Header().Set(RequestIDHeader, info.id)
+
+			logger := slog.Default().With("service", service, "request_id", info.id)
+			ctx := context.WithValue(ContextWithLogger(r.Context(), logger), requestInfoContextKey, info)
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			attrs := []any{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.status,
+				"bytes", rec.bytes,
+				"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+				"remote_addr", r.RemoteAddr,
+				"user_agent", r.UserAgent(),
+			}
+			if subject, ok := info.subject.Load().(string); ok {
+				attrs = append(attrs, "subject", subject)
+			}
+
+			level := slog.LevelInfo
+			if rec.status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+			logger.Log(ctx, level, "request", attrs...)
+		})
+	}
+}
+
+// requestID keeps a client supplied ID if it is short and made of safe
+// characters, so it cannot forge log lines or headers
+func requestID(id string) string {
+	if id == "" || len(id) > maxRequestIDLen {
+		return GenerateID()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return GenerateID()
+		}
+	}
+	return id
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,123 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// unmatchedRoute labels requests no route matched, so unknown paths cannot
+// grow the number of series
+const unmatchedRoute = "unmatched"
+
+var (
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "MongoDB command latency by command name.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command"})
+	mongoErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_command_errors_total",
+		Help: "Failed MongoDB commands by command name.",
+	}, []string{"command"})
+)
+
+// processRegistry holds the metrics every service shares: the Go runtime,
+// the MongoDB client and rate limits
+var processRegistry = prometheus.NewRegistry()
+
+func init() {
+	processRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		mongoDuration,
+		mongoErrors,
+		rateLimited,
+	)
+}
+
+// Metrics is the registry of one service, holding its HTTP metrics and the
+// collectors it owns
+type Metrics struct {
+	service  string
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewMetrics creates the registry of service and registers collectors in it
+func NewMetrics(service string, collectors ...prometheus.Collector) *Metrics {
+	m := &Metrics{
+		service:  service,
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by service, route template, method and status.",
+		}, []string{"service", "route", "method", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by service, route template and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "route", "method"}),
+	}
+	m.registry.MustRegister(m.requests, m.duration)
+	m.registry.MustRegister(collectors...)
+	return m
+}
+
+// Handler serves the shared metrics and those of the service in the
+// Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(prometheus.Gatherers{processRegistry, m.registry}, promhttp.HandlerOpts{})
+}
+
+// Register adds GET /metrics to r. Only admins and API keys with the
+// metrics:read scope may scrape it.
+func (m *Metrics) Register(r *mux.Router, auth *Auth) {
+	r.Handle("/metrics", auth.JWTMiddleware(RequireScope(model.ScopeMetricsRead, model.RoleAdmin)(m.Handler()))).Methods("GET")
+}
+
+// Routes counts requests and observes their latency per route template of
+// router, e.g. /admin/users/{id}, rather than per path
+func (m *Metrics) Routes(router *mux.Router) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			route := unmatchedRoute
+			var match mux.RouteMatch
+			if router.Match(r, &match) && match.MatchErr == nil && match.Route != nil {
+				if template, err := match.Route.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			m.requests.WithLabelValues(m.service, route, r.Method, strconv.Itoa(rec.status)).Inc()
+			m.duration.WithLabelValues(m.service, route, r.Method).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// commandMonitor records the latency of every MongoDB command and counts
+// the failed ones
+func commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			mongoErrors.WithLabelValues(e.CommandName).Inc()
+		},
+	}
+}
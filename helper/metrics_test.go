@@ -0,0 +1,53 @@
+package helper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	SetConfig(defaultConfig())
+	orders := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_orders_total", Help: "Orders."})
+	shop, admin := NewMetrics("shop", orders), NewMetrics("admin")
+
+	for _, m := range []*Metrics{shop, admin} {
+		router := mux.NewRouter()
+		router.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+		m.Routes(router)(router).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/1", nil))
+	}
+	orders.Add(3)
+	rateLimited.WithLabelValues("test").Inc()
+
+	scrape := func(handler http.Handler) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/metrics returned %d: %s", rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	// A service serves the shared metrics and its own only
+	own := scrape(admin.Handler())
+	for _, series := range []string{
+		`http_requests_total{method="GET",route="/items/{id}",service="admin",status="200"} 1`,
+		`http_rate_limited_total{policy="test"}`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(own, series) {
+			t.Errorf("admin metrics do not include %s", series)
+		}
+	}
+	if strings.Contains(own, `service="shop"`) || strings.Contains(own, "test_orders_total") {
+		t.Errorf("admin metrics include those of shop:\n%s", own)
+	}
+	if shop := scrape(shop.Handler()); !strings.Contains(shop, "test_orders_total 3") {
+		t.Errorf("shop metrics do not include its collectors:\n%s", shop)
+	}
+}
@@ -1,52 +1,143 @@
 package helper
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"strings"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func JWTMiddleware(next http.Handler) http.Handler {
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// Auth authenticates requests with JWTs or API keys, checking them against
+// the stored users and keys
+type Auth struct {
+	users   repository.UserRepository
+	apiKeys repository.APIKeyRepository
+}
+
+func NewAuth(users repository.UserRepository, apiKeys repository.APIKeyRepository) *Auth {
+	return &Auth{users: users, apiKeys: apiKeys}
+}
+
+func (a *Auth) JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/login") || strings.HasPrefix(r.URL.Path, "/register") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			a.authenticateAPIKey(w, r, next, apiKey)
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(GetConfig().Server.JwtSecret), nil
-		})
-
-		if err != nil || !token.Valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		next.ServeHTTP(w, r)
+		a.authenticateRequest(w, r, next, false)
 	})
 }
-func CORSMiddleware(next http.Handler) http.Handler {
+
+// MFAEnrollmentMiddleware works like JWTMiddleware but also accepts the
+// short-lived "mfa pending" token issued by the login flow, so users that
+// must enroll in two-factor authentication can do so before getting a JWT.
+func (a *Auth) MFAEnrollmentMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		a.authenticateRequest(w, r, next, true)
+	})
+}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+func (a *Auth) authenticateRequest(w http.ResponseWriter, r *http.Request, next http.Handler, allowMFAPending bool) {
+	tokenString, err := BearerToken(r)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	claims, err := ParseToken(tokenString)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	if claims.MFAPending && !allowMFAPending {
+		WriteError(w, r, ErrMFAPending)
+		return
+	}
+
+	// Reject tokens of disabled accounts or tokens revoked by an admin
+	user, err := a.loadTokenUser(r.Context(), claims)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	if user.Disabled {
+		WriteError(w, r, ErrAccountDisabled)
+		return
+	}
+
+	// Always trust the stored role so role changes apply immediately
+	claims.Role = user.Role
+
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	ctx = ContextWithLogger(ctx, LoggerFromContext(ctx).With("user_id", claims.UserID))
+	setRequestSubject(ctx, "user:"+claims.UserID)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (a *Auth) loadTokenUser(ctx context.Context, claims *Claims) (*model.User, error) {
+	userID, err := primitive.ObjectIDFromHex(claims.UserID)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := a.users.FindByID(ctx, userID)
+	if err != nil {
+		return nil, ErrTokenRevoked
+	}
+
+	if TokenRevoked(claims, user) {
+		return nil, ErrTokenRevoked
+	}
+
+	return user, nil
+}
+
+// TokenRevoked reports whether the user's tokens were revoked after claims
+// were issued. Versions, unlike the whole seconds of iat, also catch tokens
+// issued in the same second as the revocation.
+func TokenRevoked(claims *Claims, user *model.User) bool {
+	return claims.TokenVersion != user.TokenVersion
+}
+
+// RequireRole only lets requests through whose JWT role is one of roles.
+// API keys carry no role and are rejected; see RequireScope.
+// It must be chained after Auth.JWTMiddleware.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, isAPIKey := APIKeyFromContext(r.Context()); isAPIKey {
+				WriteError(w, r, ErrInsufficientScope)
+				return
+			}
+
+			role, ok := RoleFromContext(r.Context())
+			if !ok {
+				WriteError(w, r, ErrTokenMissing)
+				return
+			}
+
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			WriteError(w, r, ErrInsufficientScope)
+		})
+	}
 }
@@ -0,0 +1,266 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CodeRateLimited is returned when a client has used up its rate limit
+const CodeRateLimited = "rate_limited"
+
+// Rate limit response headers, following the IETF RateLimit header fields
+// draft
+const (
+	RateLimitLimitHeader     = "RateLimit-Limit"
+	RateLimitRemainingHeader = "RateLimit-Remaining"
+	RateLimitResetHeader     = "RateLimit-Reset"
+	RateLimitPolicyHeader    = "RateLimit-Policy"
+)
+
+// rateLimitAttempts bounds the compare-and-swap retries on a contended
+// bucket; requests that lose every round are rejected
+const rateLimitAttempts = 5
+
+var rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_rate_limited_total",
+	Help: "Requests rejected by a rate limit policy.",
+}, []string{"policy"})
+
+// RateLimitPolicy is a token bucket: each client may send Burst requests at
+// once, refilled at Requests per Per
+type RateLimitPolicy struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+}
+
+func (p RateLimitPolicy) validate(path string) []error {
+	var errs []error
+	if p.Requests <= 0 {
+		errs = append(errs, fmt.Errorf("%s.requests: must be positive", path))
+	}
+	if p.Per <= 0 {
+		errs = append(errs, fmt.Errorf("%s.per: must be positive", path))
+	}
+	if p.Burst <= 0 {
+		errs = append(errs, fmt.Errorf("%s.burst: must be positive", path))
+	}
+	return errs
+}
+
+// rate is the refill rate in tokens per second
+func (p RateLimitPolicy) rate() float64 {
+	return float64(p.Requests) / p.Per.Seconds()
+}
+
+// window is how long an empty bucket takes to fill up
+func (p RateLimitPolicy) window() time.Duration {
+	return time.Duration(float64(p.Burst) / p.rate() * float64(time.Second))
+}
+
+type rateLimitDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// RateLimiter enforces the policies in runtime.rate_limits. Buckets live in
+// the store, so with the Mongo store the limits hold across instances.
+type RateLimiter struct {
+	store repository.RateLimitRepository
+	now   func() time.Time
+}
+
+func NewRateLimiter(store repository.RateLimitRepository) *RateLimiter {
+	return &RateLimiter{store: store, now: time.Now}
+}
+
+// Limit applies the named policy to every request, keyed by the
+// authenticated user, the API key or the client IP. Policies are read on
+// every request, so reloads apply immediately; an unknown policy does not
+// limit. Chain it after JWTMiddleware to key requests by user.
+func (l *RateLimiter) Limit(policy string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := Settings().RateLimits[policy]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			decision, err := l.take(r.Context(), policy+":"+clientSubject(r), p)
+			if err != nil {
+				// An unavailable store must not take the API down with it
+				LoggerFromContext(r.Context()).Warn("Rate limit check failed", "policy", policy, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set(RateLimitLimitHeader, strconv.Itoa(p.Burst))
+			h.Set(RateLimitRemainingHeader, strconv.Itoa(decision.remaining))
+			h.Set(RateLimitResetHeader, ceilSeconds(decision.reset))
+			h.Set(RateLimitPolicyHeader, fmt.Sprintf("%d;w=%s", p.Burst, ceilSeconds(p.window())))
+			if !decision.allowed {
+				rateLimited.WithLabelValues(policy).Inc()
+				h.Set("Retry-After", ceilSeconds(decision.retryAfter))
+				WriteError(w, r, NewError(http.StatusTooManyRequests, CodeRateLimited,
+					"Too many requests, retry in "+ceilSeconds(decision.retryAfter)+" seconds"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// take spends a token of the bucket at key if one is left
+func (l *RateLimiter) take(ctx context.Context, key string, p RateLimitPolicy) (rateLimitDecision, error) {
+	rate := p.rate()
+	for attempt := 0; attempt < rateLimitAttempts; attempt++ {
+		// Mongo stores milliseconds, and the compare-and-swap matches on
+		// the stored update time
+		now := l.now().Truncate(time.Millisecond)
+		tokens := float64(p.Burst)
+		var previous time.Time
+
+		bucket, err := l.store.Find(ctx, key)
+		switch {
+		case err == nil:
+			previous = bucket.Updated
+			// Update times can run a millisecond ahead, see below
+			elapsed := math.Max(0, now.Sub(previous).Seconds())
+			tokens = math.Min(tokens, bucket.Tokens+elapsed*rate)
+			if !now.After(previous) {
+				// Keep update times unique so a stale read never matches
+				now = previous.Add(time.Millisecond)
+			}
+		case !errors.Is(err, repository.ErrNotFound):
+			return rateLimitDecision{}, err
+		}
+
+		if tokens < 1 {
+			return rateLimitDecision{
+				reset:      secondsDuration((float64(p.Burst) - tokens) / rate),
+				retryAfter: secondsDuration((1 - tokens) / rate),
+			}, nil
+		}
+
+		tokens--
+		reset := secondsDuration((float64(p.Burst) - tokens) / rate)
+		saved, err := l.store.Save(ctx, model.RateLimitBucket{Key: key, Tokens: tokens, Updated: now, Expires: now.Add(reset)}, previous)
+		if err != nil {
+			return rateLimitDecision{}, err
+		}
+		if saved {
+			return rateLimitDecision{allowed: true, remaining: int(tokens), reset: reset}, nil
+		}
+	}
+	return rateLimitDecision{retryAfter: time.Second, reset: time.Second}, nil
+}
+
+// clientSubject identifies who sent r: the authenticated user, the API key
+// or, for anonymous requests, the client IP
+func clientSubject(r *http.Request) string {
+	if claims, ok := ClaimsFromContext(r.Context()); ok {
+		return "user:" + claims.UserID
+	}
+	if key, ok := APIKeyFromContext(r.Context()); ok {
+		return "apikey:" + key.Prefix
+	}
+	return "ip:" + ClientIP(r)
+}
+
+// ClientIP returns the address of the client that sent r. X-Forwarded-For is
+// only believed as far as it was added by http.trusted_proxies: it is read
+// from the right, skipping trusted hops, so clients cannot spoof it.
+func ClientIP(r *http.Request) string {
+	ip := remoteIP(r.RemoteAddr)
+	trusted := trustedProxies()
+	if len(trusted) == 0 || !containsIP(trusted, ip) {
+		return ip.String()
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Garbage from the client; the last trusted hop is all we know
+			break
+		}
+		ip = hop
+		if !containsIP(trusted, hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func remoteIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	return net.IPv4zero
+}
+
+func trustedProxies() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, proxy := range GetConfig().HTTP.TrustedProxies {
+		if ipNet, err := parseProxy(proxy); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+// parseProxy parses a CIDR or a single address
+func parseProxy(proxy string) (*net.IPNet, error) {
+	if !strings.Contains(proxy, "/") {
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", proxy)
+		}
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR", proxy)
+	}
+	return ipNet, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,226 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RuntimeSettings are the operational knobs that can change without a
+// restart. They live in the runtime section of the config and are swapped
+// as a whole, so readers never see a half-applied change.
+type RuntimeSettings struct {
+	// ReloadInterval is how often the config is re-read. It is only read at
+	// startup; 0 disables reloading.
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	CORS           CORSSettings  `yaml:"cors"`
+	Auth           struct {
+		TokenTTL time.Duration `yaml:"token_ttl"`
+	} `yaml:"auth"`
+	Checkout struct {
+		// Expiry releases checked out but unconfirmed items back into stock
+		// after this long; 0 keeps them forever
+		Expiry time.Duration `yaml:"expiry"`
+	} `yaml:"checkout"`
+	Idempotency struct {
+		// TTL is how long responses are replayed for a repeated
+		// Idempotency-Key
+		TTL time.Duration `yaml:"ttl"`
+	} `yaml:"idempotency"`
+	Flags struct {
+		// CacheTTL bounds how long flag changes made on another instance
+		// take to show up
+		CacheTTL time.Duration `yaml:"cache_ttl"`
+	} `yaml:"flags"`
+	// Features are the defaults of feature flags that are not stored in
+	// the feature_flags collection
+	Features map[string]bool `yaml:"features"`
+	// LogLevel is debug, info, warn or error
+	LogLevel string `yaml:"log_level"`
+	// RateLimits are the policies routes refer to by name, see RateLimiter.
+	// They come from the config file only; removing a policy lifts its
+	// limit.
+	RateLimits map[string]RateLimitPolicy `yaml:"rate_limits"`
+}
+
+func defaultRuntimeSettings() RuntimeSettings {
+	var s RuntimeSettings
+	s.ReloadInterval = 30 * time.Second
+	s.CORS = defaultCORSSettings()
+	s.Auth.TokenTTL = 72 * time.Hour
+	s.Idempotency.TTL = 24 * time.Hour
+	s.Flags.CacheTTL = 30 * time.Second
+	s.LogLevel = "info"
+	return s
+}
+
+func (s *RuntimeSettings) Validate() error {
+	var errs []error
+	if s.ReloadInterval < 0 {
+		errs = append(errs, errors.New("runtime.reload_interval: must not be negative"))
+	}
+	errs = append(errs, s.CORS.validate()...)
+	if s.Auth.TokenTTL <= 0 {
+		errs = append(errs, errors.New("runtime.auth.token_ttl: must be positive"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("runtime.log_level: must be debug, info, warn or error, got %q", s.LogLevel))
+	}
+	if s.Flags.CacheTTL < 0 {
+		errs = append(errs, errors.New("runtime.flags.cache_ttl: must not be negative"))
+	}
+	if s.Checkout.Expiry < 0 {
+		errs = append(errs, errors.New("runtime.checkout.expiry: must not be negative"))
+	}
+	if s.Idempotency.TTL <= 0 {
+		errs = append(errs, errors.New("runtime.idempotency.ttl: must be positive"))
+	}
+	for name, policy := range s.RateLimits {
+		errs = append(errs, policy.validate("runtime.rate_limits."+name)...)
+	}
+	return errors.Join(errs...)
+}
+
+// SettingsSnapshot is an applied version of the runtime settings
+type SettingsSnapshot struct {
+	Settings  RuntimeSettings
+	Version   int64
+	AppliedAt time.Time
+}
+
+var (
+	currentSettings atomic.Pointer[SettingsSnapshot]
+	settingsMu      sync.Mutex
+	lastReloadError atomic.Pointer[string]
+)
+
+// Settings returns the runtime settings in effect. The result is shared and
+// must not be modified.
+func Settings() *RuntimeSettings {
+	return &CurrentSettings().Settings
+}
+
+// CurrentSettings returns the settings in effect along with their version
+func CurrentSettings() *SettingsSnapshot {
+	if snapshot := currentSettings.Load(); snapshot != nil {
+		return snapshot
+	}
+	// Settings are installed by SetConfig; fall back to the lazily
+	// loaded config for callers that never set one
+	currentSettings.CompareAndSwap(nil, &SettingsSnapshot{Settings: GetConfig().Runtime, Version: 1, AppliedAt: time.Now()})
+	return currentSettings.Load()
+}
+
+func storeSettings(settings RuntimeSettings) *SettingsSnapshot {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	var version int64 = 1
+	if previous := currentSettings.Load(); previous != nil {
+		version = previous.Version + 1
+	}
+	snapshot := &SettingsSnapshot{Settings: settings, Version: version, AppliedAt: time.Now()}
+	currentSettings.Store(snapshot)
+	setLogLevel(settings.LogLevel)
+	return snapshot
+}
+
+// ApplySettings validates settings and makes them the settings in effect
+func ApplySettings(settings RuntimeSettings) (*SettingsSnapshot, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	return storeSettings(settings), nil
+}
+
+// ReloadSettings reloads the config with the original flags and applies its
+// runtime section if it changed. Other sections only take effect on restart.
+func ReloadSettings() (*SettingsSnapshot, error) {
+	cfg, err := LoadConfig(GetConfig().args)
+	if err != nil {
+		msg := err.Error()
+		lastReloadError.Store(&msg)
+		return nil, err
+	}
+	lastReloadError.Store(nil)
+
+	current := CurrentSettings()
+	changed := changedSettings(&current.Settings, &cfg.Runtime)
+	if len(changed) == 0 {
+		return current, nil
+	}
+	snapshot, err := ApplySettings(cfg.Runtime)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Runtime settings updated", "version", snapshot.Version, "changed", changed)
+	return snapshot, nil
+}
+
+// LastReloadError returns why the latest reload was rejected, if it was
+func LastReloadError() string {
+	if msg := lastReloadError.Load(); msg != nil {
+		return *msg
+	}
+	return ""
+}
+
+// SettingsValues renders settings as path to value, the same paths used by
+// environment variables and flags
+func SettingsValues(settings *RuntimeSettings) map[string]string {
+	values := map[string]string{}
+	walkConfig(reflect.ValueOf(settings).Elem(), "runtime", "", func(f configField) error {
+		values[f.path] = redactValue(f)
+		return nil
+	})
+	return values
+}
+
+func changedSettings(previous, next *RuntimeSettings) []string {
+	before, after := SettingsValues(previous), SettingsValues(next)
+	var changed []string
+	for path, value := range after {
+		if before[path] != value {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// WatchSettings returns a Lifecycle worker that reloads the runtime settings
+// every runtime.reload_interval. Invalid changes are logged and the previous
+// settings stay in effect.
+func WatchSettings() func(ctx context.Context) {
+	return func(ctx context.Context) {
+		interval := Settings().ReloadInterval
+		if interval <= 0 {
+			// Reloads are off; stay running so readiness sees a live worker
+			<-ctx.Done()
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := ReloadSettings(); err != nil {
+					slog.Error("Rejected runtime settings reload", "error", err)
+				}
+			}
+		}
+	}
+}
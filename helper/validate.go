@@ -0,0 +1,353 @@
+package helper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ValidatorFunc checks field against the rule parameter and returns the
+// message reported to the client, or "" when the value is valid
+type ValidatorFunc func(field reflect.Value, param string) string
+
+var (
+	validatorsMu sync.RWMutex
+	validators   = map[string]ValidatorFunc{
+		"required": validateRequired,
+		"min":      validateMin,
+		"max":      validateMax,
+		"oneof":    validateOneOf,
+		"objectid": validateObjectID,
+	}
+)
+
+// RegisterValidator adds a rule usable in `validate` struct tags
+func RegisterValidator(name string, fn ValidatorFunc) {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	validators[name] = fn
+	// Types that failed CheckRules may pass now
+	checkedTypes.Range(func(key, _ interface{}) bool {
+		checkedTypes.Delete(key)
+		return true
+	})
+}
+
+// ParseJSONBody decodes a single JSON object from the request body into dst,
+// rejecting unknown fields and bodies over http.max_body_bytes, and then
+// validates dst. Failures are returned as *AppError with per-field details.
+func ParseJSONBody(r *http.Request, dst interface{}) error {
+	return ParseJSONBodyLimit(r, dst, GetConfig().HTTP.MaxBodyBytes)
+}
+
+func ParseJSONBodyLimit(r *http.Request, dst interface{}, maxBytes int64) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(dst); err != nil {
+		return decodeError(err)
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		return BadRequest("Request body must contain a single JSON object")
+	}
+
+	return Validate(dst)
+}
+
+func decodeError(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return NewError(http.StatusRequestEntityTooLarge, "body_too_large",
+			fmt.Sprintf("Request body must not be larger than %d bytes", maxBytesErr.Limit))
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return BadRequest("Request body contains malformed JSON").WithCode("malformed_json")
+	case errors.As(err, &typeErr):
+		return NewError(http.StatusBadRequest, CodeValidationFailed, "Invalid request payload").
+			WithField(typeErr.Field, "must be a "+typeErr.Type.String())
+	case errors.Is(err, io.EOF):
+		return BadRequest("Request body must not be empty")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return NewError(http.StatusBadRequest, CodeValidationFailed, "Invalid request payload").
+			WithField(field, "unknown field")
+	}
+	return BadRequest("Invalid request payload")
+}
+
+// Validate checks v against the `validate` tags of its fields, descending
+// into nested structs and slices of structs. Rules are comma separated, e.g.
+// `validate:"required,min=1"`; "omitempty" skips the remaining rules for
+// zero values and "dive" applies the remaining rules to slice elements.
+// An unknown rule is a bug in the tag and fails as an internal error.
+func Validate(v interface{}) error {
+	if err := CheckRules(v); err != nil {
+		return Internal("Error validating request", err)
+	}
+	var fields []FieldError
+	if err := validateStruct(reflect.ValueOf(v), "", &fields); err != nil {
+		return Internal("Error validating request", err)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return &AppError{
+		Status:  http.StatusBadRequest,
+		Code:    CodeValidationFailed,
+		Message: "Request validation failed",
+		Fields:  fields,
+	}
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+
+	// checkedTypes caches the result of CheckRules per type
+	checkedTypes sync.Map
+)
+
+// CheckRules reports the first rule in the `validate` tags of v's type, or
+// of the types nested in it, that is not registered. Validate runs it once
+// per type, so a bad tag fails on every request rather than only on the
+// ones that reach it.
+func CheckRules(v interface{}) error {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return nil
+	}
+	if err, ok := checkedTypes.Load(t); ok {
+		if err == nil {
+			return nil
+		}
+		return err.(error)
+	}
+	err := checkType(t, "", map[reflect.Type]bool{})
+	checkedTypes.Store(t, err)
+	return err
+}
+
+func checkType(t reflect.Type, prefix string, seen map[reflect.Type]bool) error {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == timeType || t == objectIDType || seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := jsonFieldName(field)
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			name, _, _ := strings.Cut(rule, "=")
+			if name == "" || name == "omitempty" || name == "dive" {
+				continue
+			}
+			validatorsMu.RLock()
+			_, ok := validators[name]
+			validatorsMu.RUnlock()
+			if !ok {
+				return fmt.Errorf("unknown validation rule %q on %s", name, path)
+			}
+		}
+		if err := checkType(field.Type, path, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateStruct(value reflect.Value, prefix string, fields *[]FieldError) error {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		structField := valueType.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+
+		name := jsonFieldName(structField)
+		if name == "-" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		field := value.Field(i)
+		if err := applyRules(field, structField.Tag.Get("validate"), path, fields); err != nil {
+			return err
+		}
+		if err := validateNested(field, path, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateNested(field reflect.Value, path string, fields *[]FieldError) error {
+	switch field.Kind() {
+	case reflect.Struct:
+		if field.Type() != timeType && field.Type() != objectIDType {
+			return validateStruct(field, path, fields)
+		}
+	case reflect.Ptr:
+		return validateNested(reflect.Indirect(field), path, fields)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < field.Len(); i++ {
+			if err := validateNested(field.Index(i), fmt.Sprintf("%s[%d]", path, i), fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func applyRules(field reflect.Value, tag, path string, fields *[]FieldError) error {
+	if tag == "" {
+		return nil
+	}
+
+	rules := strings.Split(tag, ",")
+	for i, rule := range rules {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "omitempty":
+			if field.IsZero() {
+				return nil
+			}
+			continue
+		case "dive":
+			if field.Kind() == reflect.Slice || field.Kind() == reflect.Array {
+				elementTag := strings.Join(rules[i+1:], ",")
+				for j := 0; j < field.Len(); j++ {
+					if err := applyRules(field.Index(j), elementTag, fmt.Sprintf("%s[%d]", path, j), fields); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		validatorsMu.RLock()
+		validator, ok := validators[name]
+		validatorsMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown validation rule %q on %s", name, path)
+		}
+
+		if message := validator(field, param); message != "" {
+			*fields = append(*fields, FieldError{Field: path, Message: message})
+			return nil
+		}
+	}
+	return nil
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func validateRequired(field reflect.Value, _ string) string {
+	if field.IsZero() {
+		return "is required"
+	}
+	return ""
+}
+
+func validateMin(field reflect.Value, param string) string {
+	limit, _ := strconv.ParseFloat(param, 64)
+	size, isLength := measure(field)
+	if size >= limit {
+		return ""
+	}
+	if isLength {
+		return "must have at least " + param + " items or characters"
+	}
+	return "must be at least " + param
+}
+
+func validateMax(field reflect.Value, param string) string {
+	limit, _ := strconv.ParseFloat(param, 64)
+	size, isLength := measure(field)
+	if size <= limit {
+		return ""
+	}
+	if isLength {
+		return "must have at most " + param + " items or characters"
+	}
+	return "must be at most " + param
+}
+
+// measure returns the numeric value of number fields and the length of
+// strings, slices and maps
+func measure(field reflect.Value) (float64, bool) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(field.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(field.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return field.Float(), false
+	case reflect.String:
+		return float64(utf8.RuneCountInString(field.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(field.Len()), true
+	}
+	return 0, false
+}
+
+func validateOneOf(field reflect.Value, param string) string {
+	value := fmt.Sprint(field.Interface())
+	for _, allowed := range strings.Fields(param) {
+		if value == allowed {
+			return ""
+		}
+	}
+	return "must be one of: " + strings.Join(strings.Fields(param), ", ")
+}
+
+func validateObjectID(field reflect.Value, _ string) string {
+	if field.Type() == objectIDType {
+		return ""
+	}
+	if field.Kind() == reflect.String && primitive.IsValidObjectID(field.String()) {
+		return ""
+	}
+	return "must be a valid object ID"
+}
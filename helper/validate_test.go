@@ -0,0 +1,68 @@
+package helper
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateUnknownRule(t *testing.T) {
+	type payload struct {
+		Name  string `json:"name" validate:"required"`
+		Color string `json:"color,omitempty" validate:"omitempty,testcolor"`
+	}
+
+	// The rule is reported even though the empty field never reaches it
+	err := Validate(&payload{Name: "x"})
+	var appErr *AppError
+	if !errors.As(err, &appErr) || appErr.Status != http.StatusInternalServerError {
+		t.Fatalf("Validate with an unknown rule returned %v, want an internal error", err)
+	}
+	if err := CheckRules(payload{}); err == nil || err.Error() != `unknown validation rule "testcolor" on color` {
+		t.Fatalf("CheckRules returned %v", err)
+	}
+
+	RegisterValidator("testcolor", func(field reflect.Value, _ string) string {
+		if field.String() == "red" {
+			return ""
+		}
+		return "must be red"
+	})
+	if err := Validate(&payload{Name: "x"}); err != nil {
+		t.Fatalf("Validate after registering the rule returned %v", err)
+	}
+	if err := Validate(&payload{Name: "x", Color: "blue"}); !errors.As(err, &appErr) || appErr.Status != http.StatusBadRequest {
+		t.Fatalf("Validate with an invalid value returned %v, want a validation error", err)
+	}
+}
+
+func TestParseJSONBodyLimit(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.HTTP.MaxBodyBytes = 16
+	SetConfig(cfg)
+
+	type payload struct {
+		Name string `json:"name"`
+	}
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"name":"short"}`, 0},
+		{`{"name":"longer than the limit"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		err := ParseJSONBody(req, &payload{})
+		var appErr *AppError
+		switch {
+		case tt.status == 0 && err != nil:
+			t.Errorf("ParseJSONBody(%s) returned %v", tt.body, err)
+		case tt.status != 0 && (!errors.As(err, &appErr) || appErr.Status != tt.status):
+			t.Errorf("ParseJSONBody(%s) returned %v, want status %d", tt.body, err, tt.status)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package logic
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	resetTokenTTL    = 24 * time.Hour
+)
+
+// AdminHandler serves the admin API: user management, audit logs, API keys,
+// settings and feature flags
+type AdminHandler struct {
+	users     repository.UserRepository
+	carts     repository.CartRepository
+	orders    repository.OrderRepository
+	apiKeys   repository.APIKeyRepository
+	auditLogs repository.AuditLogRepository
+	flagStore repository.FeatureFlagRepository
+	flags     *helper.FeatureFlags
+}
+
+func NewAdminHandler(repos *repository.Repositories, flags *helper.FeatureFlags) *AdminHandler {
+	return &AdminHandler{
+		users:     repos.Users,
+		carts:     repos.Carts,
+		orders:    repos.Orders,
+		apiKeys:   repos.APIKeys,
+		auditLogs: repos.AuditLogs,
+		flagStore: repos.Flags,
+		flags:     flags,
+	}
+}
+
+// PageResponse wraps one page of a paginated admin listing
+type PageResponse struct {
+	Items interface{} `json:"items"`
+	Total int64       `json:"total"`
+	Page  int         `json:"page"`
+	Limit int         `json:"limit"`
+}
+
+// AdminUser is the admin view of a user, without credentials
+type AdminUser struct {
+	ID                primitive.ObjectID `json:"id"`
+	Username          string             `json:"username"`
+	Role              string             `json:"role"`
+	Disabled          bool               `json:"disabled"`
+	MustResetPassword bool               `json:"must_reset_password"`
+	TOTPEnabled       bool               `json:"totp_enabled"`
+	Created           time.Time          `json:"created"`
+	LastUpdate        time.Time          `json:"last_update"`
+}
+
+func toAdminUser(user model.User) AdminUser {
+	return AdminUser{
+		ID:                user.ID,
+		Username:          user.Username,
+		Role:              user.Role,
+		Disabled:          user.Disabled,
+		MustResetPassword: user.MustResetPassword,
+		TOTPEnabled:       user.TOTPEnabled,
+		Created:           user.Created,
+		LastUpdate:        user.LastUpdate,
+	}
+}
+
+func parsePagination(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return page, limit
+}
+
+func pageOf(page, limit int) repository.Page {
+	return repository.Page{Skip: int64((page - 1) * limit), Limit: int64(limit)}
+}
+
+// ListUsers searches users by username, role and status, one page at a time
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	page, limit := parsePagination(r)
+	query := r.URL.Query()
+
+	filter := repository.UserFilter{Query: query.Get("q"), Role: query.Get("role")}
+	if disabled := query.Get("disabled"); disabled != "" {
+		value, err := strconv.ParseBool(disabled)
+		if err != nil {
+			return helper.BadRequest("Invalid disabled filter")
+		}
+		filter.Disabled = &value
+	}
+
+	users, total, err := h.users.Search(ctx, filter, pageOf(page, limit))
+	if err != nil {
+		return helper.Internal("Error finding users", err)
+	}
+
+	items := make([]AdminUser, 0, len(users))
+	for _, user := range users {
+		items = append(items, toAdminUser(user))
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, PageResponse{Items: items, Total: total, Page: page, Limit: limit})
+	return nil
+}
+
+func (h *AdminHandler) GetUserByID(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.findUserFromPath(r)
+	if err != nil {
+		return err
+	}
+	helper.RespondWithJSON(w, http.StatusOK, toAdminUser(*user))
+	return nil
+}
+
+type UpdateRoleRequest struct {
+	Role string `json:"role" validate:"required,role"`
+}
+
+func (h *AdminHandler) UpdateUserRole(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req UpdateRoleRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+
+	user, err := h.findUserFromPath(r)
+	if err != nil {
+		return err
+	}
+	if isSelf(r, user.ID) && req.Role != model.RoleAdmin {
+		return helper.BadRequest("Admins cannot remove their own admin role")
+	}
+
+	if err := h.users.UpdateRole(ctx, user.ID, req.Role, time.Now()); err != nil {
+		return helper.Internal("Error updating user "+user.ID.Hex(), err)
+	}
+	if err := h.recordAudit(ctx, r, AuditUserRoleChanged, user.ID, map[string]interface{}{"from": user.Role, "to": req.Role}); err != nil {
+		return err
+	}
+
+	user.Role = req.Role
+	helper.RespondWithJSON(w, http.StatusOK, toAdminUser(*user))
+	return nil
+}
+
+func (h *AdminHandler) DisableUser(w http.ResponseWriter, r *http.Request) error {
+	return h.setUserDisabled(w, r, true)
+}
+
+func (h *AdminHandler) EnableUser(w http.ResponseWriter, r *http.Request) error {
+	return h.setUserDisabled(w, r, false)
+}
+
+func (h *AdminHandler) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) error {
+	ctx := r.Context()
+
+	user, err := h.findUserFromPath(r)
+	if err != nil {
+		return err
+	}
+	if disabled && isSelf(r, user.ID) {
+		return helper.BadRequest("Admins cannot disable their own account")
+	}
+
+	now := time.Now()
+	action := AuditUserEnabled
+	if disabled {
+		action = AuditUserDisabled
+	}
+
+	if err := h.users.SetDisabled(ctx, user.ID, disabled, now); err != nil {
+		return helper.Internal("Error updating user "+user.ID.Hex(), err)
+	}
+	if err := h.recordAudit(ctx, r, action, user.ID, nil); err != nil {
+		return err
+	}
+
+	user.Disabled = disabled
+	user.LastUpdate = now
+	helper.RespondWithJSON(w, http.StatusOK, toAdminUser(*user))
+	return nil
+}
+
+// ForcePasswordReset revokes the user's tokens and issues a one-time reset
+// token that the user must redeem through /password/reset before logging in.
+func (h *AdminHandler) ForcePasswordReset(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := h.findUserFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	resetToken := helper.GenerateID()
+	now := time.Now()
+	expiry := now.Add(resetTokenTTL)
+	if err := h.users.RequirePasswordReset(ctx, user.ID, helper.HashToken(resetToken), expiry, now); err != nil {
+		return helper.Internal("Error updating user "+user.ID.Hex(), err)
+	}
+	if err := h.recordAudit(ctx, r, AuditUserPasswordReset, user.ID, map[string]interface{}{"expires": expiry}); err != nil {
+		return err
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"userId":     user.ID.Hex(),
+		"resetToken": resetToken,
+		"expires":    expiry,
+	})
+	return nil
+}
+
+// ResetUserMFA removes a user's TOTP enrollment, e.g. after a lost device
+func (h *AdminHandler) ResetUserMFA(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := h.findUserFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := h.users.DisableTOTP(ctx, user.ID, true, now); err != nil {
+		return helper.Internal("Error updating user "+user.ID.Hex(), err)
+	}
+	if err := h.recordAudit(ctx, r, AuditUserMFAReset, user.ID, nil); err != nil {
+		return err
+	}
+
+	user.TOTPEnabled = false
+	user.LastUpdate = now
+	helper.RespondWithJSON(w, http.StatusOK, toAdminUser(*user))
+	return nil
+}
+
+func (h *AdminHandler) GetUserCarts(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := h.findUserFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	carts, err := h.carts.ListByUser(ctx, user.ID)
+	if err != nil {
+		return helper.Internal("Error finding carts", err)
+	}
+	helper.RespondWithJSON(w, http.StatusOK, carts)
+	return nil
+}
+
+func (h *AdminHandler) GetUserOrders(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	user, err := h.findUserFromPath(r)
+	if err != nil {
+		return err
+	}
+
+	orders, err := h.orders.ListByUser(ctx, user.ID)
+	if err != nil {
+		return helper.Internal("Error finding orders", err)
+	}
+	helper.RespondWithJSON(w, http.StatusOK, orders)
+	return nil
+}
+
+func (h *AdminHandler) findUserFromPath(r *http.Request) (*model.User, error) {
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, helper.BadRequest("Invalid user ID")
+	}
+
+	user, err := h.users.FindByID(r.Context(), userID)
+	if err != nil {
+		if err == repository.ErrNotFound {
+			return nil, helper.NotFound("User not found")
+		}
+		return nil, helper.Internal("Error finding user", err)
+	}
+	return user, nil
+}
+
+func isSelf(r *http.Request, userID primitive.ObjectID) bool {
+	actorID, ok := helper.UserIDFromContext(r.Context())
+	return ok && actorID == userID
+}
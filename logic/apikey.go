@@ -0,0 +1,98 @@
+package logic
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,dive,scope"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// CreateAPIKey issues a new API key. The plaintext key is only part of this
+// response and cannot be retrieved later.
+func (h *AdminHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req CreateAPIKeyRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return helper.BadRequest("Expiry must be in the future")
+	}
+
+	rawKey := helper.GenerateAPIKey()
+	key := model.APIKey{
+		ID:      primitive.NewObjectID(),
+		Name:    req.Name,
+		Prefix:  rawKey[:12],
+		KeyHash: helper.HashToken(rawKey),
+		Scopes:  req.Scopes,
+		Created: time.Now(),
+	}
+	if req.ExpiresAt != nil {
+		key.ExpiresAt = *req.ExpiresAt
+	}
+	if creatorID, ok := helper.UserIDFromContext(r.Context()); ok {
+		key.CreatedByID = creatorID
+	}
+
+	if err := h.apiKeys.Create(ctx, &key); err != nil {
+		return helper.Internal("Error creating API key", err)
+	}
+	if err := h.recordAudit(ctx, r, AuditAPIKeyCreated, key.ID, map[string]interface{}{"name": key.Name, "scopes": key.Scopes}); err != nil {
+		return err
+	}
+
+	helper.RespondWithJSON(w, http.StatusCreated, map[string]interface{}{
+		"key":    rawKey,
+		"apiKey": key,
+	})
+	return nil
+}
+
+func (h *AdminHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	page, limit := parsePagination(r)
+	includeRevoked := r.URL.Query().Get("revoked") == "true"
+	keys, total, err := h.apiKeys.List(ctx, includeRevoked, pageOf(page, limit))
+	if err != nil {
+		return helper.Internal("Error finding API keys", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, PageResponse{Items: keys, Total: total, Page: page, Limit: limit})
+	return nil
+}
+
+func (h *AdminHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	keyID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return helper.BadRequest("Invalid API key ID")
+	}
+
+	err = h.apiKeys.Revoke(ctx, keyID)
+	if err == repository.ErrNotFound {
+		return helper.NotFound("API key not found")
+	}
+	if err != nil {
+		return helper.Internal("Error revoking API key", err)
+	}
+	if err := h.recordAudit(ctx, r, AuditAPIKeyRevoked, keyID, nil); err != nil {
+		return err
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "API key revoked"})
+	return nil
+}
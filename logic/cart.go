@@ -2,202 +2,196 @@ package logic
 
 import (
 	"context"
-	"encoding/json"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/dianerwansyah/web-cart-backend/helper"
 	"github.com/dianerwansyah/web-cart-backend/model"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // ProductQuantity represents a product with its quantity in the checkout payload
 type ProductQuantity struct {
-	ProductID   primitive.ObjectID `json:"ProductID" bson:"ProductID"`
+	ProductID   primitive.ObjectID `json:"ProductID" bson:"ProductID" validate:"required"`
 	Name        string             `json:"Name" bson:"Name"`
 	Description string             `json:"Description" bson:"Description"`
 	Price       float64            `json:"Price" bson:"Price"`
 	ImageURL    string             `json:"ImageURL" bson:"ImageURL"`
-	Quantity    int                `json:"Quantity" bson:"Quantity"`
+	Quantity    int                `json:"Quantity" bson:"Quantity" validate:"min=1"`
 }
 
 // CheckoutRequest represents the entire checkout payload
 type CheckoutRequest struct {
-	UserID       string            `json:"UserID" bson:"UserID"`
+	UserID       string            `json:"UserID" bson:"UserID" validate:"required,objectid"`
 	IsCheckout   bool              `json:"IsCheckout" bson:"IsCheckout"`
 	IsConfirm    bool              `json:"IsConfirm"`
 	Target       []ProductQuantity `json:"Target" bson:"Target"`
-	TotalCoupons int               `json:"TotalCoupons" bson:"TotalCoupons"`
+	TotalCoupons int               `json:"TotalCoupons" bson:"TotalCoupons" validate:"min=0"`
 }
 
-func SaveCheckout(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// TrxHandler serves carts, checkout and order history. Changes to checkout
+// are rolled out behind flags.
+type TrxHandler struct {
+	products repository.ProductRepository
+	carts    repository.CartRepository
+	orders   repository.OrderRepository
+	coupons  repository.CouponRepository
+	flags    *helper.FeatureFlags
+}
+
+func NewTrxHandler(products repository.ProductRepository, carts repository.CartRepository, orders repository.OrderRepository, coupons repository.CouponRepository, flags *helper.FeatureFlags) *TrxHandler {
+	return &TrxHandler{products: products, carts: carts, orders: orders, coupons: coupons, flags: flags}
+}
+
+func (h *TrxHandler) SaveCheckout(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 
 	var checkoutRequest CheckoutRequest
-	if err := json.NewDecoder(r.Body).Decode(&checkoutRequest); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+	if err := helper.ParseJSONBody(r, &checkoutRequest); err != nil {
+		return err
+	}
+	if err := authorizeUserID(r, checkoutRequest.UserID); err != nil {
+		return err
 	}
 
 	userID, err := primitive.ObjectIDFromHex(checkoutRequest.UserID)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		return helper.BadRequest("Invalid user ID")
 	}
 
-	cartCollection := helper.GetCollection(model.Cart{}.TableName())
-	productCollection := helper.GetCollection(model.Product{}.TableName())
+	// Take every item out of stock first, so concurrent checkouts of the
+	// last items cannot both succeed. A failure puts back what was taken.
+	for i, item := range checkoutRequest.Target {
+		err := h.products.DecrementStock(ctx, item.ProductID, item.Quantity)
+		if err == nil {
+			continue
+		}
+		h.restoreStock(ctx, checkoutRequest.Target[:i])
+		if err == repository.ErrNotFound {
+			return helper.NotFound("Product not found")
+		}
+		if err == repository.ErrInsufficientStock {
+			insufficientStock.Inc()
+			return helper.BadRequest("Insufficient stock").WithCode("insufficient_stock")
+		}
+		return helper.Internal("Error updating product stock", err)
+	}
 
-	for _, item := range checkoutRequest.Target {
-		productID, err := primitive.ObjectIDFromHex(item.ProductID.Hex())
-		if err != nil {
-			http.Error(w, "Invalid product ID", http.StatusBadRequest)
-			return
+	// Remember the cart items the checkout overwrites, so a failure can put
+	// them back as they were
+	previous := make([]*model.Cart, len(checkoutRequest.Target))
+	for i, item := range checkoutRequest.Target {
+		previous[i], err = h.carts.FindItem(ctx, userID, item.ProductID)
+		if err != nil && err != repository.ErrNotFound {
+			h.restoreStock(ctx, checkoutRequest.Target)
+			return helper.Internal("Error finding cart item", err)
 		}
+	}
 
+	for i, item := range checkoutRequest.Target {
 		// Update or insert into cart
-		filter := bson.M{"ProductID": productID, "UserID": userID}
-		update := bson.M{
-			"$set": bson.M{
-				"Quantity":   item.Quantity,
-				"IsCheckout": true,
-				"IsConfirm":  false,
-				"Created":    time.Now(),
-			},
-		}
-		opts := options.Update().SetUpsert(true)
-		_, err = cartCollection.UpdateOne(ctx, filter, update, opts)
+		err = h.carts.Upsert(ctx, model.Cart{
+			ProductID:  item.ProductID,
+			UserID:     userID,
+			Quantity:   item.Quantity,
+			IsCheckout: true,
+			IsConfirm:  false,
+			Created:    time.Now(),
+		})
 		if err != nil {
-			http.Error(w, "Error updating cart", http.StatusInternalServerError)
-			return
+			h.restoreCart(ctx, userID, checkoutRequest.Target[:i], previous)
+			h.restoreStock(ctx, checkoutRequest.Target)
+			return helper.Internal("Error updating cart", err)
 		}
+	}
 
-		// Update product stock
-		var product model.Product
-		err = productCollection.FindOne(ctx, bson.M{"_id": productID}).Decode(&product)
-		if err != nil {
-			http.Error(w, "Product not found", http.StatusNotFound)
-			return
-		}
+	checkoutsTotal.Inc()
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Checkout successful"})
+	return nil
+}
 
-		newStock := product.Stock - item.Quantity
-		if newStock < 0 {
-			http.Error(w, "Insufficient stock", http.StatusBadRequest)
-			return
+// restoreStock puts the items of a failed checkout back into stock, even
+// when the request was cancelled
+func (h *TrxHandler) restoreStock(ctx context.Context, items []ProductQuantity) {
+	ctx = context.WithoutCancel(ctx)
+	for _, item := range items {
+		err := h.products.IncrementStock(ctx, item.ProductID, item.Quantity)
+		if err != nil && err != repository.ErrNotFound {
+			slog.ErrorContext(ctx, "Error restoring product stock",
+				"product", item.ProductID.Hex(), "quantity", item.Quantity, "error", err)
 		}
+	}
+}
 
-		_, err = productCollection.UpdateOne(ctx, bson.M{"_id": productID}, bson.M{"$set": bson.M{"Stock": newStock}})
+// restoreCart puts the cart items of a failed checkout back as they were
+// before it, deleting those it created, even when the request was cancelled
+func (h *TrxHandler) restoreCart(ctx context.Context, userID primitive.ObjectID, items []ProductQuantity, previous []*model.Cart) {
+	ctx = context.WithoutCancel(ctx)
+	for i, item := range items {
+		var err error
+		if previous[i] != nil {
+			err = h.carts.Upsert(ctx, *previous[i])
+		} else {
+			err = h.carts.DeleteItem(ctx, userID, item.ProductID)
+		}
 		if err != nil {
-			http.Error(w, "Error updating product stock", http.StatusInternalServerError)
-			return
+			slog.ErrorContext(ctx, "Error restoring cart item",
+				"user", userID.Hex(), "product", item.ProductID.Hex(), "error", err)
 		}
 	}
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Checkout successful"})
 }
 
-func SaveConfirm(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (h *TrxHandler) SaveConfirm(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 
 	var checkoutRequest CheckoutRequest
 
 	// Decode JSON request body
-	if err := json.NewDecoder(r.Body).Decode(&checkoutRequest); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+	if err := helper.ParseJSONBody(r, &checkoutRequest); err != nil {
+		return err
+	}
+	if err := authorizeUserID(r, checkoutRequest.UserID); err != nil {
+		return err
 	}
 
 	userID, err := primitive.ObjectIDFromHex(checkoutRequest.UserID)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		return helper.BadRequest("Invalid user ID")
 	}
 
-	cartCollection := helper.GetCollection(model.Cart{}.TableName())
-	couponCollection := helper.GetCollection(model.Coupon{}.TableName())
-	historyCollection := helper.GetCollection(model.History{}.TableName())
-
 	for _, item := range checkoutRequest.Target {
-		productID := item.ProductID
-
 		// Update cart to set IsConfirm to true
-		filter := bson.M{"ProductID": productID, "UserID": userID}
-		update := bson.M{
-			"$set": bson.M{
-				"Quantity":   item.Quantity,
-				"IsCheckout": true,
-				"IsConfirm":  true,
-				"Created":    time.Now(),
-			},
-		}
-		opts := options.Update().SetUpsert(true)
-		_, err = cartCollection.UpdateOne(ctx, filter, update, opts)
+		err = h.carts.Upsert(ctx, model.Cart{
+			ProductID:  item.ProductID,
+			UserID:     userID,
+			Quantity:   item.Quantity,
+			IsCheckout: true,
+			IsConfirm:  true,
+			Created:    time.Now(),
+		})
 		if err != nil {
-			http.Error(w, "Error updating cart", http.StatusInternalServerError)
-			return
+			return helper.Internal("Error updating cart", err)
 		}
 	}
 
-	// Check if the coupon already exists
-	var existingCoupon model.Coupon
-	err = couponCollection.FindOne(ctx, bson.M{"UserID": userID}).Decode(&existingCoupon)
-	if err != nil && err != mongo.ErrNoDocuments {
-		http.Error(w, "Error checking existing coupon", http.StatusInternalServerError)
-		return
-	}
-
-	if existingCoupon.ID != primitive.NilObjectID {
-		// Update existing coupon
-		newAmount := existingCoupon.Amount + checkoutRequest.TotalCoupons
-		update := bson.M{
-			"$set": bson.M{
-				"Amount":      newAmount,
-				"LastUpdated": time.Now(),
-			},
-		}
-		_, err = couponCollection.UpdateOne(ctx, bson.M{"_id": existingCoupon.ID}, update)
-		if err != nil {
-			http.Error(w, "Error updating coupon", http.StatusInternalServerError)
-			return
-		}
-	} else {
-		// Insert new coupon
-		coupon := model.Coupon{
-			UserID:      userID,
-			Amount:      checkoutRequest.TotalCoupons,
-			Created:     time.Now(),
-			LastUpdated: time.Now(),
-		}
-		_, err = couponCollection.InsertOne(ctx, coupon)
-		if err != nil {
-			http.Error(w, "Error inserting coupon", http.StatusInternalServerError)
-			return
-		}
+	// Add the earned coupons to the user's balance
+	if err := h.coupons.AddAmount(ctx, userID, checkoutRequest.TotalCoupons, time.Now()); err != nil {
+		return helper.Internal("Error updating coupon", err)
 	}
+	couponsIssued.Add(float64(checkoutRequest.TotalCoupons))
 
 	// Move confirmed items from cart to history
-	filter := bson.M{"UserID": userID, "IsCheckout": true, "IsConfirm": true}
-	cursor, err := cartCollection.Find(ctx, filter)
+	confirmedItems, err := h.carts.ListConfirmed(ctx, userID)
 	if err != nil {
-		http.Error(w, "Error finding confirmed cart items", http.StatusInternalServerError)
-		return
-	}
-	var confirmedItems []model.Cart
-	if err = cursor.All(ctx, &confirmedItems); err != nil {
-		http.Error(w, "Error decoding confirmed cart items", http.StatusInternalServerError)
-		return
+		return helper.Internal("Error finding confirmed cart items", err)
 	}
 
 	// Generate a new transaction ID
 	idTrx := primitive.NewObjectID()
 
-	var historyItems []interface{}
+	var historyItems []model.History
 	for _, item := range confirmedItems {
 		history := model.History{
 			IDTrx:      idTrx,
@@ -211,21 +205,83 @@ func SaveConfirm(w http.ResponseWriter, r *http.Request) {
 		historyItems = append(historyItems, history)
 	}
 
-	if len(historyItems) > 0 {
-		_, err = historyCollection.InsertMany(ctx, historyItems)
-		if err != nil {
-			http.Error(w, "Error inserting history items", http.StatusInternalServerError)
-			return
-		}
+	if err := h.orders.InsertMany(ctx, historyItems); err != nil {
+		return helper.Internal("Error inserting history items", err)
 	}
 
 	// Delete confirmed items from cart
-	_, err = cartCollection.DeleteMany(ctx, filter)
-	if err != nil {
-		http.Error(w, "Error deleting confirmed cart items", http.StatusInternalServerError)
-		return
+	if err := h.carts.DeleteConfirmed(ctx, userID); err != nil {
+		return helper.Internal("Error deleting confirmed cart items", err)
+	}
+
+	confirmsTotal.Inc()
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Confirmation successful"})
+	return nil
+}
+
+// authorizeUserID rejects requests where a regular user acts on another
+// user's cart or orders. Admins and API keys may act on any user.
+func authorizeUserID(r *http.Request, userID string) error {
+	if _, ok := helper.APIKeyFromContext(r.Context()); ok {
+		return nil
+	}
+	if role, _ := helper.RoleFromContext(r.Context()); role == model.RoleAdmin {
+		return nil
 	}
+	if id, ok := helper.UserIDFromContext(r.Context()); !ok || id.Hex() != userID {
+		return helper.Forbidden("Cannot access another user's data")
+	}
+	return nil
+}
+
+const checkoutSweepInterval = time.Minute
+
+// ReleaseExpiredCheckouts returns a background worker that puts items that
+// were checked out but not confirmed within runtime.checkout.expiry back
+// into stock. The expiry is read on every sweep, so it can be changed or
+// disabled (0) at runtime.
+func ReleaseExpiredCheckouts(products repository.ProductRepository, carts repository.CartRepository) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(checkoutSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				expiry := helper.Settings().Checkout.Expiry
+				if expiry <= 0 {
+					continue
+				}
+				err := releaseExpiredCheckouts(ctx, products, carts, time.Now().Add(-expiry))
+				if err != nil && ctx.Err() == nil {
+					slog.Error("Error releasing expired checkouts", "error", err)
+				}
+			}
+		}
+	}
+}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Confirmation successful"})
+func releaseExpiredCheckouts(ctx context.Context, products repository.ProductRepository, carts repository.CartRepository, before time.Time) error {
+	items, err := carts.ListExpiredCheckouts(ctx, before)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		// Only the sweep that deletes the item restores its stock, and an
+		// item confirmed in the meantime is left alone
+		deleted, err := carts.DeleteExpiredCheckout(ctx, item.ID, before)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			continue
+		}
+		err = products.IncrementStock(ctx, item.ProductID, item.Quantity)
+		if err != nil && err != repository.ErrNotFound {
+			return err
+		}
+	}
+	return nil
 }
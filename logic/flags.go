@@ -0,0 +1,239 @@
+package logic
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"github.com/gorilla/mux"
+)
+
+const (
+	AuditFlagCreated = "flag.created"
+	AuditFlagUpdated = "flag.updated"
+	AuditFlagDeleted = "flag.deleted"
+)
+
+var flagKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+func init() {
+	helper.RegisterValidator("flagkey", validateFlagKey)
+}
+
+func validateFlagKey(field reflect.Value, _ string) string {
+	if flagKeyPattern.MatchString(field.String()) {
+		return ""
+	}
+	return "must be lowercase letters, digits, '.', '_' or '-', at most 64 characters"
+}
+
+// FlagRequest creates a flag, or replaces all of its settings. The key is
+// only taken from the body on create.
+type FlagRequest struct {
+	Key         string              `json:"key,omitempty" validate:"omitempty,flagkey"`
+	Description string              `json:"description" validate:"max=500"`
+	Type        string              `json:"type" validate:"required,oneof=boolean variant"`
+	Enabled     bool                `json:"enabled"`
+	UserIDs     []string            `json:"userIds" validate:"max=1000,dive,objectid"`
+	Roles       []string            `json:"roles" validate:"dive,role"`
+	Percentage  int                 `json:"percentage" validate:"min=0,max=100"`
+	Variants    []model.FlagVariant `json:"variants" validate:"max=20"`
+	OffVariant  string              `json:"offVariant" validate:"max=64"`
+}
+
+// validateVariants checks the rules that span several fields
+func (req *FlagRequest) validateVariants() error {
+	invalid := func(field, message string) error {
+		return helper.NewError(http.StatusBadRequest, helper.CodeValidationFailed, "Request validation failed").
+			WithField(field, message)
+	}
+
+	if req.Type == model.FlagTypeBoolean {
+		if len(req.Variants) > 0 || req.OffVariant != "" {
+			return invalid("variants", "only variant flags have variants")
+		}
+		return nil
+	}
+
+	if len(req.Variants) == 0 {
+		return invalid("variants", "variant flags need at least one variant")
+	}
+	names := map[string]bool{}
+	for _, variant := range req.Variants {
+		if names[variant.Name] {
+			return invalid("variants", "duplicate variant "+variant.Name)
+		}
+		names[variant.Name] = true
+	}
+	if req.OffVariant != "" && !names[req.OffVariant] {
+		return invalid("offVariant", "must be one of the variants")
+	}
+	return nil
+}
+
+func (req *FlagRequest) apply(flag *model.FeatureFlag) {
+	flag.Description = req.Description
+	flag.Type = req.Type
+	flag.Enabled = req.Enabled
+	flag.UserIDs = req.UserIDs
+	flag.Roles = req.Roles
+	flag.Percentage = req.Percentage
+	flag.Variants = req.Variants
+	flag.OffVariant = req.OffVariant
+}
+
+func (h *AdminHandler) ListFlags(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	flags, err := h.flagStore.List(ctx)
+	if err != nil {
+		return helper.Internal("Error finding feature flags", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, flags)
+	return nil
+}
+
+func (h *AdminHandler) GetFlag(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	flag, err := h.findFlagFromPath(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, flag)
+	return nil
+}
+
+func (h *AdminHandler) CreateFlag(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req FlagRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+	if req.Key == "" {
+		return helper.NewError(http.StatusBadRequest, helper.CodeValidationFailed, "Request validation failed").
+			WithField("key", "is required")
+	}
+	if err := req.validateVariants(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	flag := model.FeatureFlag{Key: req.Key, Created: now, LastUpdated: now}
+	req.apply(&flag)
+	flag.LastUpdatedByID, _ = helper.UserIDFromContext(r.Context())
+
+	err := h.flagStore.Create(ctx, &flag)
+	if err == repository.ErrDuplicate {
+		return helper.Conflict("Feature flag already exists").WithCode("flag_exists")
+	}
+	if err != nil {
+		return helper.Internal("Error creating feature flag", err)
+	}
+	h.flags.Invalidate()
+	if err := h.recordAudit(ctx, r, AuditFlagCreated, flag.ID, map[string]interface{}{"key": flag.Key, "enabled": flag.Enabled, "percentage": flag.Percentage}); err != nil {
+		return err
+	}
+
+	helper.RespondWithJSON(w, http.StatusCreated, flag)
+	return nil
+}
+
+func (h *AdminHandler) UpdateFlag(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req FlagRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+	if err := req.validateVariants(); err != nil {
+		return err
+	}
+
+	flag, err := h.findFlagFromPath(ctx, r)
+	if err != nil {
+		return err
+	}
+	if req.Key != "" && req.Key != flag.Key {
+		return helper.BadRequest("Feature flag keys cannot be changed")
+	}
+
+	req.apply(flag)
+	flag.LastUpdated = time.Now()
+	flag.LastUpdatedByID, _ = helper.UserIDFromContext(r.Context())
+
+	err = h.flagStore.Update(ctx, flag)
+	if err == repository.ErrNotFound {
+		return helper.NotFound("Feature flag not found")
+	}
+	if err != nil {
+		return helper.Internal("Error updating feature flag", err)
+	}
+	h.flags.Invalidate()
+	if err := h.recordAudit(ctx, r, AuditFlagUpdated, flag.ID, map[string]interface{}{"key": flag.Key, "enabled": flag.Enabled, "percentage": flag.Percentage}); err != nil {
+		return err
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, flag)
+	return nil
+}
+
+func (h *AdminHandler) DeleteFlag(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	flag, err := h.findFlagFromPath(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	err = h.flagStore.Delete(ctx, flag.Key)
+	if err != nil && err != repository.ErrNotFound {
+		return helper.Internal("Error deleting feature flag", err)
+	}
+	h.flags.Invalidate()
+	if err := h.recordAudit(ctx, r, AuditFlagDeleted, flag.ID, map[string]interface{}{"key": flag.Key}); err != nil {
+		return err
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Feature flag deleted"})
+	return nil
+}
+
+// EvaluateFlag shows what a flag resolves to for the user and role given in
+// the query, to check targeting before widening a rollout
+func (h *AdminHandler) EvaluateFlag(w http.ResponseWriter, r *http.Request) error {
+	subject := helper.FlagSubject{
+		UserID: r.URL.Query().Get("user"),
+		Role:   r.URL.Query().Get("role"),
+	}
+	helper.RespondWithJSON(w, http.StatusOK, h.flags.Evaluate(r.Context(), mux.Vars(r)["key"], subject))
+	return nil
+}
+
+func (h *AdminHandler) findFlagFromPath(ctx context.Context, r *http.Request) (*model.FeatureFlag, error) {
+	flag, err := h.flagStore.FindByKey(ctx, mux.Vars(r)["key"])
+	if err == repository.ErrNotFound {
+		return nil, helper.NotFound("Feature flag not found")
+	}
+	if err != nil {
+		return nil, helper.Internal("Error finding feature flag", err)
+	}
+	return flag, nil
+}
+
+// CurrentFlags returns every stored flag evaluated for the caller, so that
+// clients can switch features on the same rollout as the backend
+func CurrentFlags(flags *helper.FeatureFlags) helper.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		helper.RespondWithJSON(w, http.StatusOK, flags.EvaluateAll(r.Context(), helper.FlagSubjectFromContext(r.Context())))
+		return nil
+	}
+}
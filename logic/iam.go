@@ -1,110 +1,130 @@
 package logic
 
 import (
-	"context"
-	"encoding/json"
-	"log"
+	"crypto/subtle"
 	"net/http"
 	"time"
 
 	"github.com/dianerwansyah/web-cart-backend/helper"
 	"github.com/dianerwansyah/web-cart-backend/model"
-	"github.com/golang-jwt/jwt"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var client *mongo.Client
-var userCollection *mongo.Collection
+// AuthHandler serves registration, login, two-factor authentication and
+// external login through the given identity providers
+type AuthHandler struct {
+	users      repository.UserRepository
+	authStates repository.AuthStateRepository
+	providers  map[string]helper.IdentityProvider
+	flags      *helper.FeatureFlags
+}
 
-func init() {
-	cfg := helper.GetConfig()
-	clientOptions := options.Client().ApplyURI(cfg.Server.MongoURI)
-	client, _ = mongo.Connect(context.Background(), clientOptions)
-	userCollection = client.Database(cfg.Server.MongoDB).Collection("users")
+func NewAuthHandler(users repository.UserRepository, authStates repository.AuthStateRepository, flags *helper.FeatureFlags, providers ...helper.IdentityProvider) *AuthHandler {
+	h := &AuthHandler{
+		users:      users,
+		authStates: authStates,
+		flags:      flags,
+		providers:  make(map[string]helper.IdentityProvider, len(providers)),
+	}
+	for _, provider := range providers {
+		h.providers[provider.Name()] = provider
+	}
+	return h
 }
 
-func RegisterHandler(w http.ResponseWriter, r *http.Request) {
-	var creds model.Credentials
-	err := json.NewDecoder(r.Body).Decode(&creds)
+// RegisterRequest is the body of /register
+type RegisterRequest struct {
+	model.Credentials
+	// Deprecated: Role is accepted so older clients keep working, and
+	// ignored; registration always grants the user role.
+	Role string `json:"role,omitempty"`
+}
+
+func (h *AuthHandler) RegisterHandler(w http.ResponseWriter, r *http.Request) error {
+	var creds RegisterRequest
+	err := helper.ParseJSONBody(r, &creds)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+		return err
 	}
-
-	// Check if user already exists
-	var existingUser model.User
-	err = userCollection.FindOne(context.Background(), bson.M{"username": creds.Username}).Decode(&existingUser)
-	if err == nil {
-		http.Error(w, "User already exists", http.StatusConflict)
-		return
+	if creds.Role != "" {
+		helper.LoggerFromContext(r.Context()).Warn("Ignoring deprecated role on registration", "role", creds.Role)
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "Error hashing password", http.StatusInternalServerError)
-		return
+		return helper.Internal("Error hashing password", err)
 	}
 
 	user := model.User{
 		ID:       primitive.NewObjectID(),
 		Username: creds.Username,
 		Password: string(hashedPassword),
-		Role:     creds.Role,
-		Created:  time.Now(),
+		// Admins are made by other admins, never by signing up
+		Role:    model.RoleUser,
+		Created: time.Now(),
 	}
 
-	_, err = userCollection.InsertOne(context.Background(), user)
+	err = h.users.Create(r.Context(), &user)
+	if err == repository.ErrDuplicate {
+		return helper.Conflict("User already exists").WithCode("user_exists")
+	}
 	if err != nil {
-		http.Error(w, "Error creating user", http.StatusInternalServerError)
-		return
+		return helper.Internal("Error creating user", err)
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	helper.RespondWithJSON(w, http.StatusCreated, user)
+	return nil
 }
 
-func LoginHandler(w http.ResponseWriter, r *http.Request) {
+func (h *AuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) error {
 	var creds model.Credentials
-	err := json.NewDecoder(r.Body).Decode(&creds)
+	err := helper.ParseJSONBody(r, &creds)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	var user model.User
-	err = userCollection.FindOne(context.Background(), bson.M{"username": creds.Username}).Decode(&user)
+	user, err := h.users.FindByUsername(r.Context(), creds.Username)
 	if err != nil {
-		log.Printf("User not found: %s", creds.Username)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+		return helper.Unauthorized("Invalid credentials").WithCode("invalid_credentials")
 	}
 
-	// Tambahkan log untuk debugging
-	log.Printf("Login attempt for user: %s", creds.Username)
-
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password))
 	if err != nil {
-		// Tambahkan log untuk debugging
-		log.Printf("Password mismatch for user: %s", creds.Username)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+		return helper.Unauthorized("Invalid credentials").WithCode("invalid_credentials")
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"userId":   user.ID.Hex(),
-		"username": user.Username,
-		"role":     user.Role,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
-	})
+	if user.MustResetPassword && !user.Disabled {
+		return helper.Forbidden("Password reset required").WithCode("password_reset_required")
+	}
 
-	tokenString, err := token.SignedString([]byte(helper.GetConfig().Server.JwtSecret))
+	return h.completeLogin(w, r, user)
+}
+
+// completeLogin finishes a successful first-factor login, either with the
+// final JWT or with a two-factor challenge
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *model.User) error {
+	if user.Disabled {
+		return helper.Forbidden("Account disabled").WithCode("account_disabled")
+	}
+
+	if user.TOTPEnabled || mfaEnrollmentRequired(user) {
+		return h.respondWithMFAChallenge(w, r, user)
+	}
+
+	return respondWithToken(w, user)
+}
+
+func respondWithToken(w http.ResponseWriter, user *model.User) error {
+	tokenString, err := helper.SignToken(helper.Claims{
+		UserID:       user.ID.Hex(),
+		Username:     user.Username,
+		Role:         user.Role,
+		TokenVersion: user.TokenVersion,
+	}, helper.Settings().Auth.TokenTTL)
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+		return helper.Internal("Failed to generate token", err)
 	}
 
 	// Return the token and user ID
@@ -113,6 +133,43 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		"userId":   user.ID.Hex(),
 		"username": user.Username,
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	helper.RespondWithJSON(w, http.StatusOK, response)
+	return nil
+}
+
+type ResetPasswordRequest struct {
+	Username    string `json:"username" validate:"required"`
+	ResetToken  string `json:"resetToken" validate:"required"`
+	NewPassword string `json:"newPassword" validate:"required,min=8,max=72"`
+}
+
+// ResetPasswordHandler completes a password reset forced by an admin
+func (h *AuthHandler) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) error {
+	var req ResetPasswordRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+
+	user, err := h.users.FindByUsername(r.Context(), req.Username)
+	if err != nil {
+		return helper.Unauthorized("Invalid reset token").WithCode("reset_token_invalid")
+	}
+
+	if !user.MustResetPassword || user.ResetTokenHash == "" || time.Now().After(user.ResetTokenExpiry) ||
+		subtle.ConstantTimeCompare([]byte(helper.HashToken(req.ResetToken)), []byte(user.ResetTokenHash)) != 1 {
+		return helper.Unauthorized("Invalid reset token").WithCode("reset_token_invalid")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return helper.Internal("Error hashing password", err)
+	}
+
+	err = h.users.UpdatePassword(r.Context(), user.ID, string(hashedPassword), time.Now())
+	if err != nil {
+		return helper.Internal("Error updating password", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Password updated"})
+	return nil
 }
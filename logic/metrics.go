@@ -0,0 +1,35 @@
+package logic
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Business counters of the trx service, see Collectors
+var (
+	cartsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webcart_cart_items_created_total",
+		Help: "Products added to a cart.",
+	})
+	checkoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webcart_checkouts_total",
+		Help: "Successful checkouts.",
+	})
+	confirmsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webcart_confirms_total",
+		Help: "Successful order confirmations.",
+	})
+	insufficientStock = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webcart_insufficient_stock_total",
+		Help: "Checkouts rejected for insufficient stock.",
+	})
+	couponsIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "webcart_coupons_issued_total",
+		Help: "Coupon amount issued by confirmations.",
+	})
+)
+
+// Collectors are the business counters, for the registry of the service
+// that records them
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{cartsCreated, checkoutsTotal, confirmsTotal, insufficientStock, couponsIssued}
+}
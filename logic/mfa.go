@@ -0,0 +1,282 @@
+package logic
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	mfaPendingTTL     = 5 * time.Minute
+	recoveryCodeCount = 10
+	// mfaMaxFailures wrong codes burn an "mfa pending" token, so the
+	// password has to be entered again
+	mfaMaxFailures = 5
+)
+
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+type LoginMFARequest struct {
+	MFAToken string `json:"mfaToken" validate:"required"`
+	Code     string `json:"code" validate:"required,max=32"`
+}
+
+func mfaEnrollmentRequired(user *model.User) bool {
+	return user.Role == model.RoleAdmin && helper.GetConfig().MFA.RequireForAdmin && !user.TOTPEnabled
+}
+
+// respondWithMFAChallenge issues the short-lived "mfa pending" token that
+// must be exchanged at /login/mfa, or used to enroll first. Only the latest
+// token of a user can be exchanged.
+func (h *AuthHandler) respondWithMFAChallenge(w http.ResponseWriter, r *http.Request, user *model.User) error {
+	claims := helper.Claims{
+		UserID:       user.ID.Hex(),
+		Username:     user.Username,
+		Role:         user.Role,
+		MFAPending:   true,
+		TokenVersion: user.TokenVersion,
+	}
+	claims.Id = helper.GenerateID()
+	if err := h.users.StartMFAChallenge(r.Context(), user.ID, claims.Id); err != nil {
+		return helper.Internal("Error starting two-factor authentication", err)
+	}
+	tokenString, err := helper.SignToken(claims, mfaPendingTTL)
+	if err != nil {
+		return helper.Internal("Failed to generate token", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"mfaRequired":        true,
+		"enrollmentRequired": !user.TOTPEnabled,
+		"mfaToken":           tokenString,
+		"userId":             user.ID.Hex(),
+	})
+	return nil
+}
+
+// LoginMFAHandler exchanges an "mfa pending" token and a TOTP or recovery
+// code for a regular JWT. Each token is good for one login and
+// mfaMaxFailures wrong codes.
+func (h *AuthHandler) LoginMFAHandler(w http.ResponseWriter, r *http.Request) error {
+	var req LoginMFARequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+
+	claims, err := helper.ParseToken(req.MFAToken)
+	if err != nil || !claims.MFAPending {
+		return helper.Unauthorized("Invalid MFA token").WithCode("mfa_token_invalid")
+	}
+
+	userID, _ := primitive.ObjectIDFromHex(claims.UserID)
+	user, err := h.users.FindByID(r.Context(), userID)
+	if err != nil || user.Disabled || !user.TOTPEnabled {
+		return helper.Unauthorized("Invalid MFA token").WithCode("mfa_token_invalid")
+	}
+	// Like loadTokenUser, reject tokens issued before a revocation
+	if helper.TokenRevoked(claims, user) {
+		return helper.Unauthorized("Invalid MFA token").WithCode("mfa_token_invalid")
+	}
+	if claims.Id == "" || claims.Id != user.MFAChallenge {
+		return helper.Unauthorized("Invalid MFA token").WithCode("mfa_token_invalid")
+	}
+
+	ok, err := h.verifySecondFactor(r.Context(), user, req.Code)
+	if err != nil {
+		return helper.Internal("Error verifying code", err)
+	}
+	if !ok {
+		burned, err := h.users.RecordMFAFailure(r.Context(), user.ID, claims.Id, mfaMaxFailures)
+		if err != nil {
+			return helper.Internal("Error verifying code", err)
+		}
+		if burned {
+			return helper.Unauthorized("Too many invalid codes, log in again").WithCode("mfa_attempts_exceeded")
+		}
+		return helper.Unauthorized("Invalid code").WithCode("mfa_code_invalid")
+	}
+
+	ended, err := h.users.EndMFAChallenge(r.Context(), user.ID, claims.Id)
+	if err != nil {
+		return helper.Internal("Error verifying code", err)
+	}
+	if !ended {
+		// Used or burned by a concurrent request
+		return helper.Unauthorized("Invalid MFA token").WithCode("mfa_token_invalid")
+	}
+
+	return respondWithToken(w, user)
+}
+
+// EnrollTOTP starts enrollment by generating a secret that only becomes
+// active once confirmed with a valid code
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) error {
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabled {
+		return helper.Conflict("Two-factor authentication already enabled")
+	}
+
+	secret, err := helper.GenerateTOTPSecret()
+	if err != nil {
+		return helper.Internal("Error generating secret", err)
+	}
+
+	if err := h.users.SetTOTPPendingSecret(r.Context(), user.ID, secret, time.Now()); err != nil {
+		return helper.Internal("Error saving secret", err)
+	}
+
+	issuer := helper.GetConfig().MFA.Issuer
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{
+		"secret":          secret,
+		"provisioningUri": helper.TOTPProvisioningURI(issuer, user.Username, secret),
+	})
+	return nil
+}
+
+// ConfirmTOTP activates the pending secret and returns the recovery codes,
+// which are only ever shown once
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) error {
+	var req MFACodeRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabled {
+		return helper.Conflict("Two-factor authentication already enabled")
+	}
+	if user.TOTPPendingSecret == "" {
+		return helper.BadRequest("No enrollment in progress")
+	}
+
+	counter, valid := helper.ValidateTOTP(user.TOTPPendingSecret, req.Code, time.Now())
+	if !valid {
+		return helper.Unauthorized("Invalid code").WithCode("mfa_code_invalid")
+	}
+
+	codes, hashes := generateRecoveryCodes()
+	err = h.users.EnableTOTP(r.Context(), user.ID, user.TOTPPendingSecret, counter, hashes, time.Now())
+	if err != nil {
+		return helper.Internal("Error enabling two-factor authentication", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"recoveryCodes": codes})
+	return nil
+}
+
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) error {
+	var req MFACodeRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return helper.BadRequest("Two-factor authentication not enabled")
+	}
+	if user.Role == model.RoleAdmin && helper.GetConfig().MFA.RequireForAdmin {
+		return helper.Forbidden("Two-factor authentication is mandatory for admins")
+	}
+
+	valid, err := h.verifySecondFactor(r.Context(), user, req.Code)
+	if err != nil {
+		return helper.Internal("Error verifying code", err)
+	}
+	if !valid {
+		return helper.Unauthorized("Invalid code").WithCode("mfa_code_invalid")
+	}
+
+	if err := h.users.DisableTOTP(r.Context(), user.ID, false, time.Now()); err != nil {
+		return helper.Internal("Error disabling two-factor authentication", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the current user
+func (h *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	var req MFACodeRequest
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return helper.BadRequest("Two-factor authentication not enabled")
+	}
+
+	valid, err := h.verifySecondFactor(r.Context(), user, req.Code)
+	if err != nil {
+		return helper.Internal("Error verifying code", err)
+	}
+	if !valid {
+		return helper.Unauthorized("Invalid code").WithCode("mfa_code_invalid")
+	}
+
+	codes, hashes := generateRecoveryCodes()
+	if err := h.users.SetRecoveryCodes(r.Context(), user.ID, hashes, time.Now()); err != nil {
+		return helper.Internal("Error saving recovery codes", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]interface{}{"recoveryCodes": codes})
+	return nil
+}
+
+// verifySecondFactor accepts a TOTP code that was not used before, or
+// consumes one of the user's recovery codes
+func (h *AuthHandler) verifySecondFactor(ctx context.Context, user *model.User, code string) (bool, error) {
+	if counter, ok := helper.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		return h.users.AdvanceTOTPCounter(ctx, user.ID, counter)
+	}
+
+	return h.users.ConsumeRecoveryCode(ctx, user.ID, helper.HashToken(normalizeRecoveryCode(code)))
+}
+
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := helper.GenerateID()[:10]
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+		hashes = append(hashes, helper.HashToken(raw))
+	}
+	return codes, hashes
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func (h *AuthHandler) currentUser(r *http.Request) (*model.User, error) {
+	userID, ok := helper.UserIDFromContext(r.Context())
+	if !ok {
+		return nil, helper.ErrTokenMissing
+	}
+
+	user, err := h.users.FindByID(r.Context(), userID)
+	if err != nil {
+		return nil, helper.ErrTokenRevoked
+	}
+	return user, nil
+}
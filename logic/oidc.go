@@ -0,0 +1,310 @@
+package logic
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const authStateTTL = 10 * time.Minute
+
+// externalUsernameAttempts bounds the random usernames tried for a new
+// external user whose preferred usernames are taken
+const externalUsernameAttempts = 3
+
+// authStateCookie binds an authorization flow to the browser that started
+// it. It holds the hash of the state, so a callback forged with someone
+// else's state is rejected.
+const authStateCookie = "webcart_auth_state"
+
+func (h *AuthHandler) getIdentityProvider(name string) (helper.IdentityProvider, bool) {
+	provider, ok := h.providers[name]
+	return provider, ok
+}
+
+func (h *AuthHandler) ListIdentityProviders(w http.ResponseWriter, r *http.Request) error {
+	names := make([]string, 0, len(h.providers))
+	for name := range h.providers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	helper.RespondWithJSON(w, http.StatusOK, map[string][]string{"providers": names})
+	return nil
+}
+
+// ExternalLoginHandler redirects the browser to the identity provider
+func (h *AuthHandler) ExternalLoginHandler(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := h.getIdentityProvider(mux.Vars(r)["provider"])
+	if !ok {
+		return helper.NotFound("Unknown identity provider")
+	}
+
+	authURL, err := h.startAuthorization(w, r, provider, primitive.NilObjectID)
+	if err != nil {
+		helper.LoggerFromContext(r.Context()).Error("Error starting external login", "provider", provider.Name(), "error", err)
+		return helper.NewError(http.StatusBadGateway, helper.CodeBadGateway, "Error starting external login")
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// ExternalLinkHandler starts a flow that links an external identity to the
+// authenticated user. The URL is returned instead of redirected to because
+// the request carries the user's bearer token.
+//
+// The response also sets the cookie that binds the flow to the browser, so
+// cross-origin clients must send the request with credentials, e.g. fetch
+// with credentials: "include" from an origin in runtime.cors with
+// allow_credentials. Without the cookie the callback is rejected.
+func (h *AuthHandler) ExternalLinkHandler(w http.ResponseWriter, r *http.Request) error {
+	provider, ok := h.getIdentityProvider(mux.Vars(r)["provider"])
+	if !ok {
+		return helper.NotFound("Unknown identity provider")
+	}
+
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	authURL, err := h.startAuthorization(w, r, provider, user.ID)
+	if err != nil {
+		helper.LoggerFromContext(r.Context()).Error("Error starting identity link", "provider", provider.Name(), "error", err)
+		return helper.NewError(http.StatusBadGateway, helper.CodeBadGateway, "Error starting external login")
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"authorizationUrl": authURL})
+	return nil
+}
+
+func (h *AuthHandler) startAuthorization(w http.ResponseWriter, r *http.Request, provider helper.IdentityProvider, linkUserID primitive.ObjectID) (string, error) {
+	now := time.Now()
+	authState := model.AuthState{
+		State:        helper.GenerateID(),
+		Provider:     provider.Name(),
+		Nonce:        helper.GenerateID(),
+		CodeVerifier: helper.GeneratePKCEVerifier(),
+		LinkUserID:   linkUserID,
+		Created:      now,
+		Expires:      now.Add(authStateTTL),
+	}
+
+	authURL, err := provider.AuthCodeURL(authState.State, authState.Nonce, helper.PKCEChallenge(authState.CodeVerifier))
+	if err != nil {
+		return "", err
+	}
+
+	if err := h.authStates.Insert(r.Context(), &authState); err != nil {
+		return "", err
+	}
+	setAuthStateCookie(w, r, helper.HashToken(authState.State), int(authStateTTL.Seconds()))
+	return authURL, nil
+}
+
+// setAuthStateCookie sets the state binding cookie, or clears it when
+// maxAge is negative. It must be Lax, not Strict, to be sent on the
+// redirect back from the identity provider.
+func setAuthStateCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     authStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// stateBoundToBrowser reports whether the callback comes from the browser
+// that started the flow with state
+func stateBoundToBrowser(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(authStateCookie)
+	if err != nil || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(helper.HashToken(state))) == 1
+}
+
+// ExternalCallbackHandler completes the authorization-code flow. It either
+// links the identity to the user that started the flow or logs in the user
+// owning the identity, creating an account on first login.
+func (h *AuthHandler) ExternalCallbackHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	provider, ok := h.getIdentityProvider(mux.Vars(r)["provider"])
+	if !ok {
+		return helper.NotFound("Unknown identity provider")
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		return helper.Unauthorized("Authorization failed: " + errCode)
+	}
+
+	if !stateBoundToBrowser(r, query.Get("state")) {
+		return helper.BadRequest("Invalid or expired state")
+	}
+	setAuthStateCookie(w, r, "", -1)
+
+	// States are single use, so consume it before talking to the provider
+	authState, err := h.authStates.Consume(ctx, provider.Name(), query.Get("state"))
+	if err != nil || time.Now().After(authState.Expires) {
+		return helper.BadRequest("Invalid or expired state")
+	}
+
+	identity, err := provider.Exchange(ctx, query.Get("code"), authState.CodeVerifier)
+	if err != nil {
+		helper.LoggerFromContext(r.Context()).Warn("Error exchanging authorization code", "provider", provider.Name(), "error", err)
+		return helper.Unauthorized("External login failed")
+	}
+	if identity.Nonce != authState.Nonce {
+		return helper.Unauthorized("External login failed")
+	}
+
+	owner, err := h.users.FindByIdentity(ctx, identity.Provider, identity.Subject)
+	if err != nil && err != repository.ErrNotFound {
+		return helper.Internal("Error finding user", err)
+	}
+
+	if !authState.LinkUserID.IsZero() {
+		return h.linkIdentity(ctx, w, authState.LinkUserID, owner, identity)
+	}
+
+	if owner == nil {
+		owner, err = h.createExternalUser(ctx, identity)
+		if err != nil {
+			return helper.Internal("Error creating user", err)
+		}
+	}
+
+	return h.completeLogin(w, r, owner)
+}
+
+func (h *AuthHandler) linkIdentity(ctx context.Context, w http.ResponseWriter, userID primitive.ObjectID, owner *model.User, identity *helper.ExternalIdentity) error {
+	if owner != nil {
+		if owner.ID == userID {
+			helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Identity already linked"})
+			return nil
+		}
+		return helper.Conflict("Identity is linked to another account")
+	}
+
+	linked := model.LinkedIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		Linked:   time.Now(),
+	}
+	if err := h.users.AddIdentity(ctx, userID, linked, time.Now()); err != nil {
+		return helper.Internal("Error linking identity", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Identity linked"})
+	return nil
+}
+
+// UnlinkIdentityHandler removes an external identity from the current user
+// as long as the user keeps another way to log in
+func (h *AuthHandler) UnlinkIdentityHandler(w http.ResponseWriter, r *http.Request) error {
+	providerName := mux.Vars(r)["provider"]
+
+	user, err := h.currentUser(r)
+	if err != nil {
+		return err
+	}
+
+	linked := false
+	for _, identity := range user.Identities {
+		if identity.Provider == providerName {
+			linked = true
+		}
+	}
+	if !linked {
+		return helper.NotFound("Identity not linked")
+	}
+	if user.Password == "" && len(user.Identities) <= 1 {
+		return helper.BadRequest("Cannot unlink the only login method")
+	}
+
+	if err := h.users.RemoveIdentity(r.Context(), user.ID, providerName, time.Now()); err != nil {
+		return helper.Internal("Error unlinking identity", err)
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Identity unlinked"})
+	return nil
+}
+
+// createExternalUser registers a password-less user for a first external
+// login. Existing local accounts are never linked implicitly: when the
+// verified email is taken as a username, e.g. by someone who registered it
+// first, the user gets the provider and subject, or a random suffix.
+func (h *AuthHandler) createExternalUser(ctx context.Context, identity *helper.ExternalIdentity) (*model.User, error) {
+	base := identity.Provider + ":" + identity.Subject
+	var usernames []string
+	if identity.Email != "" && identity.EmailVerified {
+		usernames = append(usernames, identity.Email)
+	}
+	usernames = append(usernames, base)
+	for i := 0; i < externalUsernameAttempts; i++ {
+		usernames = append(usernames, base+"-"+helper.GenerateID()[:8])
+	}
+
+	now := time.Now()
+	for _, username := range usernames {
+		user := model.User{
+			ID:       primitive.NewObjectID(),
+			Username: username,
+			Role:     model.RoleUser,
+			Identities: []model.LinkedIdentity{{
+				Provider: identity.Provider,
+				Subject:  identity.Subject,
+				Email:    identity.Email,
+				Linked:   now,
+			}},
+			Created: now,
+		}
+		err := h.users.Create(ctx, &user)
+		if err == repository.ErrDuplicate {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	return nil, fmt.Errorf("no free username for %s", base)
+}
+
+// PurgeExpiredAuthStates returns a background worker that periodically
+// deletes authorization states that were never consumed
+func PurgeExpiredAuthStates(authStates repository.AuthStateRepository) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(authStateTTL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := authStates.DeleteExpired(ctx, time.Now())
+				if err != nil && ctx.Err() == nil {
+					slog.Error("Error purging expired auth states", "error", err)
+				}
+			}
+		}
+	}
+}
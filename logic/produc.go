@@ -2,91 +2,65 @@ package logic
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"math/rand"
 	"net/http"
 	"time"
 
 	"github.com/dianerwansyah/web-cart-backend/helper"
 	"github.com/dianerwansyah/web-cart-backend/model"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func GetProducts() ([]model.Product, error) {
-	collectionName := helper.GetTableName(model.Product{})
-	collection := helper.GetCollection(collectionName)
+// CatalogHandler serves the product and category catalog
+type CatalogHandler struct {
+	products   repository.ProductRepository
+	categories repository.CategoryRepository
+	flags      *helper.FeatureFlags
+}
 
-	cursor, err := collection.Find(context.Background(), bson.M{})
-	if err != nil {
-		log.Printf("Error finding categories: %v", err)
-		return nil, err
-	}
+func NewCatalogHandler(products repository.ProductRepository, categories repository.CategoryRepository, flags *helper.FeatureFlags) *CatalogHandler {
+	return &CatalogHandler{products: products, categories: categories, flags: flags}
+}
 
-	var products []model.Product
-	if err := cursor.All(context.Background(), &products); err != nil {
-		log.Printf("Error decoding categories: %v", err)
-		return nil, err
-	}
-	return products, nil
+func (h *CatalogHandler) GetProducts() ([]model.Product, error) {
+	return h.products.List(context.Background(), 0)
 }
 
 type FilterRequest struct {
-	FilterType string `json:"filtertype"`
-	Limit      int    `json:"limit"`
-	Field      string `json:"field,omitempty"`
+	FilterType string `json:"filtertype" validate:"required"`
+	Limit      int    `json:"limit" validate:"min=0,max=1000"`
+	Field      string `json:"field,omitempty" validate:"omitempty,fieldname"`
 	Value      string `json:"value,omitempty"`
 }
 
-func GetProductsByFilter(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (h *CatalogHandler) GetProductsByFilter(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 
 	var filterRequest FilterRequest
 
 	// Decode JSON request body
-	if err := json.NewDecoder(r.Body).Decode(&filterRequest); err != nil {
-		log.Printf("Error decoding request body: %v", err)
-		helper.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
-		return
+	if err := helper.ParseJSONBody(r, &filterRequest); err != nil {
+		return err
+	}
+	if filterRequest.FilterType != "limit" && filterRequest.Field == "" {
+		return helper.NewError(http.StatusBadRequest, helper.CodeValidationFailed, "Request validation failed").
+			WithField("field", "is required unless filtertype is limit")
 	}
 
-	collectionName := helper.GetTableName(model.Product{})
-	collection := helper.GetCollection(collectionName)
-
-	var cursor *mongo.Cursor
+	var products []model.Product
 	var err error
 
 	if filterRequest.FilterType == "limit" {
 		// Find products with limit if limit is greater than 0
-		if filterRequest.Limit > 0 {
-			options := options.Find().SetLimit(int64(filterRequest.Limit))
-			cursor, err = collection.Find(ctx, bson.M{}, options)
-		} else {
-			// Find all products without limit
-			cursor, err = collection.Find(ctx, bson.M{})
-		}
+		products, err = h.products.List(ctx, filterRequest.Limit)
 	} else {
 		// Filter by specific field and value
-		filter := bson.M{filterRequest.Field: filterRequest.Value}
-		cursor, err = collection.Find(ctx, filter)
+		products, err = h.products.FindByField(ctx, filterRequest.Field, filterRequest.Value)
 	}
 
 	if err != nil {
-		log.Printf("Error finding products: %v", err)
-		helper.RespondWithError(w, http.StatusInternalServerError, "Error finding products")
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var products []model.Product
-	if err := cursor.All(ctx, &products); err != nil {
-		log.Printf("Error decoding products: %v", err)
-		helper.RespondWithError(w, http.StatusInternalServerError, "Error decoding products")
-		return
+		return helper.Internal("Error finding products", err)
 	}
 
 	// Pilih produk secara acak hingga mencapai limit jika limit > 0
@@ -97,10 +71,11 @@ func GetProductsByFilter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	helper.RespondWithJSON(w, http.StatusOK, products)
+	return nil
 }
 
 type UserRequest struct {
-	UserID     string `json:"UserID"`
+	UserID     string `json:"UserID" validate:"required,objectid"`
 	IsCheckout bool   `json:"IsCheckout"`
 	IsConfirm  bool   `json:"IsConfirm"`
 }
@@ -110,45 +85,29 @@ type ProductWithQuantity struct {
 	Quantity int           `json:"Quantity"`
 }
 
-func GetProductsUser(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (h *TrxHandler) GetProductsUser(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 
 	var userRequest UserRequest
 
 	// Decode JSON request body
-	if err := json.NewDecoder(r.Body).Decode(&userRequest); err != nil {
-		log.Printf("Error decoding request body: %v", err)
-		helper.RespondWithError(w, http.StatusBadRequest, "Invalid request payload")
-		return
+	if err := helper.ParseJSONBody(r, &userRequest); err != nil {
+		return err
+	}
+	if err := authorizeUserID(r, userRequest.UserID); err != nil {
+		return err
 	}
 
 	// Get user ID from the request
 	userID, err := primitive.ObjectIDFromHex(userRequest.UserID)
 	if err != nil {
-		log.Printf("Invalid user ID: %v", err)
-		helper.RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
-		return
+		return helper.BadRequest("Invalid user ID")
 	}
 
-	// Create filter for transactions
-	filter := bson.M{"UserID": userID, "IsCheckout": userRequest.IsCheckout}
-
 	// Fetch transactions for the user
-	transactionCollection := helper.GetCollection(helper.GetTableName(model.Cart{}))
-	var transactions []model.Cart
-	cursor, err := transactionCollection.Find(ctx, filter)
+	transactions, err := h.carts.ListByCheckout(ctx, userID, userRequest.IsCheckout)
 	if err != nil {
-		log.Printf("Error finding transactions: %v", err)
-		helper.RespondWithError(w, http.StatusInternalServerError, "Error finding transactions")
-		return
-	}
-	defer cursor.Close(ctx)
-
-	if err := cursor.All(ctx, &transactions); err != nil {
-		log.Printf("Error decoding transactions: %v", err)
-		helper.RespondWithError(w, http.StatusInternalServerError, "Error decoding transactions")
-		return
+		return helper.Internal("Error finding transactions", err)
 	}
 
 	// Create a map to store product quantities
@@ -164,20 +123,9 @@ func GetProductsUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch products based on the extracted product IDs
-	productCollection := helper.GetCollection(helper.GetTableName(model.Product{}))
-	var products []model.Product
-	cursor, err = productCollection.Find(ctx, bson.M{"_id": bson.M{"$in": productIDs}})
+	products, err := h.products.FindByIDs(ctx, productIDs)
 	if err != nil {
-		log.Printf("Error finding products: %v", err)
-		helper.RespondWithError(w, http.StatusInternalServerError, "Error finding products")
-		return
-	}
-	defer cursor.Close(ctx)
-
-	if err := cursor.All(ctx, &products); err != nil {
-		log.Printf("Error decoding products: %v", err)
-		helper.RespondWithError(w, http.StatusInternalServerError, "Error decoding products")
-		return
+		return helper.Internal("Error finding products", err)
 	}
 
 	// Combine products with their quantities
@@ -190,76 +138,70 @@ func GetProductsUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	helper.RespondWithJSON(w, http.StatusOK, productsWithQuantity)
+	return nil
 }
 
 type UpdateCartItemRequest struct {
-	ProductID string `json:"ProductID"`
-	Quantity  int    `json:"Quantity"`
-	UserID    string `json:"UserID"`
+	ProductID string `json:"ProductID" validate:"required,objectid"`
+	Quantity  int    `json:"Quantity" validate:"min=0"`
+	UserID    string `json:"UserID" validate:"required,objectid"`
 }
 
-func UpdateCartItemQuantity(w http.ResponseWriter, r *http.Request) {
+func (h *TrxHandler) UpdateCartItemQuantity(w http.ResponseWriter, r *http.Request) error {
 	var req UpdateCartItemRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+	if err := helper.ParseJSONBody(r, &req); err != nil {
+		return err
+	}
+	if err := authorizeUserID(r, req.UserID); err != nil {
+		return err
 	}
 
 	productID, err := primitive.ObjectIDFromHex(req.ProductID)
 	if err != nil {
-		http.Error(w, "Invalid product ID", http.StatusBadRequest)
-		return
+		return helper.BadRequest("Invalid product ID")
 	}
 
 	userID, err := primitive.ObjectIDFromHex(req.UserID)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		return helper.BadRequest("Invalid user ID")
 	}
 
-	collection := helper.GetCollection(model.Cart{}.TableName())
+	ctx := r.Context()
 
 	// Check if the transaction already exists
-	filter := bson.M{"ProductID": productID, "UserID": userID}
-	var existingTransaction model.Cart
-	err = collection.FindOne(context.Background(), filter).Decode(&existingTransaction)
-	if err != nil && err != mongo.ErrNoDocuments {
-		http.Error(w, "Error checking existing transaction", http.StatusInternalServerError)
-		return
+	existingTransaction, err := h.carts.FindItem(ctx, userID, productID)
+	if err != nil && err != repository.ErrNotFound {
+		return helper.Internal("Error checking existing transaction", err)
 	}
 
 	// If the transaction exists, update it
-	if existingTransaction.ID != primitive.NilObjectID {
+	if existingTransaction != nil {
 		if req.Quantity > 0 {
-			update := bson.M{
-				"$set": bson.M{
-					"Quantity": req.Quantity,
-					"Created":  time.Now(),
-				},
-			}
-			_, err := collection.UpdateOne(context.Background(), filter, update)
+			now := time.Now()
+			err := h.carts.UpdateQuantity(ctx, userID, productID, req.Quantity, now)
 			if err != nil {
-				http.Error(w, "Error updating transaction", http.StatusInternalServerError)
-				return
+				return helper.Internal("Error updating transaction", err)
 			}
 			existingTransaction.Quantity = req.Quantity
-			existingTransaction.Created = time.Now()
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(existingTransaction)
-			return
+			existingTransaction.Created = now
+			helper.RespondWithJSON(w, http.StatusOK, existingTransaction)
+			return nil
 		} else {
-			_, err := collection.DeleteOne(context.Background(), filter)
+			err := h.carts.DeleteItem(ctx, userID, productID)
 			if err != nil {
-				http.Error(w, "Error deleting transaction", http.StatusInternalServerError)
-				return
+				return helper.Internal("Error deleting transaction", err)
 			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(map[string]string{"message": "Transaction deleted"})
-			return
+			helper.RespondWithJSON(w, http.StatusOK, map[string]string{"message": "Transaction deleted"})
+			return nil
 		}
 	}
 
-	// If the transaction does not exist, insert a new one
+	// If the transaction does not exist, insert a new one; there is nothing
+	// to remove for a quantity of 0
+	if req.Quantity == 0 {
+		return helper.NewError(http.StatusBadRequest, helper.CodeValidationFailed, "Invalid request payload").
+			WithField("Quantity", "must be at least 1 for a new cart item")
+	}
 	transaction := model.Cart{
 		ProductID: productID,
 		UserID:    userID,
@@ -267,12 +209,12 @@ func UpdateCartItemQuantity(w http.ResponseWriter, r *http.Request) {
 		Created:   time.Now(),
 	}
 
-	_, err = collection.InsertOne(context.Background(), transaction)
+	err = h.carts.Insert(ctx, &transaction)
 	if err != nil {
-		http.Error(w, "Error saving transaction", http.StatusInternalServerError)
-		return
+		return helper.Internal("Error saving transaction", err)
 	}
+	cartsCreated.Inc()
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(transaction)
+	helper.RespondWithJSON(w, http.StatusOK, transaction)
+	return nil
 }
@@ -0,0 +1,59 @@
+package logic
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const AuditSettingsReloaded = "settings.reloaded"
+
+type SettingsResponse struct {
+	Version         int64             `json:"version"`
+	AppliedAt       time.Time         `json:"appliedAt"`
+	Settings        map[string]string `json:"settings"`
+	LastReloadError string            `json:"lastReloadError,omitempty"`
+}
+
+func settingsResponse(snapshot *helper.SettingsSnapshot) SettingsResponse {
+	return SettingsResponse{
+		Version:         snapshot.Version,
+		AppliedAt:       snapshot.AppliedAt,
+		Settings:        helper.SettingsValues(&snapshot.Settings),
+		LastReloadError: helper.LastReloadError(),
+	}
+}
+
+// GetSettings shows the runtime settings currently in effect
+func (h *AdminHandler) GetSettings(w http.ResponseWriter, r *http.Request) error {
+	helper.RespondWithJSON(w, http.StatusOK, settingsResponse(helper.CurrentSettings()))
+	return nil
+}
+
+// ReloadSettings re-reads the config immediately instead of waiting for the
+// next reload interval
+func (h *AdminHandler) ReloadSettings(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	previous := helper.CurrentSettings()
+	snapshot, err := helper.ReloadSettings()
+	if err != nil {
+		return helper.NewError(http.StatusUnprocessableEntity, "settings_invalid", "Config rejected, previous settings stay in effect").
+			WithField("config", err.Error())
+	}
+
+	if snapshot.Version != previous.Version {
+		err := h.recordAudit(ctx, r, AuditSettingsReloaded, primitive.NilObjectID, map[string]interface{}{
+			"fromVersion": previous.Version,
+			"toVersion":   snapshot.Version,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	helper.RespondWithJSON(w, http.StatusOK, settingsResponse(snapshot))
+	return nil
+}
@@ -0,0 +1,39 @@
+package logic
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/model"
+)
+
+func init() {
+	helper.RegisterValidator("role", validateRole)
+	helper.RegisterValidator("scope", validateScope)
+	helper.RegisterValidator("fieldname", validateFieldName)
+}
+
+func validateRole(field reflect.Value, _ string) string {
+	if model.IsValidRole(field.String()) {
+		return ""
+	}
+	return "must be one of: " + strings.Join(model.ValidRoles, ", ")
+}
+
+func validateScope(field reflect.Value, _ string) string {
+	if model.IsValidScope(field.String()) {
+		return ""
+	}
+	return "must be one of: " + strings.Join(model.ValidScopes, ", ")
+}
+
+// validateFieldName only allows plain document field names in client
+// supplied filters so they cannot inject query operators
+func validateFieldName(field reflect.Value, _ string) string {
+	name := field.String()
+	if name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, "..") {
+		return "must be a document field name"
+	}
+	return ""
+}
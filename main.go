@@ -2,33 +2,96 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
 
 	"github.com/dianerwansyah/web-cart-backend/app/iam"
 	"github.com/dianerwansyah/web-cart-backend/app/setup"
+	"github.com/dianerwansyah/web-cart-backend/app/trx"
 	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/logic"
+	"github.com/dianerwansyah/web-cart-backend/repository"
 )
 
 func main() {
+	// Subcommands come before the config flags, which they accept too
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "audit":
+			os.Exit(runAudit(os.Args[2:]))
+		}
+	}
+
+	cfg, err := helper.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		os.Exit(1)
+	}
+	helper.SetConfig(cfg)
+	helper.SetupLogging(cfg)
+	slog.Info("Starting", "profile", cfg.Profile, "config", cfg)
+
+	shutdownTracing, err := helper.SetupTracing(context.Background(), cfg)
+	if err != nil {
+		slog.Error("Error setting up tracing", "error", err)
+		os.Exit(1)
+	}
+
 	// Inisialisasi klien MongoDB
 	models := helper.GetAllModels()
 	tableNames := helper.GetTableNames(models)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Mongo.ConnectTimeout+cfg.Mongo.ServerSelectionTimeout)
+	db, err := helper.ConnectDB(ctx, cfg)
+	if err == nil {
+		err = db.EnsureCollections(ctx, tableNames)
+	}
+	cancel()
+	if err == nil {
+		ctx, cancel = context.WithTimeout(context.Background(), cfg.Mongo.MigrateTimeout)
+		err = db.Migrate(ctx, cfg)
+		cancel()
+	}
+	if err != nil {
+		slog.Error("Error preparing MongoDB", "error", err)
+		os.Exit(1)
+	}
 
-	cfg := helper.GetConfig()
-	client := helper.InitDB(cfg.Server.MongoURI, tableNames)
+	// Semua service memakai repository yang sama di atas satu klien database
+	repos := repository.NewMongo(db.DB())
+	flags := helper.NewFeatureFlags(repos.Flags)
 
-	defer func() {
-		if err := client.Disconnect(context.Background()); err != nil {
-			log.Fatalf("Error disconnecting from MongoDB: %v", err)
-		}
-	}()
+	lc := helper.NewLifecycle(cfg.HTTP.ShutdownTimeout, cfg.HTTP.DrainDelay)
+	lc.OnShutdown("mongo", db.Close)
+	lc.OnShutdown("tracing", shutdownTracing)
+
+	health := helper.NewHealth()
+	health.AddCheck("mongo", db.Ping)
+	health.AddCheck("indexes", db.CheckIndexes)
+	health.AddCheck("workers", lc.CheckWorkers)
+	lc.OnDrain(health.SetDraining)
 
-	// Simpan klien database ke helper untuk digunakan di seluruh aplikasi
-	helper.SetDBClient(client)
+	// Each service has its own registry, served with the shared process
+	// metrics on its own /metrics
+	iamMetrics := helper.NewMetrics("iam")
+	trxMetrics := helper.NewMetrics("trx", logic.Collectors()...)
+	setupMetrics := helper.NewMetrics("setup")
 
-	go iam.StartServer()
-	go setup.StartServer()
+	lc.AddServer("IAM", iam.NewServer(repos, flags, health, iamMetrics))
+	lc.AddServer("Trx", trx.NewServer(repos, flags, health, trxMetrics))
+	lc.AddServer("Setup", setup.NewServer(repos, flags, health, setupMetrics))
+	lc.AddWorker("auth-state-purge", logic.PurgeExpiredAuthStates(repos.AuthStates))
+	lc.AddWorker("checkout-expiry", logic.ReleaseExpiredCheckouts(repos.Products, repos.Carts))
+	lc.AddWorker("settings-reload", helper.WatchSettings())
 
-	// Prevent the main function from exiting
-	select {}
+	if err := lc.Run(); err != nil {
+		slog.Error("Server stopped with error", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/helper"
+	"github.com/dianerwansyah/web-cart-backend/repository"
+)
+
+const migrateUsage = `usage: webcart migrate <command> [config flags]
+
+commands:
+  status           list migrations and when they were applied
+  up [version]     apply pending migrations, up to version if given
+  down [steps]     revert the latest applied migrations, 1 by default
+`
+
+// runMigrate runs the migrate subcommand and returns the exit code
+func runMigrate(args []string) int {
+	command, number, args, ok := parseMigrateArgs(args)
+	if !ok {
+		fmt.Fprint(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	return withDatabase(args, migrateUsage, func(ctx context.Context, db *helper.Database) int {
+		migrator := db.Migrator()
+		var done []repository.Migration
+		var err error
+		switch command {
+		case "status":
+			statuses, err := migrator.Status(ctx)
+			if err != nil {
+				slog.Error("Error reading migrations", "error", err)
+				return 1
+			}
+			printMigrations(os.Stdout, statuses)
+			return 0
+		case "up":
+			done, err = migrator.Up(ctx, number)
+		case "down":
+			done, err = migrator.Down(ctx, number)
+		}
+
+		msg := "Migration applied"
+		if command == "down" {
+			msg = "Migration reverted"
+		}
+		for _, migration := range done {
+			slog.Info(msg, "version", migration.Version, "name", migration.Name)
+		}
+		if err != nil {
+			slog.Error("Migration failed", "error", err)
+			return 1
+		}
+		if len(done) == 0 {
+			slog.Info("Nothing to migrate")
+		}
+		return 0
+	})
+}
+
+// parseMigrateArgs splits the arguments of migrate into the command, its
+// number and the config flags. The number of down defaults to 1 step.
+func parseMigrateArgs(args []string) (command string, number int, flags []string, ok bool) {
+	if len(args) == 0 {
+		return "", 0, nil, false
+	}
+	command, flags = args[0], args[1:]
+	if command != "status" && command != "up" && command != "down" {
+		return "", 0, nil, false
+	}
+
+	// An optional number follows the command, then the config flags
+	if len(flags) > 0 && (!strings.HasPrefix(flags[0], "-") || isNumber(flags[0])) {
+		n, err := strconv.Atoi(flags[0])
+		if err != nil || n < 1 || command == "status" {
+			return "", 0, nil, false
+		}
+		number, flags = n, flags[1:]
+	}
+	if command == "down" && number == 0 {
+		number = 1
+	}
+	return command, number, flags, true
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func printMigrations(w io.Writer, statuses []repository.MigrationStatus) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for _, status := range statuses {
+		applied := "pending"
+		if !status.Applied.IsZero() {
+			applied = status.Applied.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+	}
+	tw.Flush()
+}
+
+// withDatabase loads the config from the flags of a subcommand, connects
+// to MongoDB and runs the command, returning its exit code
+func withDatabase(args []string, usage string, run func(ctx context.Context, db *helper.Database) int) int {
+	cfg, err := helper.LoadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(os.Stderr, usage)
+		return 0
+	}
+	if err != nil {
+		slog.Error("Error loading config", "error", err)
+		return 1
+	}
+	helper.SetConfig(cfg)
+	helper.SetupLogging(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Mongo.ConnectTimeout+cfg.Mongo.ServerSelectionTimeout+cfg.Mongo.MigrateTimeout)
+	defer cancel()
+	db, err := helper.ConnectDB(ctx, cfg)
+	if err != nil {
+		slog.Error("Error connecting to MongoDB", "error", err)
+		return 1
+	}
+	defer db.Close(context.Background())
+	return run(ctx, db)
+}
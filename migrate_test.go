@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMigrateArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		command string
+		number  int
+		flags   []string
+		ok      bool
+	}{
+		{"no command", nil, "", 0, nil, false},
+		{"flag instead of command", []string{"--profile=test"}, "", 0, nil, false},
+		{"unknown command", []string{"redo"}, "", 0, nil, false},
+		{"status", []string{"status"}, "status", 0, []string{}, true},
+		{"status with a number", []string{"status", "2"}, "", 0, nil, false},
+		{"up to the latest", []string{"up"}, "up", 0, []string{}, true},
+		{"up to a version", []string{"up", "3"}, "up", 3, []string{}, true},
+		{"up to version zero", []string{"up", "0"}, "", 0, nil, false},
+		{"up to a name", []string{"up", "schema_validators"}, "", 0, nil, false},
+		{"down one step by default", []string{"down"}, "down", 1, []string{}, true},
+		{"down by steps", []string{"down", "2"}, "down", 2, []string{}, true},
+		{"down by negative steps", []string{"down", "-1"}, "", 0, nil, false},
+		{"config flags", []string{"up", "2", "--profile", "test", "--mongo.migrate_timeout=1m"},
+			"up", 2, []string{"--profile", "test", "--mongo.migrate_timeout=1m"}, true},
+		{"config flags without a number", []string{"down", "--profile=test"}, "down", 1, []string{"--profile=test"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, number, flags, ok := parseMigrateArgs(tt.args)
+			if ok != tt.ok || command != tt.command || number != tt.number || !reflect.DeepEqual(flags, tt.flags) {
+				t.Fatalf("parseMigrateArgs(%q) = %q, %d, %q, %v; want %q, %d, %q, %v",
+					tt.args, command, number, flags, ok, tt.command, tt.number, tt.flags, tt.ok)
+			}
+		})
+	}
+
+	if code := runMigrate([]string{"redo"}); code != 2 {
+		t.Fatalf("runMigrate with an unknown command exited with %d, want 2", code)
+	}
+}
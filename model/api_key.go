@@ -0,0 +1,69 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeOrdersRead    = "orders:read"
+	ScopeOrdersWrite   = "orders:write"
+	ScopeCartsRead     = "carts:read"
+	ScopeCartsWrite    = "carts:write"
+	ScopeUsersRead     = "users:read"
+	ScopeUsersWrite    = "users:write"
+	ScopeMetricsRead   = "metrics:read"
+)
+
+// ValidScopes lists the scopes that can be granted to an API key
+var ValidScopes = []string{
+	ScopeProductsRead,
+	ScopeProductsWrite,
+	ScopeOrdersRead,
+	ScopeOrdersWrite,
+	ScopeCartsRead,
+	ScopeCartsWrite,
+	ScopeUsersRead,
+	ScopeUsersWrite,
+	ScopeMetricsRead,
+}
+
+// APIKey authenticates a server-to-server integration. Only the SHA-256 hash
+// of the key is stored; Prefix identifies the key in listings.
+type APIKey struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name        string             `bson:"Name" json:"Name"`
+	Prefix      string             `bson:"Prefix" json:"Prefix"`
+	KeyHash     string             `bson:"KeyHash" json:"-"`
+	Scopes      []string           `bson:"Scopes" json:"Scopes"`
+	CreatedByID primitive.ObjectID `bson:"CreatedByID" json:"CreatedByID"`
+	Created     time.Time          `bson:"Created" json:"Created"`
+	ExpiresAt   time.Time          `bson:"ExpiresAt,omitempty" json:"ExpiresAt,omitempty"`
+	LastUsed    time.Time          `bson:"LastUsed,omitempty" json:"LastUsed,omitempty"`
+	Revoked     bool               `bson:"Revoked" json:"Revoked"`
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidScope(scope string) bool {
+	for _, s := range ValidScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
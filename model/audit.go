@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type AuditLog struct {
+	ID            primitive.ObjectID     `bson:"_id,omitempty" json:"id,omitempty"`
+	ActorID       primitive.ObjectID     `bson:"ActorID" json:"ActorID"`
+	ActorUsername string                 `bson:"ActorUsername" json:"ActorUsername"`
+	Action        string                 `bson:"Action" json:"Action"`
+	TargetID      primitive.ObjectID     `bson:"TargetID,omitempty" json:"TargetID,omitempty"`
+	Details       map[string]interface{} `bson:"Details,omitempty" json:"Details,omitempty"`
+	RemoteAddr    string                 `bson:"RemoteAddr" json:"RemoteAddr"`
+	Created       time.Time              `bson:"Created" json:"Created"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_logs"
+}
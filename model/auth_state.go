@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuthState keeps the PKCE verifier and nonce of a pending external login
+// between the authorization request and the provider callback
+type AuthState struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	State        string             `bson:"state" json:"state"`
+	Provider     string             `bson:"provider" json:"provider"`
+	Nonce        string             `bson:"nonce" json:"nonce"`
+	CodeVerifier string             `bson:"code_verifier" json:"-"`
+	LinkUserID   primitive.ObjectID `bson:"link_user_id,omitempty" json:"link_user_id,omitempty"`
+	Created      time.Time          `bson:"created" json:"created"`
+	Expires      time.Time          `bson:"expires" json:"expires"`
+}
+
+func (AuthState) TableName() string {
+	return "auth_states"
+}
@@ -8,9 +8,9 @@ import (
 
 type Cart struct {
 	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	ProductID  primitive.ObjectID `bson:"ProductID" json:"ProductID"`
-	UserID     primitive.ObjectID `bson:"UserID" json:"UserID"`
-	Quantity   int                `bson:"Quantity" json:"Quantity"`
+	ProductID  primitive.ObjectID `bson:"ProductID" json:"ProductID" schema:"required"`
+	UserID     primitive.ObjectID `bson:"UserID" json:"UserID" schema:"required"`
+	Quantity   int                `bson:"Quantity" json:"Quantity" schema:"required,min=1"`
 	IsCheckout bool               `bson:"IsCheckout" json:"IsCheckout"`
 	IsConfirm  bool               `bson:"IsConfirm" json:"IsConfirm"`
 	Created    time.Time          `bson:"Created" json:"Created"`
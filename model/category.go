@@ -8,7 +8,7 @@ import (
 
 type Category struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Name           string             `bson:"name" json:"name"`
+	Name           string             `bson:"name" json:"name" schema:"required,minLength=1"`
 	Description    string             `bson:"description" json:"description"`
 	Created        time.Time          `bson:"created" json:"created"`
 	LastUpdate     time.Time          `bson:"last_update" json:"last_update"`
@@ -8,8 +8,8 @@ import (
 
 type Coupon struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	UserID      primitive.ObjectID `bson:"UserID" json:"UserID"`
-	Amount      int                `bson:"Amount" json:"Amount"`
+	UserID      primitive.ObjectID `bson:"UserID" json:"UserID" schema:"required"`
+	Amount      int                `bson:"Amount" json:"Amount" schema:"min=0"`
 	Created     time.Time          `bson:"Created" json:"Created"`
 	LastUpdated time.Time          `bson:"LastUpdated" json:"LastUpdated"`
 }
@@ -0,0 +1,42 @@
+package model
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	FlagTypeBoolean = "boolean"
+	FlagTypeVariant = "variant"
+)
+
+// FlagVariant is one value of a variant flag. Users in the rollout are
+// spread over the variants in proportion to their weights.
+type FlagVariant struct {
+	Name   string `bson:"Name" json:"name" validate:"required,max=64"`
+	Weight int    `bson:"Weight" json:"weight" validate:"min=1,max=1000"`
+}
+
+// FeatureFlag is on for a user when it is enabled and the user is targeted
+// by ID or role, or falls into the first Percentage of the rollout buckets.
+// Everyone else gets OffVariant.
+type FeatureFlag struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Key             string             `bson:"Key" json:"key"`
+	Description     string             `bson:"Description" json:"description"`
+	Type            string             `bson:"Type" json:"type"`
+	Enabled         bool               `bson:"Enabled" json:"enabled"`
+	UserIDs         []string           `bson:"UserIDs" json:"userIds"`
+	Roles           []string           `bson:"Roles" json:"roles"`
+	Percentage      int                `bson:"Percentage" json:"percentage"`
+	Variants        []FlagVariant      `bson:"Variants,omitempty" json:"variants,omitempty"`
+	OffVariant      string             `bson:"OffVariant,omitempty" json:"offVariant,omitempty"`
+	Created         time.Time          `bson:"Created" json:"created"`
+	LastUpdated     time.Time          `bson:"LastUpdated" json:"lastUpdated"`
+	LastUpdatedByID primitive.ObjectID `bson:"LastUpdatedByID,omitempty" json:"lastUpdatedById,omitempty"`
+}
+
+func (FeatureFlag) TableName() string {
+	return "feature_flags"
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// IdempotencyRecord remembers a request sent with an Idempotency-Key and,
+// once it completed, its response, so that retries get the same answer
+// instead of running the request again
+type IdempotencyRecord struct {
+	// Key is the client key prefixed with the subject that sent it
+	Key string `bson:"_id" json:"key"`
+	// Fingerprint is a hash of the method, path and body of the request
+	Fingerprint string    `bson:"fingerprint" json:"fingerprint"`
+	Completed   bool      `bson:"completed" json:"completed"`
+	Status      int       `bson:"status,omitempty" json:"status,omitempty"`
+	ContentType string    `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty" json:"-"`
+	Created     time.Time `bson:"created" json:"created"`
+	Expires     time.Time `bson:"expires" json:"expires"`
+}
+
+func (IdempotencyRecord) TableName() string {
+	return "idempotency_keys"
+}
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// Migration records a schema migration applied to the database
+type Migration struct {
+	Version int       `bson:"_id" json:"version"`
+	Name    string    `bson:"name" json:"name"`
+	Applied time.Time `bson:"applied" json:"applied"`
+}
+
+func (Migration) TableName() string {
+	return "migrations"
+}
@@ -8,11 +8,11 @@ import (
 
 type Product struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Name           string             `bson:"Name" json:"Name"`
+	Name           string             `bson:"Name" json:"Name" schema:"required,minLength=1"`
 	Description    string             `bson:"Description" json:"Description"`
-	Price          float64            `bson:"Price" json:"Price"`
+	Price          float64            `bson:"Price" json:"Price" schema:"required,min=0"`
 	ImageURL       string             `bson:"ImageURL" json:"ImageURL"`
-	Stock          int                `bson:"Stock" json:"Stock"`
+	Stock          int                `bson:"Stock" json:"Stock" schema:"required,min=0"`
 	CategoryID     []string           `bson:"CategoryID" json:"CategoryID"`
 	Created        time.Time          `bson:"Created" json:"Created"`
 	LastUpdate     time.Time          `bson:"LastUpdate" json:"LastUpdate"`
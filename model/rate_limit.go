@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// RateLimitBucket is the token bucket of one client under one rate limit
+// policy. Buckets expire once they would be full again.
+type RateLimitBucket struct {
+	Key     string    `bson:"_id" json:"key"`
+	Tokens  float64   `bson:"tokens" json:"tokens"`
+	Updated time.Time `bson:"updated" json:"updated"`
+	Expires time.Time `bson:"expires" json:"expires"`
+}
+
+func (RateLimitBucket) TableName() string {
+	return "rate_limits"
+}
@@ -6,16 +6,59 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// ValidRoles lists the roles an admin may assign to a user
+var ValidRoles = []string{RoleAdmin, RoleUser}
+
 type User struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Username string             `bson:"username" json:"username"`
-	Password string             `bson:"password" json:"password"`
-	Role     string             `bson:"role" json:"role"`
-	Created  time.Time          `bson:"created" json:"created"`
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Username          string             `bson:"username" json:"username" schema:"required,minLength=1"`
+	Password          string             `bson:"password" json:"-"`
+	Role              string             `bson:"role" json:"role" schema:"required,enum=admin|user"`
+	Disabled          bool               `bson:"disabled" json:"disabled"`
+	MustResetPassword bool               `bson:"must_reset_password" json:"must_reset_password"`
+	ResetTokenHash    string             `bson:"reset_token_hash,omitempty" json:"-"`
+	ResetTokenExpiry  time.Time          `bson:"reset_token_expiry,omitempty" json:"-"`
+	TokensValidAfter  time.Time          `bson:"tokens_valid_after,omitempty" json:"-"`
+	TokenVersion      int                `bson:"token_version,omitempty" json:"-"`
+	TOTPEnabled       bool               `bson:"totp_enabled" json:"totp_enabled"`
+	TOTPSecret        string             `bson:"totp_secret,omitempty" json:"-"`
+	TOTPPendingSecret string             `bson:"totp_pending_secret,omitempty" json:"-"`
+	TOTPLastCounter   int64              `bson:"totp_last_counter,omitempty" json:"-"`
+	RecoveryCodes     []string           `bson:"recovery_codes,omitempty" json:"-"`
+	MFAChallenge      string             `bson:"mfa_challenge,omitempty" json:"-"`
+	MFAFailures       int                `bson:"mfa_failures,omitempty" json:"-"`
+	Identities        []LinkedIdentity   `bson:"identities,omitempty" json:"identities,omitempty"`
+	Created           time.Time          `bson:"created" json:"created"`
+	LastUpdate        time.Time          `bson:"last_update,omitempty" json:"last_update,omitempty"`
+}
+
+// LinkedIdentity links a user to an account at an external identity provider
+type LinkedIdentity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	Linked   time.Time `bson:"linked" json:"linked"`
+}
+
+func (User) TableName() string {
+	return "users"
+}
+
+func IsValidRole(role string) bool {
+	for _, r := range ValidRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 type Credentials struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Role     string `json:"role,omitempty"`
+	Username string `json:"username" validate:"required,max=64"`
+	Password string `json:"password" validate:"required,max=72"`
 }
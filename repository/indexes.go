@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Index is an index the Mongo repositories rely on for lookups or for
+// uniqueness
+type Index struct {
+	Collection string
+	Name       string
+	Keys       bson.D
+	Unique     bool
+	// Partial limits the index to matching documents, e.g. users that
+	// have linked identities
+	Partial bson.M
+	// Expires makes the index a TTL index that removes documents once the
+	// date in the indexed field has passed
+	Expires bool
+}
+
+// RequiredIndexes lists every index the Mongo repositories need. A new one
+// also needs a migration that creates it, see Migrations.
+func RequiredIndexes() []Index {
+	return []Index{
+		{Collection: model.User{}.TableName(), Name: "username_unique", Keys: bson.D{{Key: "username", Value: 1}}, Unique: true},
+		{
+			Collection: model.User{}.TableName(),
+			Name:       "identity_unique",
+			Keys:       bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Unique:     true,
+			Partial:    bson.M{"identities.subject": bson.M{"$exists": true}},
+		},
+		{Collection: model.APIKey{}.TableName(), Name: "prefix_unique", Keys: bson.D{{Key: "Prefix", Value: 1}}, Unique: true},
+		{Collection: model.AuthState{}.TableName(), Name: "provider_state_unique", Keys: bson.D{{Key: "provider", Value: 1}, {Key: "state", Value: 1}}, Unique: true},
+		{Collection: model.FeatureFlag{}.TableName(), Name: "key_unique", Keys: bson.D{{Key: "Key", Value: 1}}, Unique: true},
+		{Collection: model.Cart{}.TableName(), Name: "user_product", Keys: bson.D{{Key: "UserID", Value: 1}, {Key: "ProductID", Value: 1}}},
+		{Collection: model.History{}.TableName(), Name: "user_created", Keys: bson.D{{Key: "UserID", Value: 1}, {Key: "Created", Value: -1}}},
+		{Collection: model.Coupon{}.TableName(), Name: "user", Keys: bson.D{{Key: "UserID", Value: 1}}},
+		{Collection: model.AuditLog{}.TableName(), Name: "created", Keys: bson.D{{Key: "Created", Value: -1}}},
+		{Collection: model.RateLimitBucket{}.TableName(), Name: "expires_ttl", Keys: bson.D{{Key: "expires", Value: 1}}, Expires: true},
+		{Collection: model.IdempotencyRecord{}.TableName(), Name: "expires_ttl", Keys: bson.D{{Key: "expires", Value: 1}}, Expires: true},
+	}
+}
+
+func (i Index) model() mongo.IndexModel {
+	opts := options.Index().SetName(i.Name)
+	if i.Unique {
+		opts.SetUnique(true)
+	}
+	if i.Partial != nil {
+		opts.SetPartialFilterExpression(i.Partial)
+	}
+	if i.Expires {
+		opts.SetExpireAfterSeconds(0)
+	}
+	return mongo.IndexModel{Keys: i.Keys, Options: opts}
+}
+
+// createIndexes creates the indexes that do not exist yet. It fails if
+// existing documents violate a unique index.
+func createIndexes(ctx context.Context, db *mongo.Database, indexes []Index) error {
+	for _, index := range indexes {
+		_, err := db.Collection(index.Collection).Indexes().CreateOne(ctx, index.model())
+		if err != nil {
+			return fmt.Errorf("create index %s.%s: %w", index.Collection, index.Name, err)
+		}
+	}
+	return nil
+}
+
+func dropIndexes(ctx context.Context, db *mongo.Database, indexes []Index) error {
+	for _, index := range indexes {
+		_, err := db.Collection(index.Collection).Indexes().DropOne(ctx, index.Name)
+		if err := ignoreNamespaceErrors(err); err != nil {
+			return fmt.Errorf("drop index %s.%s: %w", index.Collection, index.Name, err)
+		}
+	}
+	return nil
+}
+
+// MissingIndexes returns the required indexes that do not exist, as
+// collection.name
+func MissingIndexes(ctx context.Context, db *mongo.Database) ([]string, error) {
+	existing := map[string]map[string]bool{}
+	var missing []string
+	for _, index := range RequiredIndexes() {
+		names, ok := existing[index.Collection]
+		if !ok {
+			specs, err := db.Collection(index.Collection).Indexes().ListSpecifications(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("list indexes of %s: %w", index.Collection, err)
+			}
+			names = map[string]bool{}
+			for _, spec := range specs {
+				names[spec.Name] = true
+			}
+			existing[index.Collection] = names
+		}
+		if !names[index.Name] {
+			missing = append(missing, index.Collection+"."+index.Name)
+		}
+	}
+	return missing, nil
+}
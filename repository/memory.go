@@ -0,0 +1,950 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemory returns empty repositories that keep everything in process
+// memory. They are meant for tests and local experiments.
+func NewMemory() *Repositories {
+	return &Repositories{
+		Products:    &MemoryProducts{items: map[primitive.ObjectID]model.Product{}},
+		Categories:  &MemoryCategories{items: map[primitive.ObjectID]model.Category{}},
+		Carts:       &memoryCarts{items: map[primitive.ObjectID]model.Cart{}},
+		Orders:      &memoryOrders{},
+		Coupons:     &memoryCoupons{items: map[primitive.ObjectID]model.Coupon{}},
+		Users:       &memoryUsers{items: map[primitive.ObjectID]model.User{}},
+		APIKeys:     &memoryAPIKeys{items: map[primitive.ObjectID]model.APIKey{}},
+		AuditLogs:   &memoryAuditLogs{},
+		AuthStates:  &memoryAuthStates{items: map[string]model.AuthState{}},
+		Flags:       &memoryFlags{items: map[string]model.FeatureFlag{}},
+		RateLimits:  &memoryRateLimits{items: map[string]model.RateLimitBucket{}},
+		Idempotency: &memoryIdempotency{items: map[string]model.IdempotencyRecord{}},
+	}
+}
+
+func paginate[T any](items []T, page Page) []T {
+	if page.Skip >= int64(len(items)) {
+		return []T{}
+	}
+	items = items[page.Skip:]
+	if page.Limit > 0 && page.Limit < int64(len(items)) {
+		items = items[:page.Limit]
+	}
+	return items
+}
+
+// MemoryProducts is the in-memory ProductRepository. Add seeds it.
+type MemoryProducts struct {
+	mu    sync.Mutex
+	items map[primitive.ObjectID]model.Product
+	order []primitive.ObjectID
+}
+
+// Add stores product, assigning an ID if it has none
+func (m *MemoryProducts) Add(product model.Product) model.Product {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if product.ID.IsZero() {
+		product.ID = primitive.NewObjectID()
+	}
+	if _, exists := m.items[product.ID]; !exists {
+		m.order = append(m.order, product.ID)
+	}
+	m.items[product.ID] = product
+	return product
+}
+
+func (m *MemoryProducts) List(ctx context.Context, limit int) ([]model.Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	products := []model.Product{}
+	for _, id := range m.order {
+		if limit > 0 && len(products) == limit {
+			break
+		}
+		products = append(products, cloneProduct(m.items[id]))
+	}
+	return products, nil
+}
+
+func (m *MemoryProducts) FindByField(ctx context.Context, field, value string) ([]model.Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	products := []model.Product{}
+	for _, id := range m.order {
+		matched, err := fieldMatches(m.items[id], field, value)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			products = append(products, cloneProduct(m.items[id]))
+		}
+	}
+	return products, nil
+}
+
+// fieldMatches mimics a Mongo equality filter on a top-level field,
+// including matching any element of an array field
+func fieldMatches(doc interface{}, field, value string) (bool, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return false, err
+	}
+
+	switch v := fields[field].(type) {
+	case string:
+		return v == value, nil
+	case bson.A:
+		for _, element := range v {
+			if s, ok := element.(string); ok && s == value {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryProducts) FindByID(ctx context.Context, id primitive.ObjectID) (*model.Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	product, ok := m.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	product = cloneProduct(product)
+	return &product, nil
+}
+
+func (m *MemoryProducts) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]model.Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wanted := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	products := []model.Product{}
+	for _, id := range m.order {
+		if wanted[id] {
+			products = append(products, cloneProduct(m.items[id]))
+		}
+	}
+	return products, nil
+}
+
+func (m *MemoryProducts) DecrementStock(ctx context.Context, id primitive.ObjectID, quantity int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	product, ok := m.items[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if product.Stock < quantity {
+		return ErrInsufficientStock
+	}
+	product.Stock -= quantity
+	m.items[id] = product
+	return nil
+}
+
+func (m *MemoryProducts) IncrementStock(ctx context.Context, id primitive.ObjectID, quantity int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	product, ok := m.items[id]
+	if !ok {
+		return ErrNotFound
+	}
+	product.Stock += quantity
+	m.items[id] = product
+	return nil
+}
+
+func cloneProduct(product model.Product) model.Product {
+	product.CategoryID = append([]string(nil), product.CategoryID...)
+	return product
+}
+
+// MemoryCategories is the in-memory CategoryRepository. Add seeds it.
+type MemoryCategories struct {
+	mu    sync.Mutex
+	items map[primitive.ObjectID]model.Category
+	order []primitive.ObjectID
+}
+
+// Add stores category, assigning an ID if it has none
+func (m *MemoryCategories) Add(category model.Category) model.Category {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if category.ID.IsZero() {
+		category.ID = primitive.NewObjectID()
+	}
+	if _, exists := m.items[category.ID]; !exists {
+		m.order = append(m.order, category.ID)
+	}
+	m.items[category.ID] = category
+	return category
+}
+
+func (m *MemoryCategories) List(ctx context.Context) ([]model.Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	categories := []model.Category{}
+	for _, id := range m.order {
+		categories = append(categories, m.items[id])
+	}
+	return categories, nil
+}
+
+func (m *MemoryCategories) FindByID(ctx context.Context, id primitive.ObjectID) (*model.Category, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	category, ok := m.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &category, nil
+}
+
+type memoryCarts struct {
+	mu    sync.Mutex
+	items map[primitive.ObjectID]model.Cart
+}
+
+// list returns the items accepted by match, newest first
+func (m *memoryCarts) list(match func(model.Cart) bool) []model.Cart {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	items := []model.Cart{}
+	for _, item := range m.items {
+		if match(item) {
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Created.After(items[j].Created) })
+	return items
+}
+
+func (m *memoryCarts) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]model.Cart, error) {
+	return m.list(func(item model.Cart) bool { return item.UserID == userID }), nil
+}
+
+func (m *memoryCarts) ListByCheckout(ctx context.Context, userID primitive.ObjectID, isCheckout bool) ([]model.Cart, error) {
+	return m.list(func(item model.Cart) bool {
+		return item.UserID == userID && item.IsCheckout == isCheckout
+	}), nil
+}
+
+func isConfirmed(item model.Cart, userID primitive.ObjectID) bool {
+	return item.UserID == userID && item.IsCheckout && item.IsConfirm
+}
+
+func (m *memoryCarts) ListConfirmed(ctx context.Context, userID primitive.ObjectID) ([]model.Cart, error) {
+	return m.list(func(item model.Cart) bool { return isConfirmed(item, userID) }), nil
+}
+
+func (m *memoryCarts) DeleteConfirmed(ctx context.Context, userID primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, item := range m.items {
+		if isConfirmed(item, userID) {
+			delete(m.items, id)
+		}
+	}
+	return nil
+}
+
+// find returns the ID of the user's item for the product. The caller must
+// hold m.mu.
+func (m *memoryCarts) find(userID, productID primitive.ObjectID) (primitive.ObjectID, bool) {
+	for id, item := range m.items {
+		if item.UserID == userID && item.ProductID == productID {
+			return id, true
+		}
+	}
+	return primitive.NilObjectID, false
+}
+
+func (m *memoryCarts) FindItem(ctx context.Context, userID, productID primitive.ObjectID) (*model.Cart, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.find(userID, productID)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	item := m.items[id]
+	return &item, nil
+}
+
+func (m *memoryCarts) Insert(ctx context.Context, item *model.Cart) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if item.ID.IsZero() {
+		item.ID = primitive.NewObjectID()
+	}
+	m.items[item.ID] = *item
+	return nil
+}
+
+func (m *memoryCarts) Upsert(ctx context.Context, item model.Cart) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.find(item.UserID, item.ProductID)
+	if !ok {
+		id = primitive.NewObjectID()
+	}
+	item.ID = id
+	m.items[id] = item
+	return nil
+}
+
+func (m *memoryCarts) UpdateQuantity(ctx context.Context, userID, productID primitive.ObjectID, quantity int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, ok := m.find(userID, productID); ok {
+		item := m.items[id]
+		item.Quantity = quantity
+		item.Created = at
+		m.items[id] = item
+	}
+	return nil
+}
+
+func (m *memoryCarts) DeleteItem(ctx context.Context, userID, productID primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, ok := m.find(userID, productID); ok {
+		delete(m.items, id)
+	}
+	return nil
+}
+
+func isExpiredCheckout(item model.Cart, before time.Time) bool {
+	return item.IsCheckout && !item.IsConfirm && item.Created.Before(before)
+}
+
+func (m *memoryCarts) ListExpiredCheckouts(ctx context.Context, before time.Time) ([]model.Cart, error) {
+	return m.list(func(item model.Cart) bool { return isExpiredCheckout(item, before) }), nil
+}
+
+func (m *memoryCarts) DeleteExpiredCheckout(ctx context.Context, id primitive.ObjectID, before time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[id]
+	if !ok || !isExpiredCheckout(item, before) {
+		return false, nil
+	}
+	delete(m.items, id)
+	return true, nil
+}
+
+type memoryOrders struct {
+	mu    sync.Mutex
+	items []model.History
+}
+
+func (m *memoryOrders) InsertMany(ctx context.Context, items []model.History) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, item := range items {
+		if item.ID.IsZero() {
+			item.ID = primitive.NewObjectID()
+		}
+		m.items = append(m.items, item)
+	}
+	return nil
+}
+
+func (m *memoryOrders) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]model.History, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	items := []model.History{}
+	for _, item := range m.items {
+		if item.UserID == userID {
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Created.After(items[j].Created) })
+	return items, nil
+}
+
+type memoryCoupons struct {
+	mu    sync.Mutex
+	items map[primitive.ObjectID]model.Coupon // keyed by user ID
+}
+
+func (m *memoryCoupons) FindByUser(ctx context.Context, userID primitive.ObjectID) (*model.Coupon, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	coupon, ok := m.items[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &coupon, nil
+}
+
+func (m *memoryCoupons) AddAmount(ctx context.Context, userID primitive.ObjectID, amount int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	coupon, ok := m.items[userID]
+	if !ok {
+		coupon = model.Coupon{ID: primitive.NewObjectID(), UserID: userID, Created: at}
+	}
+	coupon.Amount += amount
+	coupon.LastUpdated = at
+	m.items[userID] = coupon
+	return nil
+}
+
+type memoryUsers struct {
+	mu    sync.Mutex
+	items map[primitive.ObjectID]model.User
+}
+
+func cloneUser(user model.User) *model.User {
+	user.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	user.Identities = append([]model.LinkedIdentity(nil), user.Identities...)
+	return &user
+}
+
+// findUser returns a copy of the first user accepted by match
+func (m *memoryUsers) findUser(match func(model.User) bool) (*model.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.items {
+		if match(user) {
+			return cloneUser(user), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// update applies change to the stored user with id
+func (m *memoryUsers) update(id primitive.ObjectID, change func(user *model.User)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.items[id]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := cloneUser(user)
+	change(updated)
+	m.items[id] = *updated
+	return nil
+}
+
+func (m *memoryUsers) FindByID(ctx context.Context, id primitive.ObjectID) (*model.User, error) {
+	return m.findUser(func(user model.User) bool { return user.ID == id })
+}
+
+func (m *memoryUsers) FindByUsername(ctx context.Context, username string) (*model.User, error) {
+	return m.findUser(func(user model.User) bool { return user.Username == username })
+}
+
+func (m *memoryUsers) FindByIdentity(ctx context.Context, provider, subject string) (*model.User, error) {
+	return m.findUser(func(user model.User) bool {
+		for _, identity := range user.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (m *memoryUsers) Search(ctx context.Context, filter UserFilter, page Page) ([]model.User, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	query := strings.ToLower(filter.Query)
+	users := []model.User{}
+	for _, user := range m.items {
+		if query != "" && !strings.Contains(strings.ToLower(user.Username), query) {
+			continue
+		}
+		if filter.Role != "" && user.Role != filter.Role {
+			continue
+		}
+		if filter.Disabled != nil && user.Disabled != *filter.Disabled {
+			continue
+		}
+		users = append(users, *cloneUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return paginate(users, page), int64(len(users)), nil
+}
+
+func (m *memoryUsers) Create(ctx context.Context, user *model.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.items {
+		if existing.Username == user.Username {
+			return ErrDuplicate
+		}
+	}
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	if _, exists := m.items[user.ID]; exists {
+		return fmt.Errorf("user %s: %w", user.ID.Hex(), ErrDuplicate)
+	}
+	m.items[user.ID] = *cloneUser(*user)
+	return nil
+}
+
+func (m *memoryUsers) UpdateRole(ctx context.Context, id primitive.ObjectID, role string, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.Role = role
+		user.LastUpdate = at
+	})
+}
+
+func (m *memoryUsers) SetDisabled(ctx context.Context, id primitive.ObjectID, disabled bool, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.Disabled = disabled
+		user.LastUpdate = at
+		if disabled {
+			user.TokensValidAfter = at
+			user.TokenVersion++
+		}
+	})
+}
+
+func (m *memoryUsers) RequirePasswordReset(ctx context.Context, id primitive.ObjectID, tokenHash string, expiry, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.MustResetPassword = true
+		user.ResetTokenHash = tokenHash
+		user.ResetTokenExpiry = expiry
+		user.TokensValidAfter = at
+		user.TokenVersion++
+		user.LastUpdate = at
+	})
+}
+
+func (m *memoryUsers) UpdatePassword(ctx context.Context, id primitive.ObjectID, passwordHash string, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.Password = passwordHash
+		user.MustResetPassword = false
+		user.ResetTokenHash = ""
+		user.ResetTokenExpiry = time.Time{}
+		user.TokensValidAfter = at
+		user.TokenVersion++
+		user.LastUpdate = at
+	})
+}
+
+func (m *memoryUsers) SetTOTPPendingSecret(ctx context.Context, id primitive.ObjectID, secret string, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.TOTPPendingSecret = secret
+		user.LastUpdate = at
+	})
+}
+
+func (m *memoryUsers) EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, counter int64, recoveryCodes []string, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.TOTPEnabled = true
+		user.TOTPSecret = secret
+		user.TOTPPendingSecret = ""
+		user.TOTPLastCounter = counter
+		user.RecoveryCodes = append([]string(nil), recoveryCodes...)
+		user.LastUpdate = at
+	})
+}
+
+func (m *memoryUsers) DisableTOTP(ctx context.Context, id primitive.ObjectID, revokeTokens bool, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPPendingSecret = ""
+		user.TOTPLastCounter = 0
+		user.RecoveryCodes = nil
+		user.LastUpdate = at
+		if revokeTokens {
+			user.TokensValidAfter = at
+			user.TokenVersion++
+		}
+	})
+}
+
+func (m *memoryUsers) SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, recoveryCodes []string, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.RecoveryCodes = append([]string(nil), recoveryCodes...)
+		user.LastUpdate = at
+	})
+}
+
+func (m *memoryUsers) AdvanceTOTPCounter(ctx context.Context, id primitive.ObjectID, counter int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.items[id]
+	if !ok || user.TOTPLastCounter >= counter {
+		return false, nil
+	}
+	user.TOTPLastCounter = counter
+	m.items[id] = user
+	return true, nil
+}
+
+func (m *memoryUsers) ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.items[id]
+	if !ok {
+		return false, nil
+	}
+	remaining := []string{}
+	for _, hash := range user.RecoveryCodes {
+		if hash != codeHash {
+			remaining = append(remaining, hash)
+		}
+	}
+	if len(remaining) == len(user.RecoveryCodes) {
+		return false, nil
+	}
+	user.RecoveryCodes = remaining
+	m.items[id] = user
+	return true, nil
+}
+
+func (m *memoryUsers) StartMFAChallenge(ctx context.Context, id primitive.ObjectID, challenge string) error {
+	return m.update(id, func(user *model.User) {
+		user.MFAChallenge = challenge
+		user.MFAFailures = 0
+	})
+}
+
+func (m *memoryUsers) RecordMFAFailure(ctx context.Context, id primitive.ObjectID, challenge string, maxFailures int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.items[id]
+	if !ok || user.MFAChallenge != challenge {
+		return true, nil
+	}
+	user.MFAFailures++
+	burned := user.MFAFailures >= maxFailures
+	if burned {
+		user.MFAChallenge = ""
+		user.MFAFailures = 0
+	}
+	m.items[id] = user
+	return burned, nil
+}
+
+func (m *memoryUsers) EndMFAChallenge(ctx context.Context, id primitive.ObjectID, challenge string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.items[id]
+	if !ok || user.MFAChallenge != challenge {
+		return false, nil
+	}
+	user.MFAChallenge = ""
+	user.MFAFailures = 0
+	m.items[id] = user
+	return true, nil
+}
+
+func (m *memoryUsers) AddIdentity(ctx context.Context, id primitive.ObjectID, identity model.LinkedIdentity, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		user.Identities = append(user.Identities, identity)
+		user.LastUpdate = at
+	})
+}
+
+func (m *memoryUsers) RemoveIdentity(ctx context.Context, id primitive.ObjectID, provider string, at time.Time) error {
+	return m.update(id, func(user *model.User) {
+		remaining := []model.LinkedIdentity{}
+		for _, identity := range user.Identities {
+			if identity.Provider != provider {
+				remaining = append(remaining, identity)
+			}
+		}
+		user.Identities = remaining
+		user.LastUpdate = at
+	})
+}
+
+type memoryAPIKeys struct {
+	mu    sync.Mutex
+	items map[primitive.ObjectID]model.APIKey
+}
+
+func (m *memoryAPIKeys) Create(ctx context.Context, key *model.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+	m.items[key.ID] = *key
+	return nil
+}
+
+func (m *memoryAPIKeys) FindByHash(ctx context.Context, keyHash string) (*model.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range m.items {
+		if key.KeyHash == keyHash {
+			return &key, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryAPIKeys) List(ctx context.Context, includeRevoked bool, page Page) ([]model.APIKey, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []model.APIKey{}
+	for _, key := range m.items {
+		if includeRevoked || !key.Revoked {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.After(keys[j].Created) })
+	return paginate(keys, page), int64(len(keys)), nil
+}
+
+func (m *memoryAPIKeys) Revoke(ctx context.Context, id primitive.ObjectID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.items[id]
+	if !ok || key.Revoked {
+		return ErrNotFound
+	}
+	key.Revoked = true
+	m.items[id] = key
+	return nil
+}
+
+func (m *memoryAPIKeys) TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, ok := m.items[id]
+	if !ok {
+		return ErrNotFound
+	}
+	key.LastUsed = at
+	m.items[id] = key
+	return nil
+}
+
+type memoryAuditLogs struct {
+	mu      sync.Mutex
+	entries []model.AuditLog
+}
+
+func (m *memoryAuditLogs) Insert(ctx context.Context, entry *model.AuditLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	m.entries = append(m.entries, *entry)
+	return nil
+}
+
+func (m *memoryAuditLogs) List(ctx context.Context, filter AuditFilter, page Page) ([]model.AuditLog, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []model.AuditLog{}
+	for _, entry := range m.entries {
+		if filter.Action != "" && entry.Action != filter.Action {
+			continue
+		}
+		if !filter.TargetID.IsZero() && entry.TargetID != filter.TargetID {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Created.After(entries[j].Created) })
+	return paginate(entries, page), int64(len(entries)), nil
+}
+
+type memoryAuthStates struct {
+	mu    sync.Mutex
+	items map[string]model.AuthState // keyed by state
+}
+
+func (m *memoryAuthStates) Insert(ctx context.Context, state *model.AuthState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state.ID.IsZero() {
+		state.ID = primitive.NewObjectID()
+	}
+	m.items[state.State] = *state
+	return nil
+}
+
+func (m *memoryAuthStates) Consume(ctx context.Context, provider, state string) (*model.AuthState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	authState, ok := m.items[state]
+	if !ok || authState.Provider != provider {
+		return nil, ErrNotFound
+	}
+	delete(m.items, state)
+	return &authState, nil
+}
+
+func (m *memoryAuthStates) DeleteExpired(ctx context.Context, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for state, authState := range m.items {
+		if authState.Expires.Before(now) {
+			delete(m.items, state)
+		}
+	}
+	return nil
+}
+
+type memoryFlags struct {
+	mu    sync.Mutex
+	items map[string]model.FeatureFlag
+}
+
+func cloneFlag(flag model.FeatureFlag) model.FeatureFlag {
+	flag.UserIDs = append([]string(nil), flag.UserIDs...)
+	flag.Roles = append([]string(nil), flag.Roles...)
+	flag.Variants = append([]model.FlagVariant(nil), flag.Variants...)
+	return flag
+}
+
+func (m *memoryFlags) List(ctx context.Context) ([]model.FeatureFlag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	flags := []model.FeatureFlag{}
+	for _, flag := range m.items {
+		flags = append(flags, cloneFlag(flag))
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Key < flags[j].Key })
+	return flags, nil
+}
+
+func (m *memoryFlags) FindByKey(ctx context.Context, key string) (*model.FeatureFlag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	flag, ok := m.items[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	flag = cloneFlag(flag)
+	return &flag, nil
+}
+
+func (m *memoryFlags) Create(ctx context.Context, flag *model.FeatureFlag) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[flag.Key]; ok {
+		return ErrDuplicate
+	}
+	if flag.ID.IsZero() {
+		flag.ID = primitive.NewObjectID()
+	}
+	m.items[flag.Key] = cloneFlag(*flag)
+	return nil
+}
+
+func (m *memoryFlags) Update(ctx context.Context, flag *model.FeatureFlag) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.items[flag.Key]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := cloneFlag(*flag)
+	updated.ID = existing.ID
+	m.items[flag.Key] = updated
+	return nil
+}
+
+func (m *memoryFlags) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.items, key)
+	return nil
+}
+
+type memoryRateLimits struct {
+	mu    sync.Mutex
+	items map[string]model.RateLimitBucket
+}
+
+func (m *memoryRateLimits) Find(ctx context.Context, key string) (*model.RateLimitBucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket, ok := m.items[key]
+	if !ok || bucket.Expires.Before(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return &bucket, nil
+}
+
+func (m *memoryRateLimits) Save(ctx context.Context, bucket model.RateLimitBucket, previous time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.items[bucket.Key]
+	if ok && stored.Expires.Before(time.Now()) {
+		ok = false
+	}
+	if ok != !previous.IsZero() || (ok && !stored.Updated.Equal(previous)) {
+		return false, nil
+	}
+	m.items[bucket.Key] = bucket
+	return true, nil
+}
+
+type memoryIdempotency struct {
+	mu    sync.Mutex
+	items map[string]model.IdempotencyRecord
+}
+
+func (m *memoryIdempotency) Create(ctx context.Context, record model.IdempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, ok := m.items[record.Key]; ok && !stored.Expires.Before(time.Now()) {
+		return ErrDuplicate
+	}
+	m.items[record.Key] = record
+	return nil
+}
+
+func (m *memoryIdempotency) Find(ctx context.Context, key string) (*model.IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.items[key]
+	if !ok || record.Expires.Before(time.Now()) {
+		return nil, ErrNotFound
+	}
+	record.Body = append([]byte(nil), record.Body...)
+	return &record, nil
+}
+
+func (m *memoryIdempotency) Complete(ctx context.Context, record model.IdempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[record.Key]; !ok {
+		return ErrNotFound
+	}
+	record.Body = append([]byte(nil), record.Body...)
+	m.items[record.Key] = record
+	return nil
+}
+
+func (m *memoryIdempotency) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+	return nil
+}
@@ -0,0 +1,338 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// migrationLockID is the _id of the document that keeps instances
+	// from migrating at the same time
+	migrationLockID = "lock"
+	// migrationLockTTL lets another instance take over the lock of one
+	// that died while migrating. The holder renews it every third of that.
+	migrationLockTTL  = time.Minute
+	migrationLockPoll = time.Second
+)
+
+// ErrMigrationLockLost is the cause of a migration cancelled because its
+// lock expired or was taken over
+var ErrMigrationLockLost = errors.New("migration lock lost")
+
+// Migration is a versioned change to the database. Up must be safe to run
+// again after a partial failure; Down undoes Up.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+	Down    func(ctx context.Context, db *mongo.Database) error
+}
+
+// MigrationStatus is a migration and when it was applied, zero if pending
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied time.Time
+}
+
+// migrationStore records applied migrations and holds the lock
+type migrationStore interface {
+	Applied(ctx context.Context) ([]model.Migration, error)
+	Record(ctx context.Context, migration model.Migration) error
+	Unrecord(ctx context.Context, version int) error
+	// Lock takes the lock for owner if it is free or expired, reporting
+	// false if someone else holds it
+	Lock(ctx context.Context, owner string, expires time.Time) (bool, error)
+	// Renew extends the lock of owner, reporting false if owner lost it
+	Renew(ctx context.Context, owner string, expires time.Time) (bool, error)
+	Unlock(ctx context.Context, owner string) error
+}
+
+// Migrator applies migrations in version order and records them in the
+// migrations collection
+type Migrator struct {
+	db         *mongo.Database
+	store      migrationStore
+	migrations []Migration
+	lockTTL    time.Duration
+	lockPoll   time.Duration
+}
+
+func NewMigrator(db *mongo.Database, migrations []Migration) *Migrator {
+	return newMigrator(db, &mongoMigrations{db.Collection(model.Migration{}.TableName())}, migrations)
+}
+
+func newMigrator(db *mongo.Database, store migrationStore, migrations []Migration) *Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return &Migrator{db: db, store: store, migrations: sorted, lockTTL: migrationLockTTL, lockPoll: migrationLockPoll}
+}
+
+// Status lists every known migration, and applied ones the code no longer
+// knows about
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = record.Applied
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, record := range applied {
+		statuses = append(statuses, MigrationStatus{Version: record.Version, Name: record.Name, Applied: record.Applied})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Pending returns the migrations that have not been applied
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies the pending migrations up to and including version target, or
+// all of them when target is 0, and returns the applied ones
+func (m *Migrator) Up(ctx context.Context, target int) ([]Migration, error) {
+	ctx, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return nil, lockError(ctx, err)
+	}
+	var done []Migration
+	for _, migration := range pending {
+		if target > 0 && migration.Version > target {
+			break
+		}
+		if err := migration.Up(ctx, m.db); err != nil {
+			return done, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, lockError(ctx, err))
+		}
+		record := model.Migration{Version: migration.Version, Name: migration.Name, Applied: time.Now()}
+		if err := m.store.Record(ctx, record); err != nil {
+			return done, fmt.Errorf("record migration %d: %w", migration.Version, lockError(ctx, err))
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down reverts the latest steps applied migrations and returns the reverted
+// ones
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	ctx, unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, lockError(ctx, err)
+	}
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	known := map[int]Migration{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+
+	var done []Migration
+	for _, version := range versions {
+		if len(done) == steps {
+			break
+		}
+		migration, ok := known[version]
+		if !ok {
+			return done, fmt.Errorf("migration %d %s is applied but unknown to this version", version, applied[version].Name)
+		}
+		if err := migration.Down(ctx, m.db); err != nil {
+			return done, fmt.Errorf("revert migration %d %s: %w", migration.Version, migration.Name, lockError(ctx, err))
+		}
+		if err := m.store.Unrecord(ctx, version); err != nil {
+			return done, fmt.Errorf("unrecord migration %d: %w", version, lockError(ctx, err))
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]model.Migration, error) {
+	records, err := m.store.Applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list applied migrations: %w", err)
+	}
+	applied := make(map[int]model.Migration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// lock waits until this process holds the migration lock and renews it in
+// the background. The returned context is cancelled with
+// ErrMigrationLockLost once the lock can no longer be renewed; the returned
+// function releases the lock.
+func (m *Migrator) lock(ctx context.Context) (context.Context, func(), error) {
+	host, _ := os.Hostname()
+	owner := host + ":" + strconv.Itoa(os.Getpid()) + ":" + primitive.NewObjectID().Hex()
+	for {
+		expires := time.Now().Add(m.lockTTL)
+		locked, err := m.store.Lock(ctx, owner, expires)
+		if err != nil {
+			return nil, nil, fmt.Errorf("take migration lock: %w", err)
+		}
+		if locked {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("wait for migration lock: %w", ctx.Err())
+		case <-time.After(m.lockPoll):
+		}
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		m.renew(lockCtx, owner, cancel)
+	}()
+
+	return lockCtx, func() {
+		cancel(context.Canceled)
+		<-stopped
+		// Release even if the migration ran out of time
+		_ = m.store.Unlock(context.WithoutCancel(ctx), owner)
+	}, nil
+}
+
+// renew extends the lock until ctx is done. Failed renewals are retried
+// until the lock expires.
+func (m *Migrator) renew(ctx context.Context, owner string, cancel context.CancelCauseFunc) {
+	expires := time.Now().Add(m.lockTTL)
+	ticker := time.NewTicker(m.lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		next := time.Now().Add(m.lockTTL)
+		renewed, err := m.store.Renew(ctx, owner, next)
+		switch {
+		case err == nil && !renewed:
+			cancel(ErrMigrationLockLost)
+			return
+		case err == nil:
+			expires = next
+		case time.Now().After(expires):
+			cancel(fmt.Errorf("%w: %v", ErrMigrationLockLost, err))
+			return
+		}
+	}
+}
+
+// lockError reports a lost lock instead of the cancellation it caused
+func lockError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrMigrationLockLost) {
+		return cause
+	}
+	return err
+}
+
+type mongoMigrations struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoMigrations) Applied(ctx context.Context) ([]model.Migration, error) {
+	return findAll[model.Migration](ctx, m.collection, bson.M{"_id": bson.M{"$type": "number"}})
+}
+
+func (m *mongoMigrations) Record(ctx context.Context, migration model.Migration) error {
+	_, err := m.collection.InsertOne(ctx, migration)
+	return err
+}
+
+func (m *mongoMigrations) Unrecord(ctx context.Context, version int) error {
+	_, err := m.collection.DeleteOne(ctx, bson.M{"_id": version})
+	return err
+}
+
+func (m *mongoMigrations) Lock(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	_, err := m.collection.DeleteOne(ctx, bson.M{"_id": migrationLockID, "expires": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return false, fmt.Errorf("clear stale migration lock: %w", err)
+	}
+	_, err = m.collection.InsertOne(ctx, bson.M{"_id": migrationLockID, "owner": owner, "expires": expires})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *mongoMigrations) Renew(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	filter := bson.M{"_id": migrationLockID, "owner": owner}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"expires": expires}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (m *mongoMigrations) Unlock(ctx context.Context, owner string) error {
+	_, err := m.collection.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner})
+	return err
+}
+
+// Server error codes
+const (
+	namespaceNotFound = 26
+	indexNotFound     = 27
+)
+
+// ignoreNamespaceErrors treats dropping what does not exist as done, so
+// Down can run after a partial Up
+func ignoreNamespaceErrors(err error) error {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && (cmdErr.Code == namespaceNotFound || cmdErr.Code == indexNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,304 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memoryMigrations is an in-memory migrationStore
+type memoryMigrations struct {
+	mu          sync.Mutex
+	applied     map[int]model.Migration
+	owner       string
+	lockExpires time.Time
+}
+
+func newMemoryMigrations(applied ...model.Migration) *memoryMigrations {
+	store := &memoryMigrations{applied: map[int]model.Migration{}}
+	for _, migration := range applied {
+		store.applied[migration.Version] = migration
+	}
+	return store
+}
+
+func (m *memoryMigrations) Applied(ctx context.Context) ([]model.Migration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []model.Migration
+	for _, record := range m.applied {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (m *memoryMigrations) Record(ctx context.Context, migration model.Migration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied[migration.Version] = migration
+	return nil
+}
+
+func (m *memoryMigrations) Unrecord(ctx context.Context, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.applied, version)
+	return nil
+}
+
+func (m *memoryMigrations) Lock(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owner != "" && time.Now().Before(m.lockExpires) {
+		return false, nil
+	}
+	m.owner, m.lockExpires = owner, expires
+	return true, nil
+}
+
+func (m *memoryMigrations) Renew(ctx context.Context, owner string, expires time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owner != owner {
+		return false, nil
+	}
+	m.lockExpires = expires
+	return true, nil
+}
+
+func (m *memoryMigrations) Unlock(ctx context.Context, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owner == owner {
+		m.owner = ""
+	}
+	return nil
+}
+
+// recorder builds migrations that log their runs
+type recorder struct {
+	mu  sync.Mutex
+	log []string
+}
+
+func (r *recorder) migration(version int, name string) Migration {
+	run := func(direction string) func(ctx context.Context, db *mongo.Database) error {
+		return func(ctx context.Context, db *mongo.Database) error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.log = append(r.log, direction+" "+name)
+			return nil
+		}
+	}
+	return Migration{Version: version, Name: name, Up: run("up"), Down: run("down")}
+}
+
+func (r *recorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log := r.log
+	r.log = nil
+	return log
+}
+
+func newTestMigrator(store migrationStore, migrations ...Migration) *Migrator {
+	m := newMigrator(nil, store, migrations)
+	m.lockTTL, m.lockPoll = 60*time.Millisecond, 5*time.Millisecond
+	return m
+}
+
+func names(migrations []Migration) []string {
+	var names []string
+	for _, migration := range migrations {
+		names = append(names, migration.Name)
+	}
+	return names
+}
+
+func expectStatuses(t *testing.T, m *Migrator, want map[int]bool) {
+	t.Helper()
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[int]bool{}
+	for i, status := range statuses {
+		if i > 0 && statuses[i-1].Version >= status.Version {
+			t.Fatalf("statuses not sorted by version: %+v", statuses)
+		}
+		got[status.Version] = !status.Applied.IsZero()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("applied versions are %v, want %v", got, want)
+	}
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	ctx := context.Background()
+	r := &recorder{}
+	m := newTestMigrator(newMemoryMigrations(), r.migration(3, "third"), r.migration(1, "first"), r.migration(2, "second"))
+
+	tests := []struct {
+		name     string
+		run      func() ([]Migration, error)
+		done     []string
+		log      []string
+		statuses map[int]bool
+	}{
+		{"up to a version", func() ([]Migration, error) { return m.Up(ctx, 2) },
+			[]string{"first", "second"}, []string{"up first", "up second"}, map[int]bool{1: true, 2: true, 3: false}},
+		{"up to an applied version", func() ([]Migration, error) { return m.Up(ctx, 2) },
+			nil, nil, map[int]bool{1: true, 2: true, 3: false}},
+		{"up to the latest", func() ([]Migration, error) { return m.Up(ctx, 0) },
+			[]string{"third"}, []string{"up third"}, map[int]bool{1: true, 2: true, 3: true}},
+		{"down by steps", func() ([]Migration, error) { return m.Down(ctx, 2) },
+			[]string{"third", "second"}, []string{"down third", "down second"}, map[int]bool{1: true, 2: false, 3: false}},
+		{"down past the first", func() ([]Migration, error) { return m.Down(ctx, 5) },
+			[]string{"first"}, []string{"down first"}, map[int]bool{1: false, 2: false, 3: false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done, err := tt.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(done); !reflect.DeepEqual(got, tt.done) {
+				t.Errorf("returned %v, want %v", got, tt.done)
+			}
+			if got := r.take(); !reflect.DeepEqual(got, tt.log) {
+				t.Errorf("ran %v, want %v", got, tt.log)
+			}
+			expectStatuses(t, m, tt.statuses)
+		})
+	}
+}
+
+func TestMigratorFailure(t *testing.T) {
+	ctx := context.Background()
+	r := &recorder{}
+	failing := r.migration(2, "failing")
+	failing.Up = func(ctx context.Context, db *mongo.Database) error { return errors.New("boom") }
+	m := newTestMigrator(newMemoryMigrations(), r.migration(1, "first"), failing, r.migration(3, "third"))
+
+	done, err := m.Up(ctx, 0)
+	if err == nil || !strings.Contains(err.Error(), "migration 2 failing: boom") {
+		t.Fatalf("Up returned %v, want the failure of migration 2", err)
+	}
+	if got := names(done); !reflect.DeepEqual(got, []string{"first"}) {
+		t.Fatalf("Up applied %v, want only the first migration", got)
+	}
+	expectStatuses(t, m, map[int]bool{1: true, 2: false, 3: false})
+}
+
+func TestMigratorUnknownApplied(t *testing.T) {
+	ctx := context.Background()
+	r := &recorder{}
+	store := newMemoryMigrations(
+		model.Migration{Version: 1, Name: "first", Applied: time.Now()},
+		model.Migration{Version: 9, Name: "from_a_newer_release", Applied: time.Now()},
+	)
+	m := newTestMigrator(store, r.migration(1, "first"), r.migration(2, "second"))
+
+	expectStatuses(t, m, map[int]bool{1: true, 2: false, 9: true})
+	pending, err := m.Pending(ctx)
+	if err != nil || !reflect.DeepEqual(names(pending), []string{"second"}) {
+		t.Fatalf("Pending returned %v, %v", names(pending), err)
+	}
+
+	// Up still applies what is pending, but Down cannot revert what it
+	// does not know
+	if _, err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	done, err := m.Down(ctx, 1)
+	if err == nil || !strings.Contains(err.Error(), "migration 9 from_a_newer_release is applied but unknown") {
+		t.Fatalf("Down returned %v, want an unknown migration error", err)
+	}
+	if len(done) != 0 || len(r.take()) != 1 {
+		t.Fatalf("Down reverted %v", names(done))
+	}
+}
+
+func TestMigratorLock(t *testing.T) {
+	store := newMemoryMigrations()
+	started, release := make(chan struct{}), make(chan struct{})
+	slow := Migration{Version: 1, Name: "slow",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			close(started)
+			<-release
+			return ctx.Err()
+		},
+	}
+	first := newTestMigrator(store, slow)
+	second := newTestMigrator(store, slow)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := first.Up(context.Background(), 0)
+		result <- err
+	}()
+	<-started
+
+	// The lock is renewed, so it outlives its TTL while the migration runs
+	ctx, cancel := context.WithTimeout(context.Background(), 4*first.lockTTL)
+	defer cancel()
+	if _, err := second.Up(ctx, 0); err == nil || !strings.Contains(err.Error(), "wait for migration lock") {
+		t.Fatalf("second migrator returned %v while the first held the lock", err)
+	}
+
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatalf("first migrator failed: %v", err)
+	}
+	done, err := second.Up(context.Background(), 0)
+	if err != nil || len(done) != 0 {
+		t.Fatalf("second migrator after the first returned %v, %v", names(done), err)
+	}
+}
+
+func TestMigratorLockLost(t *testing.T) {
+	store := newMemoryMigrations()
+	started := make(chan struct{})
+	m := newTestMigrator(store, Migration{Version: 1, Name: "long",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := m.Up(context.Background(), 0)
+		result <- err
+	}()
+	<-started
+
+	// Another instance takes over, e.g. after this one stalled past the TTL
+	store.mu.Lock()
+	store.owner = "other"
+	store.mu.Unlock()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrMigrationLockLost) {
+			t.Fatalf("Up returned %v, want ErrMigrationLockLost", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("migration kept running after losing the lock")
+	}
+	if store.owner != "other" {
+		t.Fatalf("lock of the new owner was released")
+	}
+	expectStatuses(t, m, map[int]bool{1: false})
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migrations are the schema migrations of the Mongo repositories. Append
+// new ones with the next version; never change one that has shipped.
+func Migrations() []Migration {
+	return []Migration{
+		{
+			// The indexes the services created at startup before they
+			// had migrations
+			Version: 1,
+			Name:    "required_indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return createIndexes(ctx, db, initialIndexes)
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				return dropIndexes(ctx, db, initialIndexes)
+			},
+		},
+		{
+			// Validators come from the model structs; when their schema
+			// tags change, add a migration that applies them again
+			Version: 2,
+			Name:    "schema_validators",
+			Up:      applyValidators,
+			Down:    removeValidators,
+		},
+	}
+}
+
+// initialIndexes is RequiredIndexes as migration 1 shipped it. Later
+// indexes are created by their own migrations.
+var initialIndexes = []Index{
+	{Collection: "users", Name: "username_unique", Keys: bson.D{{Key: "username", Value: 1}}, Unique: true},
+	{
+		Collection: "users",
+		Name:       "identity_unique",
+		Keys:       bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+		Unique:     true,
+		Partial:    bson.M{"identities.subject": bson.M{"$exists": true}},
+	},
+	{Collection: "api_keys", Name: "prefix_unique", Keys: bson.D{{Key: "Prefix", Value: 1}}, Unique: true},
+	{Collection: "auth_states", Name: "provider_state_unique", Keys: bson.D{{Key: "provider", Value: 1}, {Key: "state", Value: 1}}, Unique: true},
+	{Collection: "feature_flags", Name: "key_unique", Keys: bson.D{{Key: "Key", Value: 1}}, Unique: true},
+	{Collection: "carts", Name: "user_product", Keys: bson.D{{Key: "UserID", Value: 1}, {Key: "ProductID", Value: 1}}},
+	{Collection: "historys", Name: "user_created", Keys: bson.D{{Key: "UserID", Value: 1}, {Key: "Created", Value: -1}}},
+	{Collection: "coupons", Name: "user", Keys: bson.D{{Key: "UserID", Value: 1}}},
+	{Collection: "audit_logs", Name: "created", Keys: bson.D{{Key: "Created", Value: -1}}},
+	{Collection: "rate_limits", Name: "expires_ttl", Keys: bson.D{{Key: "expires", Value: 1}}, Expires: true},
+	{Collection: "idempotency_keys", Name: "expires_ttl", Keys: bson.D{{Key: "expires", Value: 1}}, Expires: true},
+}
@@ -0,0 +1,692 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongo returns repositories backed by the collections of db
+func NewMongo(db *mongo.Database) *Repositories {
+	return &Repositories{
+		Products:    &mongoProducts{db.Collection(model.Product{}.TableName())},
+		Categories:  &mongoCategories{db.Collection(model.Category{}.TableName())},
+		Carts:       &mongoCarts{db.Collection(model.Cart{}.TableName())},
+		Orders:      &mongoOrders{db.Collection(model.History{}.TableName())},
+		Coupons:     &mongoCoupons{db.Collection(model.Coupon{}.TableName())},
+		Users:       &mongoUsers{db.Collection(model.User{}.TableName())},
+		APIKeys:     &mongoAPIKeys{db.Collection(model.APIKey{}.TableName())},
+		AuditLogs:   &mongoAuditLogs{db.Collection(model.AuditLog{}.TableName())},
+		AuthStates:  &mongoAuthStates{db.Collection(model.AuthState{}.TableName())},
+		Flags:       &mongoFlags{db.Collection(model.FeatureFlag{}.TableName())},
+		RateLimits:  &mongoRateLimits{db.Collection(model.RateLimitBucket{}.TableName())},
+		Idempotency: &mongoIdempotency{db.Collection(model.IdempotencyRecord{}.TableName())},
+	}
+}
+
+func findOne[T any](ctx context.Context, collection *mongo.Collection, filter interface{}) (*T, error) {
+	var result T
+	err := collection.FindOne(ctx, filter).Decode(&result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func findAll[T any](ctx context.Context, collection *mongo.Collection, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	cursor, err := collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	results := []T{}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func findPage[T any](ctx context.Context, collection *mongo.Collection, filter interface{}, sort bson.D, page Page) ([]T, int64, error) {
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().SetSort(sort).SetSkip(page.Skip).SetLimit(page.Limit)
+	results, err := findAll[T](ctx, collection, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// updateByID applies update to the document with id, returning ErrNotFound
+// when there is none
+func updateByID(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, update bson.M) error {
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+var newestFirst = bson.D{{Key: "Created", Value: -1}}
+
+type mongoProducts struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoProducts) List(ctx context.Context, limit int) ([]model.Product, error) {
+	opts := options.Find()
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	return findAll[model.Product](ctx, m.collection, bson.M{}, opts)
+}
+
+func (m *mongoProducts) FindByField(ctx context.Context, field, value string) ([]model.Product, error) {
+	return findAll[model.Product](ctx, m.collection, bson.M{field: value})
+}
+
+func (m *mongoProducts) FindByID(ctx context.Context, id primitive.ObjectID) (*model.Product, error) {
+	return findOne[model.Product](ctx, m.collection, bson.M{"_id": id})
+}
+
+func (m *mongoProducts) FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]model.Product, error) {
+	if len(ids) == 0 {
+		return []model.Product{}, nil
+	}
+	return findAll[model.Product](ctx, m.collection, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (m *mongoProducts) DecrementStock(ctx context.Context, id primitive.ObjectID, quantity int) error {
+	filter := bson.M{"_id": id, "Stock": bson.M{"$gte": quantity}}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"Stock": -quantity}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+
+	if _, err := m.FindByID(ctx, id); err != nil {
+		return err
+	}
+	return ErrInsufficientStock
+}
+
+func (m *mongoProducts) IncrementStock(ctx context.Context, id primitive.ObjectID, quantity int) error {
+	result, err := m.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"Stock": quantity}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoCategories struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoCategories) List(ctx context.Context) ([]model.Category, error) {
+	return findAll[model.Category](ctx, m.collection, bson.M{})
+}
+
+func (m *mongoCategories) FindByID(ctx context.Context, id primitive.ObjectID) (*model.Category, error) {
+	return findOne[model.Category](ctx, m.collection, bson.M{"_id": id})
+}
+
+type mongoCarts struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoCarts) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]model.Cart, error) {
+	return findAll[model.Cart](ctx, m.collection, bson.M{"UserID": userID}, options.Find().SetSort(newestFirst))
+}
+
+func (m *mongoCarts) ListByCheckout(ctx context.Context, userID primitive.ObjectID, isCheckout bool) ([]model.Cart, error) {
+	return findAll[model.Cart](ctx, m.collection, bson.M{"UserID": userID, "IsCheckout": isCheckout})
+}
+
+func confirmedFilter(userID primitive.ObjectID) bson.M {
+	return bson.M{"UserID": userID, "IsCheckout": true, "IsConfirm": true}
+}
+
+func (m *mongoCarts) ListConfirmed(ctx context.Context, userID primitive.ObjectID) ([]model.Cart, error) {
+	return findAll[model.Cart](ctx, m.collection, confirmedFilter(userID))
+}
+
+func (m *mongoCarts) DeleteConfirmed(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := m.collection.DeleteMany(ctx, confirmedFilter(userID))
+	return err
+}
+
+func (m *mongoCarts) FindItem(ctx context.Context, userID, productID primitive.ObjectID) (*model.Cart, error) {
+	return findOne[model.Cart](ctx, m.collection, bson.M{"ProductID": productID, "UserID": userID})
+}
+
+func (m *mongoCarts) Insert(ctx context.Context, item *model.Cart) error {
+	if item.ID.IsZero() {
+		item.ID = primitive.NewObjectID()
+	}
+	_, err := m.collection.InsertOne(ctx, item)
+	return err
+}
+
+func (m *mongoCarts) Upsert(ctx context.Context, item model.Cart) error {
+	filter := bson.M{"ProductID": item.ProductID, "UserID": item.UserID}
+	update := bson.M{
+		"$set": bson.M{
+			"Quantity":   item.Quantity,
+			"IsCheckout": item.IsCheckout,
+			"IsConfirm":  item.IsConfirm,
+			"Created":    item.Created,
+		},
+	}
+	_, err := m.collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *mongoCarts) UpdateQuantity(ctx context.Context, userID, productID primitive.ObjectID, quantity int, at time.Time) error {
+	filter := bson.M{"ProductID": productID, "UserID": userID}
+	update := bson.M{"$set": bson.M{"Quantity": quantity, "Created": at}}
+	_, err := m.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (m *mongoCarts) DeleteItem(ctx context.Context, userID, productID primitive.ObjectID) error {
+	_, err := m.collection.DeleteOne(ctx, bson.M{"ProductID": productID, "UserID": userID})
+	return err
+}
+
+func expiredCheckoutFilter(before time.Time) bson.M {
+	return bson.M{"IsCheckout": true, "IsConfirm": false, "Created": bson.M{"$lt": before}}
+}
+
+func (m *mongoCarts) ListExpiredCheckouts(ctx context.Context, before time.Time) ([]model.Cart, error) {
+	return findAll[model.Cart](ctx, m.collection, expiredCheckoutFilter(before))
+}
+
+func (m *mongoCarts) DeleteExpiredCheckout(ctx context.Context, id primitive.ObjectID, before time.Time) (bool, error) {
+	filter := expiredCheckoutFilter(before)
+	filter["_id"] = id
+	result, err := m.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+type mongoOrders struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoOrders) InsertMany(ctx context.Context, items []model.History) error {
+	if len(items) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		docs = append(docs, item)
+	}
+	_, err := m.collection.InsertMany(ctx, docs)
+	return err
+}
+
+func (m *mongoOrders) ListByUser(ctx context.Context, userID primitive.ObjectID) ([]model.History, error) {
+	return findAll[model.History](ctx, m.collection, bson.M{"UserID": userID}, options.Find().SetSort(newestFirst))
+}
+
+type mongoCoupons struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoCoupons) FindByUser(ctx context.Context, userID primitive.ObjectID) (*model.Coupon, error) {
+	return findOne[model.Coupon](ctx, m.collection, bson.M{"UserID": userID})
+}
+
+func (m *mongoCoupons) AddAmount(ctx context.Context, userID primitive.ObjectID, amount int, at time.Time) error {
+	update := bson.M{
+		"$inc":         bson.M{"Amount": amount},
+		"$set":         bson.M{"LastUpdated": at},
+		"$setOnInsert": bson.M{"Created": at},
+	}
+	_, err := m.collection.UpdateOne(ctx, bson.M{"UserID": userID}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+type mongoUsers struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoUsers) FindByID(ctx context.Context, id primitive.ObjectID) (*model.User, error) {
+	return findOne[model.User](ctx, m.collection, bson.M{"_id": id})
+}
+
+func (m *mongoUsers) FindByUsername(ctx context.Context, username string) (*model.User, error) {
+	return findOne[model.User](ctx, m.collection, bson.M{"username": username})
+}
+
+func (m *mongoUsers) FindByIdentity(ctx context.Context, provider, subject string) (*model.User, error) {
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"provider": provider,
+		"subject":  subject,
+	}}}
+	return findOne[model.User](ctx, m.collection, filter)
+}
+
+func (m *mongoUsers) Search(ctx context.Context, filter UserFilter, page Page) ([]model.User, int64, error) {
+	query := bson.M{}
+	if filter.Query != "" {
+		query["username"] = bson.M{"$regex": regexp.QuoteMeta(filter.Query), "$options": "i"}
+	}
+	if filter.Role != "" {
+		query["role"] = filter.Role
+	}
+	if filter.Disabled != nil {
+		query["disabled"] = *filter.Disabled
+	}
+	return findPage[model.User](ctx, m.collection, query, bson.D{{Key: "username", Value: 1}}, page)
+}
+
+func (m *mongoUsers) Create(ctx context.Context, user *model.User) error {
+	count, err := m.collection.CountDocuments(ctx, bson.M{"username": user.Username})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicate
+	}
+
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	_, err = m.collection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m *mongoUsers) UpdateRole(ctx context.Context, id primitive.ObjectID, role string, at time.Time) error {
+	return updateByID(ctx, m.collection, id, bson.M{"$set": bson.M{"role": role, "last_update": at}})
+}
+
+func (m *mongoUsers) SetDisabled(ctx context.Context, id primitive.ObjectID, disabled bool, at time.Time) error {
+	update := bson.M{"$set": bson.M{"disabled": disabled, "last_update": at}}
+	if disabled {
+		// Revoke outstanding tokens so re-enabling does not revive them
+		withTokenRevocation(update, at)
+	}
+	return updateByID(ctx, m.collection, id, update)
+}
+
+func (m *mongoUsers) RequirePasswordReset(ctx context.Context, id primitive.ObjectID, tokenHash string, expiry, at time.Time) error {
+	update := bson.M{
+		"$set": bson.M{
+			"must_reset_password": true,
+			"reset_token_hash":    tokenHash,
+			"reset_token_expiry":  expiry,
+			"last_update":         at,
+		},
+	}
+	withTokenRevocation(update, at)
+	return updateByID(ctx, m.collection, id, update)
+}
+
+func (m *mongoUsers) UpdatePassword(ctx context.Context, id primitive.ObjectID, passwordHash string, at time.Time) error {
+	update := bson.M{
+		"$set": bson.M{
+			"password":            passwordHash,
+			"must_reset_password": false,
+			"last_update":         at,
+		},
+		"$unset": bson.M{
+			"reset_token_hash":   "",
+			"reset_token_expiry": "",
+		},
+	}
+	withTokenRevocation(update, at)
+	return updateByID(ctx, m.collection, id, update)
+}
+
+func (m *mongoUsers) SetTOTPPendingSecret(ctx context.Context, id primitive.ObjectID, secret string, at time.Time) error {
+	return updateByID(ctx, m.collection, id, bson.M{"$set": bson.M{"totp_pending_secret": secret, "last_update": at}})
+}
+
+func (m *mongoUsers) EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, counter int64, recoveryCodes []string, at time.Time) error {
+	update := bson.M{
+		"$set": bson.M{
+			"totp_enabled":      true,
+			"totp_secret":       secret,
+			"totp_last_counter": counter,
+			"recovery_codes":    recoveryCodes,
+			"last_update":       at,
+		},
+		"$unset": bson.M{"totp_pending_secret": ""},
+	}
+	return updateByID(ctx, m.collection, id, update)
+}
+
+func (m *mongoUsers) DisableTOTP(ctx context.Context, id primitive.ObjectID, revokeTokens bool, at time.Time) error {
+	update := bson.M{
+		"$set": bson.M{"totp_enabled": false, "last_update": at},
+		"$unset": bson.M{
+			"totp_secret":         "",
+			"totp_pending_secret": "",
+			"totp_last_counter":   "",
+			"recovery_codes":      "",
+		},
+	}
+	if revokeTokens {
+		withTokenRevocation(update, at)
+	}
+	return updateByID(ctx, m.collection, id, update)
+}
+
+// withTokenRevocation adds the revocation of the user's tokens to update:
+// bumping the version invalidates every token issued before, even in the
+// same second
+func withTokenRevocation(update bson.M, at time.Time) {
+	update["$set"].(bson.M)["tokens_valid_after"] = at
+	update["$inc"] = bson.M{"token_version": 1}
+}
+
+func (m *mongoUsers) SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, recoveryCodes []string, at time.Time) error {
+	return updateByID(ctx, m.collection, id, bson.M{"$set": bson.M{"recovery_codes": recoveryCodes, "last_update": at}})
+}
+
+func (m *mongoUsers) AdvanceTOTPCounter(ctx context.Context, id primitive.ObjectID, counter int64) (bool, error) {
+	filter := bson.M{"_id": id, "totp_last_counter": bson.M{"$not": bson.M{"$gte": counter}}}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp_last_counter": counter}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (m *mongoUsers) ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, codeHash string) (bool, error) {
+	filter := bson.M{"_id": id, "recovery_codes": codeHash}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"recovery_codes": codeHash}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (m *mongoUsers) StartMFAChallenge(ctx context.Context, id primitive.ObjectID, challenge string) error {
+	return updateByID(ctx, m.collection, id, bson.M{"$set": bson.M{"mfa_challenge": challenge, "mfa_failures": 0}})
+}
+
+func (m *mongoUsers) RecordMFAFailure(ctx context.Context, id primitive.ObjectID, challenge string, maxFailures int) (bool, error) {
+	filter := bson.M{"_id": id, "mfa_challenge": challenge}
+	var user model.User
+	err := m.collection.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"mfa_failures": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if user.MFAFailures < maxFailures {
+		return false, nil
+	}
+	_, err = m.EndMFAChallenge(ctx, id, challenge)
+	return err == nil, err
+}
+
+func (m *mongoUsers) EndMFAChallenge(ctx context.Context, id primitive.ObjectID, challenge string) (bool, error) {
+	filter := bson.M{"_id": id, "mfa_challenge": challenge}
+	result, err := m.collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"mfa_challenge": "", "mfa_failures": ""}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (m *mongoUsers) AddIdentity(ctx context.Context, id primitive.ObjectID, identity model.LinkedIdentity, at time.Time) error {
+	update := bson.M{
+		"$push": bson.M{"identities": identity},
+		"$set":  bson.M{"last_update": at},
+	}
+	return updateByID(ctx, m.collection, id, update)
+}
+
+func (m *mongoUsers) RemoveIdentity(ctx context.Context, id primitive.ObjectID, provider string, at time.Time) error {
+	update := bson.M{
+		"$pull": bson.M{"identities": bson.M{"provider": provider}},
+		"$set":  bson.M{"last_update": at},
+	}
+	return updateByID(ctx, m.collection, id, update)
+}
+
+type mongoAPIKeys struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoAPIKeys) Create(ctx context.Context, key *model.APIKey) error {
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+	_, err := m.collection.InsertOne(ctx, key)
+	return err
+}
+
+func (m *mongoAPIKeys) FindByHash(ctx context.Context, keyHash string) (*model.APIKey, error) {
+	return findOne[model.APIKey](ctx, m.collection, bson.M{"KeyHash": keyHash})
+}
+
+func (m *mongoAPIKeys) List(ctx context.Context, includeRevoked bool, page Page) ([]model.APIKey, int64, error) {
+	filter := bson.M{}
+	if !includeRevoked {
+		filter["Revoked"] = false
+	}
+	return findPage[model.APIKey](ctx, m.collection, filter, newestFirst, page)
+}
+
+func (m *mongoAPIKeys) Revoke(ctx context.Context, id primitive.ObjectID) error {
+	result, err := m.collection.UpdateOne(ctx, bson.M{"_id": id, "Revoked": false}, bson.M{"$set": bson.M{"Revoked": true}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *mongoAPIKeys) TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	return updateByID(ctx, m.collection, id, bson.M{"$set": bson.M{"LastUsed": at}})
+}
+
+type mongoAuditLogs struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoAuditLogs) Insert(ctx context.Context, entry *model.AuditLog) error {
+	if entry.ID.IsZero() {
+		entry.ID = primitive.NewObjectID()
+	}
+	_, err := m.collection.InsertOne(ctx, entry)
+	return err
+}
+
+func (m *mongoAuditLogs) List(ctx context.Context, filter AuditFilter, page Page) ([]model.AuditLog, int64, error) {
+	query := bson.M{}
+	if filter.Action != "" {
+		query["Action"] = filter.Action
+	}
+	if !filter.TargetID.IsZero() {
+		query["TargetID"] = filter.TargetID
+	}
+	return findPage[model.AuditLog](ctx, m.collection, query, newestFirst, page)
+}
+
+type mongoAuthStates struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoAuthStates) Insert(ctx context.Context, state *model.AuthState) error {
+	if state.ID.IsZero() {
+		state.ID = primitive.NewObjectID()
+	}
+	_, err := m.collection.InsertOne(ctx, state)
+	return err
+}
+
+func (m *mongoAuthStates) Consume(ctx context.Context, provider, state string) (*model.AuthState, error) {
+	var authState model.AuthState
+	filter := bson.M{"state": state, "provider": provider}
+	err := m.collection.FindOneAndDelete(ctx, filter).Decode(&authState)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authState, nil
+}
+
+func (m *mongoAuthStates) DeleteExpired(ctx context.Context, now time.Time) error {
+	_, err := m.collection.DeleteMany(ctx, bson.M{"expires": bson.M{"$lt": now}})
+	return err
+}
+
+type mongoFlags struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoFlags) List(ctx context.Context) ([]model.FeatureFlag, error) {
+	return findAll[model.FeatureFlag](ctx, m.collection, bson.M{}, options.Find().SetSort(bson.D{{Key: "Key", Value: 1}}))
+}
+
+func (m *mongoFlags) FindByKey(ctx context.Context, key string) (*model.FeatureFlag, error) {
+	return findOne[model.FeatureFlag](ctx, m.collection, bson.M{"Key": key})
+}
+
+func (m *mongoFlags) Create(ctx context.Context, flag *model.FeatureFlag) error {
+	count, err := m.collection.CountDocuments(ctx, bson.M{"Key": flag.Key})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicate
+	}
+
+	if flag.ID.IsZero() {
+		flag.ID = primitive.NewObjectID()
+	}
+	_, err = m.collection.InsertOne(ctx, flag)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m *mongoFlags) Update(ctx context.Context, flag *model.FeatureFlag) error {
+	replacement := *flag
+	replacement.ID = primitive.NilObjectID
+	result, err := m.collection.ReplaceOne(ctx, bson.M{"Key": flag.Key}, replacement)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *mongoFlags) Delete(ctx context.Context, key string) error {
+	result, err := m.collection.DeleteOne(ctx, bson.M{"Key": key})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoRateLimits struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoRateLimits) Find(ctx context.Context, key string) (*model.RateLimitBucket, error) {
+	return findOne[model.RateLimitBucket](ctx, m.collection, bson.M{"_id": key})
+}
+
+func (m *mongoRateLimits) Save(ctx context.Context, bucket model.RateLimitBucket, previous time.Time) (bool, error) {
+	if previous.IsZero() {
+		// An expired bucket the TTL monitor has not removed yet is replaced
+		_, err := m.collection.DeleteOne(ctx, bson.M{"_id": bucket.Key, "expires": bson.M{"$lt": time.Now()}})
+		if err != nil {
+			return false, err
+		}
+		_, err = m.collection.InsertOne(ctx, bucket)
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	update := bson.M{"$set": bson.M{"tokens": bucket.Tokens, "updated": bucket.Updated, "expires": bucket.Expires}}
+	result, err := m.collection.UpdateOne(ctx, bson.M{"_id": bucket.Key, "updated": previous}, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+type mongoIdempotency struct {
+	collection *mongo.Collection
+}
+
+func (m *mongoIdempotency) Create(ctx context.Context, record model.IdempotencyRecord) error {
+	// An expired record the TTL monitor has not removed yet is replaced
+	_, err := m.collection.DeleteOne(ctx, bson.M{"_id": record.Key, "expires": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	_, err = m.collection.InsertOne(ctx, record)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m *mongoIdempotency) Find(ctx context.Context, key string) (*model.IdempotencyRecord, error) {
+	return findOne[model.IdempotencyRecord](ctx, m.collection, bson.M{"_id": key, "expires": bson.M{"$gte": time.Now()}})
+}
+
+func (m *mongoIdempotency) Complete(ctx context.Context, record model.IdempotencyRecord) error {
+	result, err := m.collection.ReplaceOne(ctx, bson.M{"_id": record.Key}, record)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *mongoIdempotency) Delete(ctx context.Context, key string) error {
+	_, err := m.collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
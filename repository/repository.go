@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrNotFound          = errors.New("not found")
+	ErrDuplicate         = errors.New("duplicate")
+	ErrInsufficientStock = errors.New("insufficient stock")
+)
+
+// Repositories bundles every repository used by the services
+type Repositories struct {
+	Products    ProductRepository
+	Categories  CategoryRepository
+	Carts       CartRepository
+	Orders      OrderRepository
+	Coupons     CouponRepository
+	Users       UserRepository
+	APIKeys     APIKeyRepository
+	AuditLogs   AuditLogRepository
+	AuthStates  AuthStateRepository
+	Flags       FeatureFlagRepository
+	RateLimits  RateLimitRepository
+	Idempotency IdempotencyRepository
+}
+
+// Page selects a slice of a sorted listing
+type Page struct {
+	Skip  int64
+	Limit int64
+}
+
+type ProductRepository interface {
+	// List returns up to limit products, or all of them when limit is 0
+	List(ctx context.Context, limit int) ([]model.Product, error)
+	// FindByField returns the products whose field equals value
+	FindByField(ctx context.Context, field, value string) ([]model.Product, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (*model.Product, error)
+	FindByIDs(ctx context.Context, ids []primitive.ObjectID) ([]model.Product, error)
+	// DecrementStock atomically takes quantity items out of stock. It returns
+	// ErrInsufficientStock, and leaves the stock untouched, when fewer are left.
+	DecrementStock(ctx context.Context, id primitive.ObjectID, quantity int) error
+	// IncrementStock puts quantity items back into stock
+	IncrementStock(ctx context.Context, id primitive.ObjectID, quantity int) error
+}
+
+type CategoryRepository interface {
+	List(ctx context.Context) ([]model.Category, error)
+	FindByID(ctx context.Context, id primitive.ObjectID) (*model.Category, error)
+}
+
+type CartRepository interface {
+	// ListByUser returns all cart items of a user, newest first
+	ListByUser(ctx context.Context, userID primitive.ObjectID) ([]model.Cart, error)
+	ListByCheckout(ctx context.Context, userID primitive.ObjectID, isCheckout bool) ([]model.Cart, error)
+	ListConfirmed(ctx context.Context, userID primitive.ObjectID) ([]model.Cart, error)
+	DeleteConfirmed(ctx context.Context, userID primitive.ObjectID) error
+	FindItem(ctx context.Context, userID, productID primitive.ObjectID) (*model.Cart, error)
+	Insert(ctx context.Context, item *model.Cart) error
+	// Upsert sets quantity, status and creation time of the user's item for
+	// the product, creating it if needed
+	Upsert(ctx context.Context, item model.Cart) error
+	UpdateQuantity(ctx context.Context, userID, productID primitive.ObjectID, quantity int, at time.Time) error
+	DeleteItem(ctx context.Context, userID, productID primitive.ObjectID) error
+	// ListExpiredCheckouts returns checked out but unconfirmed items created
+	// before the given time
+	ListExpiredCheckouts(ctx context.Context, before time.Time) ([]model.Cart, error)
+	// DeleteExpiredCheckout deletes the item only if it is still an expired,
+	// unconfirmed checkout, and reports whether it did
+	DeleteExpiredCheckout(ctx context.Context, id primitive.ObjectID, before time.Time) (bool, error)
+}
+
+// OrderRepository stores confirmed purchases (the history collection)
+type OrderRepository interface {
+	InsertMany(ctx context.Context, items []model.History) error
+	// ListByUser returns all order lines of a user, newest first
+	ListByUser(ctx context.Context, userID primitive.ObjectID) ([]model.History, error)
+}
+
+type CouponRepository interface {
+	FindByUser(ctx context.Context, userID primitive.ObjectID) (*model.Coupon, error)
+	// AddAmount atomically adds amount to the user's coupon balance, creating
+	// the coupon on first use
+	AddAmount(ctx context.Context, userID primitive.ObjectID, amount int, at time.Time) error
+}
+
+// UserFilter narrows a user search. Empty fields match everything.
+type UserFilter struct {
+	Query    string
+	Role     string
+	Disabled *bool
+}
+
+type UserRepository interface {
+	FindByID(ctx context.Context, id primitive.ObjectID) (*model.User, error)
+	FindByUsername(ctx context.Context, username string) (*model.User, error)
+	FindByIdentity(ctx context.Context, provider, subject string) (*model.User, error)
+	// Search returns one page of matching users sorted by username, and the
+	// total number of matches
+	Search(ctx context.Context, filter UserFilter, page Page) ([]model.User, int64, error)
+	// Create inserts user, returning ErrDuplicate if the username is taken
+	Create(ctx context.Context, user *model.User) error
+
+	UpdateRole(ctx context.Context, id primitive.ObjectID, role string, at time.Time) error
+	// SetDisabled toggles the account. Disabling also revokes issued tokens.
+	SetDisabled(ctx context.Context, id primitive.ObjectID, disabled bool, at time.Time) error
+	// RequirePasswordReset revokes issued tokens and stores a reset token hash
+	RequirePasswordReset(ctx context.Context, id primitive.ObjectID, tokenHash string, expiry, at time.Time) error
+	// UpdatePassword sets a new password hash, clears any pending reset and
+	// revokes issued tokens
+	UpdatePassword(ctx context.Context, id primitive.ObjectID, passwordHash string, at time.Time) error
+
+	SetTOTPPendingSecret(ctx context.Context, id primitive.ObjectID, secret string, at time.Time) error
+	EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, counter int64, recoveryCodes []string, at time.Time) error
+	// DisableTOTP removes the TOTP enrollment, optionally revoking tokens
+	DisableTOTP(ctx context.Context, id primitive.ObjectID, revokeTokens bool, at time.Time) error
+	SetRecoveryCodes(ctx context.Context, id primitive.ObjectID, recoveryCodes []string, at time.Time) error
+	// AdvanceTOTPCounter records a used TOTP time step. It reports false when
+	// the step, or a later one, was already used.
+	AdvanceTOTPCounter(ctx context.Context, id primitive.ObjectID, counter int64) (bool, error)
+	// ConsumeRecoveryCode removes a recovery code hash, reporting whether the
+	// user had it
+	ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, codeHash string) (bool, error)
+	// StartMFAChallenge makes challenge the user's current two-factor
+	// challenge, replacing any earlier one
+	StartMFAChallenge(ctx context.Context, id primitive.ObjectID, challenge string) error
+	// RecordMFAFailure counts a wrong code against challenge and burns the
+	// challenge on the maxFailures-th one. It reports whether challenge is
+	// burned.
+	RecordMFAFailure(ctx context.Context, id primitive.ObjectID, challenge string, maxFailures int) (bool, error)
+	// EndMFAChallenge consumes challenge, reporting false if it is not the
+	// current one
+	EndMFAChallenge(ctx context.Context, id primitive.ObjectID, challenge string) (bool, error)
+
+	AddIdentity(ctx context.Context, id primitive.ObjectID, identity model.LinkedIdentity, at time.Time) error
+	RemoveIdentity(ctx context.Context, id primitive.ObjectID, provider string, at time.Time) error
+}
+
+type APIKeyRepository interface {
+	Create(ctx context.Context, key *model.APIKey) error
+	FindByHash(ctx context.Context, keyHash string) (*model.APIKey, error)
+	// List returns one page of keys, newest first, and the total count
+	List(ctx context.Context, includeRevoked bool, page Page) ([]model.APIKey, int64, error)
+	// Revoke returns ErrNotFound if no active key has id
+	Revoke(ctx context.Context, id primitive.ObjectID) error
+	TouchLastUsed(ctx context.Context, id primitive.ObjectID, at time.Time) error
+}
+
+// AuditFilter narrows an audit log listing. Empty fields match everything.
+type AuditFilter struct {
+	Action   string
+	TargetID primitive.ObjectID
+}
+
+type AuditLogRepository interface {
+	Insert(ctx context.Context, entry *model.AuditLog) error
+	// List returns one page of entries, newest first, and the total count
+	List(ctx context.Context, filter AuditFilter, page Page) ([]model.AuditLog, int64, error)
+}
+
+type AuthStateRepository interface {
+	Insert(ctx context.Context, state *model.AuthState) error
+	// Consume deletes and returns the state, so each state is used once
+	Consume(ctx context.Context, provider, state string) (*model.AuthState, error)
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
+
+// RateLimitRepository stores token buckets shared by all instances. Save
+// is a compare-and-swap, so concurrent requests cannot spend the same token.
+type RateLimitRepository interface {
+	// Find returns ErrNotFound when the key has no bucket
+	Find(ctx context.Context, key string) (*model.RateLimitBucket, error)
+	// Save stores bucket if the stored bucket was last updated at previous,
+	// or does not exist when previous is zero. It reports false if another
+	// request changed the bucket first.
+	Save(ctx context.Context, bucket model.RateLimitBucket, previous time.Time) (bool, error)
+}
+
+// IdempotencyRepository stores idempotency records. Expired records count
+// as missing even before they are removed.
+type IdempotencyRepository interface {
+	// Create stores a new record, or returns ErrDuplicate if its key is
+	// taken
+	Create(ctx context.Context, record model.IdempotencyRecord) error
+	Find(ctx context.Context, key string) (*model.IdempotencyRecord, error)
+	// Complete replaces the record with its completed version
+	Complete(ctx context.Context, record model.IdempotencyRecord) error
+	Delete(ctx context.Context, key string) error
+}
+
+type FeatureFlagRepository interface {
+	// List returns all flags ordered by key
+	List(ctx context.Context) ([]model.FeatureFlag, error)
+	FindByKey(ctx context.Context, key string) (*model.FeatureFlag, error)
+	// Create returns ErrDuplicate when the key is taken
+	Create(ctx context.Context, flag *model.FeatureFlag) error
+	// Update replaces the flag with the same key, or returns ErrNotFound
+	Update(ctx context.Context, flag *model.FeatureFlag) error
+	Delete(ctx context.Context, key string) error
+}
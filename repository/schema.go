@@ -0,0 +1,319 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// schemaModels are the models whose collections get a $jsonSchema
+// validator
+var schemaModels = []interface{ TableName() string }{
+	model.Product{},
+	model.Category{},
+	model.Cart{},
+	model.History{},
+	model.Coupon{},
+	model.User{},
+}
+
+// Validator is the $jsonSchema validator of a collection
+type Validator struct {
+	Collection string
+	Schema     bson.M
+}
+
+// Validators generates the validators of every schema model
+func Validators() ([]Validator, error) {
+	var validators []Validator
+	for _, m := range schemaModels {
+		schema, err := Schema(m)
+		if err != nil {
+			return nil, err
+		}
+		validators = append(validators, Validator{Collection: m.TableName(), Schema: schema})
+	}
+	return validators, nil
+}
+
+// Schema builds the $jsonSchema of a model. Field names and types come from
+// the struct and its bson tags; schema tags add rules, comma separated:
+//
+//	required             the field must be present
+//	min=N, max=N         bounds of a number
+//	minLength=N          minimum length of a string
+//	maxLength=N          maximum length of a string
+//	enum=a|b             allowed string values
+//
+// Unknown fields are allowed, so documents may carry data the model lacks.
+func Schema(doc interface{}) (bson.M, error) {
+	t := reflect.TypeOf(doc)
+	schema, err := objectSchema(t)
+	if err != nil {
+		return nil, fmt.Errorf("schema of %s: %w", t.Name(), err)
+	}
+	return schema, nil
+}
+
+func objectSchema(t reflect.Type) (bson.M, error) {
+	properties := bson.M{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("bson"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			// The driver's default name
+			name = strings.ToLower(field.Name)
+		}
+
+		property, err := fieldSchema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field.Name, err)
+		}
+		rules, err := parseSchemaTag(field.Tag.Get("schema"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field.Name, err)
+		}
+		if _, ok := rules["required"]; ok {
+			required = append(required, name)
+			delete(rules, "required")
+		}
+		for key, value := range rules {
+			property[key] = value
+		}
+		properties[name] = property
+	}
+
+	schema := bson.M{"bsonType": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema, nil
+}
+
+// fieldSchema maps a Go type to the BSON types the driver encodes it as.
+// Nil slices, maps and pointers are stored as null.
+func fieldSchema(t reflect.Type) (bson.M, error) {
+	switch {
+	case t == objectIDType:
+		return bson.M{"bsonType": "objectId"}, nil
+	case t == timeType:
+		return bson.M{"bsonType": "date"}, nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return bson.M{"bsonType": bson.A{"binData", "null"}}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return bson.M{"bsonType": "string"}, nil
+	case reflect.Bool:
+		return bson.M{"bsonType": "bool"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return bson.M{"bsonType": bson.A{"int", "long"}}, nil
+	case reflect.Float32, reflect.Float64:
+		return bson.M{"bsonType": "number"}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := fieldSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"bsonType": bson.A{"array", "null"}, "items": items}, nil
+	case reflect.Map:
+		return bson.M{"bsonType": bson.A{"object", "null"}}, nil
+	case reflect.Struct:
+		return objectSchema(t)
+	case reflect.Ptr:
+		schema, err := fieldSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"anyOf": bson.A{schema, bson.M{"bsonType": "null"}}}, nil
+	case reflect.Interface:
+		return bson.M{}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", t)
+}
+
+func parseSchemaTag(tag string) (bson.M, error) {
+	rules := bson.M{}
+	if tag == "" {
+		return rules, nil
+	}
+	for _, rule := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+			rules[key] = true
+		case "min", "max":
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("schema rule %q: %w", rule, err)
+			}
+			rules[map[string]string{"min": "minimum", "max": "maximum"}[key]] = n
+		case "minLength", "maxLength":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("schema rule %q: must be a non-negative integer", rule)
+			}
+			rules[key] = n
+		case "enum":
+			values := bson.A{}
+			for _, v := range strings.Split(value, "|") {
+				values = append(values, v)
+			}
+			rules[key] = values
+		default:
+			return nil, fmt.Errorf("unknown schema rule %q", rule)
+		}
+	}
+	return rules, nil
+}
+
+// applyValidators installs the validators, creating missing collections.
+// Validation is moderate: documents that already violate the schema can
+// still be updated, but new violations are rejected.
+func applyValidators(ctx context.Context, db *mongo.Database) error {
+	validators, err := Validators()
+	if err != nil {
+		return err
+	}
+	for _, v := range validators {
+		validator := bson.M{"$jsonSchema": v.Schema}
+		err := db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: v.Collection},
+			{Key: "validator", Value: validator},
+			{Key: "validationLevel", Value: "moderate"},
+			{Key: "validationAction", Value: "error"},
+		}).Err()
+		var cmdErr mongo.CommandError
+		if errors.As(err, &cmdErr) && cmdErr.Code == namespaceNotFound {
+			err = db.CreateCollection(ctx, v.Collection, options.CreateCollection().
+				SetValidator(validator).
+				SetValidationLevel("moderate").
+				SetValidationAction("error"))
+		}
+		if err != nil {
+			return fmt.Errorf("set validator of %s: %w", v.Collection, err)
+		}
+	}
+	return nil
+}
+
+func removeValidators(ctx context.Context, db *mongo.Database) error {
+	for _, m := range schemaModels {
+		err := db.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: m.TableName()},
+			{Key: "validator", Value: bson.M{}},
+			{Key: "validationLevel", Value: "off"},
+		}).Err()
+		if err := ignoreNamespaceErrors(err); err != nil {
+			return fmt.Errorf("remove validator of %s: %w", m.TableName(), err)
+		}
+	}
+	return nil
+}
+
+// SchemaViolation counts the documents of a collection that break the rules
+// of one field
+type SchemaViolation struct {
+	Collection string
+	Field      string
+	Count      int64
+	// Samples are the IDs of some violating documents
+	Samples []interface{}
+}
+
+// violationFinder counts the documents of a collection that match a filter
+// and returns the IDs of up to samples of them
+type violationFinder interface {
+	FindViolations(ctx context.Context, collection string, filter bson.M, samples int) (int64, []interface{}, error)
+}
+
+// AuditSchemas reports the existing documents that violate the validators,
+// field by field, with up to samples IDs each
+func AuditSchemas(ctx context.Context, db *mongo.Database, samples int) ([]SchemaViolation, error) {
+	return auditSchemas(ctx, &mongoViolations{db}, samples)
+}
+
+func auditSchemas(ctx context.Context, finder violationFinder, samples int) ([]SchemaViolation, error) {
+	validators, err := Validators()
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []SchemaViolation
+	for _, v := range validators {
+		properties := v.Schema["properties"].(bson.M)
+		required, _ := v.Schema["required"].([]string)
+
+		fields := make([]string, 0, len(properties))
+		for field := range properties {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		for _, field := range fields {
+			schema := bson.M{"properties": bson.M{field: properties[field]}}
+			for _, name := range required {
+				if name == field {
+					schema["required"] = bson.A{field}
+				}
+			}
+			filter := bson.M{"$nor": bson.A{bson.M{"$jsonSchema": schema}}}
+			count, ids, err := finder.FindViolations(ctx, v.Collection, filter, samples)
+			if err != nil {
+				return nil, fmt.Errorf("audit %s.%s: %w", v.Collection, field, err)
+			}
+			if count > 0 {
+				violations = append(violations, SchemaViolation{Collection: v.Collection, Field: field, Count: count, Samples: ids})
+			}
+		}
+	}
+	return violations, nil
+}
+
+type mongoViolations struct {
+	db *mongo.Database
+}
+
+func (m *mongoViolations) FindViolations(ctx context.Context, collection string, filter bson.M, samples int) (int64, []interface{}, error) {
+	coll := m.db.Collection(collection)
+	count, err := coll.CountDocuments(ctx, filter)
+	if err != nil || count == 0 || samples <= 0 {
+		return count, nil, err
+	}
+
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(int64(samples))
+	docs, err := findAll[bson.M](ctx, coll, filter, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc["_id"])
+	}
+	return count, ids, nil
+}
@@ -0,0 +1,304 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dianerwansyah/web-cart-backend/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	objectIDSchema = bson.M{"bsonType": "objectId"}
+	dateSchema     = bson.M{"bsonType": "date"}
+	stringSchema   = bson.M{"bsonType": "string"}
+	boolSchema     = bson.M{"bsonType": "bool"}
+	intSchema      = bson.M{"bsonType": bson.A{"int", "long"}}
+)
+
+func TestSchemaModels(t *testing.T) {
+	tests := []struct {
+		model      interface{ TableName() string }
+		required   []string
+		properties map[string]bson.M
+	}{
+		{model.Product{}, []string{"Name", "Price", "Stock"}, map[string]bson.M{
+			"_id":            objectIDSchema,
+			"Name":           {"bsonType": "string", "minLength": 1},
+			"Description":    stringSchema,
+			"Price":          {"bsonType": "number", "minimum": 0.0},
+			"ImageURL":       stringSchema,
+			"Stock":          {"bsonType": bson.A{"int", "long"}, "minimum": 0.0},
+			"CategoryID":     {"bsonType": bson.A{"array", "null"}, "items": stringSchema},
+			"Created":        dateSchema,
+			"LastUpdate":     dateSchema,
+			"LastUpdateByID": objectIDSchema,
+		}},
+		{model.Category{}, []string{"name"}, map[string]bson.M{
+			"_id":               objectIDSchema,
+			"name":              {"bsonType": "string", "minLength": 1},
+			"description":       stringSchema,
+			"created":           dateSchema,
+			"last_update":       dateSchema,
+			"last_update_by_id": objectIDSchema,
+		}},
+		{model.Cart{}, []string{"ProductID", "UserID", "Quantity"}, map[string]bson.M{
+			"_id":        objectIDSchema,
+			"ProductID":  objectIDSchema,
+			"UserID":     objectIDSchema,
+			"Quantity":   {"bsonType": bson.A{"int", "long"}, "minimum": 1.0},
+			"IsCheckout": boolSchema,
+			"IsConfirm":  boolSchema,
+			"Created":    dateSchema,
+		}},
+		{model.History{}, []string{"ProductID", "UserID", "Quantity"}, map[string]bson.M{
+			"_id":        objectIDSchema,
+			"IDTrx":      objectIDSchema,
+			"ProductID":  objectIDSchema,
+			"UserID":     objectIDSchema,
+			"Quantity":   {"bsonType": bson.A{"int", "long"}, "minimum": 1.0},
+			"IsCheckout": boolSchema,
+			"IsConfirm":  boolSchema,
+			"Created":    dateSchema,
+		}},
+		{model.Coupon{}, []string{"UserID"}, map[string]bson.M{
+			"_id":         objectIDSchema,
+			"UserID":      objectIDSchema,
+			"Amount":      {"bsonType": bson.A{"int", "long"}, "minimum": 0.0},
+			"Created":     dateSchema,
+			"LastUpdated": dateSchema,
+		}},
+		{model.User{}, []string{"username", "role"}, map[string]bson.M{
+			"_id":                 objectIDSchema,
+			"username":            {"bsonType": "string", "minLength": 1},
+			"password":            stringSchema,
+			"role":                {"bsonType": "string", "enum": bson.A{"admin", "user"}},
+			"disabled":            boolSchema,
+			"must_reset_password": boolSchema,
+			"reset_token_hash":    stringSchema,
+			"reset_token_expiry":  dateSchema,
+			"tokens_valid_after":  dateSchema,
+			"token_version":       intSchema,
+			"totp_enabled":        boolSchema,
+			"totp_secret":         stringSchema,
+			"totp_pending_secret": stringSchema,
+			"totp_last_counter":   intSchema,
+			"recovery_codes":      {"bsonType": bson.A{"array", "null"}, "items": stringSchema},
+			"mfa_challenge":       stringSchema,
+			"mfa_failures":        intSchema,
+			"identities": {"bsonType": bson.A{"array", "null"}, "items": bson.M{
+				"bsonType": "object",
+				"properties": bson.M{
+					"provider": stringSchema,
+					"subject":  stringSchema,
+					"email":    stringSchema,
+					"linked":   dateSchema,
+				},
+			}},
+			"created":     dateSchema,
+			"last_update": dateSchema,
+		}},
+	}
+	if len(tests) != len(schemaModels) {
+		t.Fatalf("%d models tested, %d have a schema", len(tests), len(schemaModels))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model.TableName(), func(t *testing.T) {
+			schema, err := Schema(tt.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if schema["bsonType"] != "object" {
+				t.Errorf("bsonType is %v, want object", schema["bsonType"])
+			}
+			if required, _ := schema["required"].([]string); !reflect.DeepEqual(required, tt.required) {
+				t.Errorf("required is %v, want %v", required, tt.required)
+			}
+
+			properties := schema["properties"].(bson.M)
+			for name, want := range tt.properties {
+				if got := properties[name]; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s is %v, want %v", name, got, want)
+				}
+			}
+			for name := range properties {
+				if _, ok := tt.properties[name]; !ok {
+					t.Errorf("unexpected property %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaTypes(t *testing.T) {
+	type nested struct {
+		Label string `bson:"label" schema:"required,maxLength=8"`
+	}
+	type doc struct {
+		Pointer  *int               `bson:"pointer" schema:"max=10"`
+		Struct   *nested            `bson:"struct"`
+		Bytes    []byte             `bson:"bytes"`
+		Array    [2]int             `bson:"array"`
+		Map      map[string]string  `bson:"map"`
+		Any      interface{}        `bson:"any"`
+		Time     time.Time          `bson:"time"`
+		ID       primitive.ObjectID `bson:"id"`
+		Float    float32            `bson:"float" schema:"min=-1.5"`
+		Default  string
+		Skipped  string `bson:"-"`
+		internal string
+	}
+
+	schema, err := Schema(doc{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{
+		"bsonType": "object",
+		"properties": bson.M{
+			"pointer": bson.M{"anyOf": bson.A{intSchema, bson.M{"bsonType": "null"}}, "maximum": 10.0},
+			"struct": bson.M{"anyOf": bson.A{
+				bson.M{
+					"bsonType":   "object",
+					"properties": bson.M{"label": bson.M{"bsonType": "string", "maxLength": 8}},
+					"required":   []string{"label"},
+				},
+				bson.M{"bsonType": "null"},
+			}},
+			"bytes":   bson.M{"bsonType": bson.A{"binData", "null"}},
+			"array":   bson.M{"bsonType": bson.A{"array", "null"}, "items": intSchema},
+			"map":     bson.M{"bsonType": bson.A{"object", "null"}},
+			"any":     bson.M{},
+			"time":    dateSchema,
+			"id":      objectIDSchema,
+			"float":   bson.M{"bsonType": "number", "minimum": -1.5},
+			"default": stringSchema,
+		},
+	}
+	if !reflect.DeepEqual(schema, want) {
+		t.Fatalf("Schema returned\n%v\nwant\n%v", schema, want)
+	}
+}
+
+func TestSchemaErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     interface{}
+		wantErr string
+	}{
+		{"unknown rule", struct {
+			Name string `schema:"required,unique"`
+		}{}, `Name: unknown schema rule "unique"`},
+		{"bad bound", struct {
+			Stock int `schema:"min=none"`
+		}{}, `Stock: schema rule "min=none"`},
+		{"negative length", struct {
+			Name string `schema:"minLength=-1"`
+		}{}, `Name: schema rule "minLength=-1": must be a non-negative integer`},
+		{"unsupported type", struct {
+			Notify chan int
+		}{}, "Notify: unsupported type chan int"},
+		{"nested unknown rule", struct {
+			Items []struct {
+				Name string `schema:"pattern=^a"`
+			}
+		}{}, `Items: Name: unknown schema rule "pattern=^a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Schema(tt.doc)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Schema returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeViolations returns canned violations by collection and field, and
+// records the filters it was asked for
+type fakeViolations struct {
+	counts  map[string]int64
+	fail    string
+	filters map[string]bson.M
+}
+
+func (f *fakeViolations) FindViolations(ctx context.Context, collection string, filter bson.M, samples int) (int64, []interface{}, error) {
+	schema := filter["$nor"].(bson.A)[0].(bson.M)["$jsonSchema"].(bson.M)
+	var field string
+	for name := range schema["properties"].(bson.M) {
+		field = name
+	}
+	key := collection + "." + field
+	f.filters[key] = schema
+	if key == f.fail {
+		return 0, nil, errors.New("connection reset")
+	}
+	count := f.counts[key]
+	var ids []interface{}
+	for i := int64(0); i < count && i < int64(samples); i++ {
+		ids = append(ids, i)
+	}
+	return count, ids, nil
+}
+
+func TestAuditSchemas(t *testing.T) {
+	ctx := context.Background()
+	finder := &fakeViolations{
+		counts: map[string]int64{
+			"carts.Quantity": 7,
+			"users.role":     1,
+			"carts.Created":  2,
+		},
+		filters: map[string]bson.M{},
+	}
+
+	violations, err := auditSchemas(ctx, finder, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SchemaViolation{
+		{Collection: "carts", Field: "Created", Count: 2, Samples: []interface{}{int64(0), int64(1)}},
+		{Collection: "carts", Field: "Quantity", Count: 7, Samples: []interface{}{int64(0), int64(1), int64(2)}},
+		{Collection: "users", Field: "role", Count: 1, Samples: []interface{}{int64(0)}},
+	}
+	if !reflect.DeepEqual(violations, want) {
+		t.Fatalf("auditSchemas returned %+v, want %+v", violations, want)
+	}
+
+	// Every field is audited on its own, required only where the model says so
+	validators, err := Validators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range validators {
+		for field, property := range v.Schema["properties"].(bson.M) {
+			key := v.Collection + "." + field
+			schema, ok := finder.filters[key]
+			if !ok {
+				t.Errorf("%s was not audited", key)
+				continue
+			}
+			if !reflect.DeepEqual(schema["properties"], bson.M{field: property}) {
+				t.Errorf("%s audited with %v", key, schema["properties"])
+			}
+			wantRequired := false
+			for _, name := range v.Schema["required"].([]string) {
+				wantRequired = wantRequired || name == field
+			}
+			if _, required := schema["required"]; required != wantRequired {
+				t.Errorf("%s audited with required %v, want %v", key, required, wantRequired)
+			}
+		}
+	}
+
+	finder.fail = "historys.Quantity"
+	if _, err := auditSchemas(ctx, finder, 3); err == nil || err.Error() != "audit historys.Quantity: connection reset" {
+		t.Fatalf("auditSchemas returned %v, want the failure of historys.Quantity", err)
+	}
+}